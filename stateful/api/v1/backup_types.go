@@ -0,0 +1,126 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Phases of a backup run and of a restore
+const (
+	PhasePending   = "Pending"
+	PhaseRunning   = "Running"
+	PhaseCompleted = "Completed"
+	PhaseFailed    = "Failed"
+)
+
+// BackupStorage selects the PVC the dumps are written to
+type BackupStorage struct {
+	// Existing PVC to use; when empty a PVC named <backup>-backups is created
+	ClaimName string `json:"claimName,omitempty"`
+	// Size of the created PVC (default 1Gi)
+	Size string `json:"size,omitempty"`
+}
+
+// DatabaseBackupSpec defines the desired state of DatabaseBackup
+type DatabaseBackupSpec struct {
+	// Database to back up, in the same namespace
+	Database string `json:"database"`
+	// Database inside postgres to dump (default postgres)
+	DBName string `json:"dbname,omitempty"`
+	// Schedule in standard cron format, e.g. "0 2 * * *"; a single backup is taken when empty
+	Schedule string `json:"schedule,omitempty"`
+	// Number of completed backups to keep (default 5)
+	Retention *int32 `json:"retention,omitempty"`
+	// Where the dumps are stored
+	Storage BackupStorage `json:"storage,omitempty"`
+}
+
+// BackupRecord describes one backup run
+type BackupRecord struct {
+	// Job that took the backup
+	JobName string `json:"jobName"`
+	// Path of the dump on the PVC
+	File string `json:"file"`
+	// Phase is one of Running/Completed/Failed
+	Phase          string       `json:"phase"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Size of the dump in bytes
+	Size int64 `json:"size,omitempty"`
+	// SHA-256 of the dump
+	Checksum string `json:"checksum,omitempty"`
+	// Error of a failed run
+	Message string `json:"message,omitempty"`
+}
+
+// DatabaseBackupStatus defines the observed state of DatabaseBackup
+type DatabaseBackupStatus struct {
+	// Phase of the latest run, Pending until the first one starts
+	Phase string `json:"phase,omitempty"`
+	// Why the backup is Pending
+	Message string `json:"message,omitempty"`
+	// PVC holding the dumps
+	ClaimName string `json:"claimName,omitempty"`
+	// Last time a scheduled run was started
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	// Kept runs, newest first
+	Backups []BackupRecord `json:"backups,omitempty"`
+}
+
+// DatabaseBackup is the Schema for the DatabaseBackup Custom Resource
+type DatabaseBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DatabaseBackupSpec   `json:"spec,omitempty"`
+	Status DatabaseBackupStatus `json:"status,omitempty"`
+}
+
+// DatabaseBackupList contains a list of DatabaseBackup
+type DatabaseBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DatabaseBackup `json:"items"`
+}
+
+// DatabaseRestoreSpec defines the desired state of DatabaseRestore
+type DatabaseRestoreSpec struct {
+	// Database to restore into, in the same namespace
+	Database string `json:"database"`
+	// DatabaseBackup the dump comes from
+	Backup string `json:"backup"`
+	// Job name of the backup run to restore (default the latest completed one)
+	BackupJobName string `json:"backupJobName,omitempty"`
+	// Database inside postgres to restore into (default the dbname of the backup)
+	DBName string `json:"dbname,omitempty"`
+}
+
+// DatabaseRestoreStatus defines the observed state of DatabaseRestore
+type DatabaseRestoreStatus struct {
+	// Phase is one of Pending/Running/Completed/Failed
+	Phase string `json:"phase,omitempty"`
+	// Why the restore is Pending or Failed
+	Message string `json:"message,omitempty"`
+	// Job running pg_restore
+	JobName string `json:"jobName,omitempty"`
+	// Dump being restored and its expected SHA-256
+	File           string       `json:"file,omitempty"`
+	Checksum       string       `json:"checksum,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// DatabaseRestore is the Schema for the DatabaseRestore Custom Resource
+type DatabaseRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DatabaseRestoreSpec   `json:"spec,omitempty"`
+	Status DatabaseRestoreStatus `json:"status,omitempty"`
+}
+
+// DatabaseRestoreList contains a list of DatabaseRestore
+type DatabaseRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DatabaseRestore `json:"items"`
+}
@@ -4,6 +4,14 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// SecretKeyRef selects a key of a Secret in the namespace of the Database
+type SecretKeyRef struct {
+	// Name of the Secret
+	Name string `json:"name"`
+	// Key holding the value (default "password")
+	Key string `json:"key,omitempty"`
+}
+
 // DatabaseSpec defines the desired state of Database
 type DatabaseSpec struct {
 	// Name of the database (also used as StatefulSet name)
@@ -14,19 +22,117 @@ type DatabaseSpec struct {
 	Replicas int `json:"replicas"`
 	// Storage size e.g. "1Gi"
 	Storage string `json:"storage,omitempty"`
-	// Postgres password (for demo; in real world use Secrets)
+	// Deprecated: the password is stored in plain text in the CR, use PasswordSecretRef instead.
+	// Still honoured when set: it is moved into the generated credentials Secret.
 	Password string `json:"password,omitempty"`
+	// Secret holding the postgres password; when neither this nor Password is set, a random
+	// password is generated into a Secret named <databaseName>-credentials
+	PasswordSecretRef *SecretKeyRef `json:"passwordSecretRef,omitempty"`
 	// Optional image pull policy (IfNotPresent/Always)
 	ImagePullPolicy string `json:"imagePullPolicy,omitempty"`
+	// Roles to create in the postgres instance
+	Roles []RoleSpec `json:"roles,omitempty"`
+	// Databases to create in the postgres instance
+	Databases []LogicalDatabaseSpec `json:"databases,omitempty"`
+	// What happens to the data when the Database is deleted: Delete, Retain (default) or Snapshot
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+	// Networks clients and standbys may connect from, e.g. the pod CIDR of the cluster. Defaults
+	// to the private ranges 10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16, 100.64.0.0/10 and fc00::/7.
+	AllowedCIDRs []string `json:"allowedCIDRs,omitempty"`
+}
+
+// Deletion policies
+const (
+	// DeletionPolicyDelete deletes the data volumes with the Database
+	DeletionPolicyDelete = "Delete"
+	// DeletionPolicyRetain keeps the data volumes and credentials for a Database of the same databaseName
+	DeletionPolicyRetain = "Retain"
+	// DeletionPolicySnapshot keeps a final pg_dumpall and the credentials, and deletes the data volumes
+	DeletionPolicySnapshot = "Snapshot"
+)
+
+// RoleSpec is a postgres role. Roles removed from the spec are left in place.
+type RoleSpec struct {
+	Name      string `json:"name"`
+	Login     bool   `json:"login,omitempty"`
+	Superuser bool   `json:"superuser,omitempty"`
+	CreateDB  bool   `json:"createdb,omitempty"`
+	// Secret holding the role's password; the role has no password when unset
+	PasswordSecretRef *SecretKeyRef `json:"passwordSecretRef,omitempty"`
+}
+
+// LogicalDatabaseSpec is a database inside the postgres instance. Databases and extensions
+// removed from the spec are left in place.
+type LogicalDatabaseSpec struct {
+	Name string `json:"name"`
+	// Owning role (default postgres)
+	Owner string `json:"owner,omitempty"`
+	// Extensions created in the database, e.g. pgcrypto
+	Extensions []string `json:"extensions,omitempty"`
+}
+
+// SQLObjectStatus reports whether a role or database matches the spec
+type SQLObjectStatus struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+	// Error of the last attempt when not ready
+	Message string `json:"message,omitempty"`
+	// ResourceVersion of the password Secret last applied to a role
+	PasswordVersion string `json:"passwordVersion,omitempty"`
 }
 
+// StandbyStatus reports how far a standby trails the primary
+type StandbyStatus struct {
+	Pod string `json:"pod"`
+	// State from pg_stat_replication, e.g. streaming, or disconnected
+	State string `json:"state"`
+	// WAL bytes the standby has yet to replay
+	LagBytes int64 `json:"lagBytes"`
+	// Time since the last WAL the standby replayed was written on the primary
+	ReplayLagMillis int64 `json:"replayLagMillis"`
+}
+
+// Condition types reported in DatabaseStatus
+const (
+	// ConditionStorageResized means every data volume has the size in spec.storage
+	ConditionStorageResized = "StorageResized"
+	// ConditionFinalBackup reports the dump a Snapshot deletion policy takes before the volumes go
+	ConditionFinalBackup = "FinalBackup"
+)
+
 // DatabaseStatus defines the observed state of Database
 type DatabaseStatus struct {
 	// Phase is one of Pending/Running/Ready/Failed
 	Phase string `json:"phase,omitempty"`
 	// Number of ready replicas
 	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
-	// Conditions, optional in future
+	// Secret and key holding the postgres password in use
+	PasswordSecretRef *SecretKeyRef `json:"passwordSecretRef,omitempty"`
+	// Secret with host, port, user, password, dbname, uri and jdbcUrl for clients, set once
+	// the role it logs in as exists
+	ConnectionSecret string `json:"connectionSecret,omitempty"`
+	// Pod running the primary
+	Primary string `json:"primary,omitempty"`
+	// Services sending clients to the primary and to the standbys
+	ReadWriteService string `json:"readWriteService,omitempty"`
+	ReadOnlyService  string `json:"readOnlyService,omitempty"`
+	// Replication state of each standby
+	Standbys []StandbyStatus `json:"standbys,omitempty"`
+	// Roles and databases from the spec, in the same order
+	Roles     []SQLObjectStatus `json:"roles,omitempty"`
+	Databases []SQLObjectStatus `json:"databases,omitempty"`
+	// Role the standbys replicate with, once there are standbys
+	ReplicationRole *SQLObjectStatus `json:"replicationRole,omitempty"`
+	// Role the connection Secret logs in as
+	AppRole *SQLObjectStatus `json:"appRole,omitempty"`
+	// Image the StatefulSet runs; differs from spec.image until an upgrade completes
+	Image string `json:"image,omitempty"`
+	// Volume claim template holding the data, "data" until the first major upgrade
+	DataVolume string `json:"dataVolume,omitempty"`
+	// Latest upgrade, kept after it finished
+	Upgrade *UpgradeStatus `json:"upgrade,omitempty"`
+	// Latest observations of the Database, see the Condition types
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // Database is the Schema for the Database Custom Resource
@@ -1,22 +1,136 @@
 package v1
 
-import "k8s.io/apimachinery/pkg/runtime"
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
 
 // DeepCopyInto copies all properties of this object into another object of the
 // same type that is provided as a pointer.
 func (in *Database) DeepCopyInto(out *Database) {
 	out.TypeMeta = in.TypeMeta
-	out.ObjectMeta = in.ObjectMeta
-	out.Spec = DatabaseSpec{
-		DatabaseName:    in.Spec.DatabaseName,
-		Image:           in.Spec.Image,
-		Replicas:        in.Spec.Replicas,
-		Storage:         in.Spec.Storage,
-		Password:        in.Spec.Password,
-		ImagePullPolicy: in.Spec.ImagePullPolicy,
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopyInto copies the spec, including optional pointer fields
+func (in *DatabaseSpec) DeepCopyInto(out *DatabaseSpec) {
+	*out = *in
+	if in.PasswordSecretRef != nil {
+		out.PasswordSecretRef = new(SecretKeyRef)
+		*out.PasswordSecretRef = *in.PasswordSecretRef
+	}
+	if in.Roles != nil {
+		out.Roles = make([]RoleSpec, len(in.Roles))
+		for i := range in.Roles {
+			in.Roles[i].DeepCopyInto(&out.Roles[i])
+		}
+	}
+	if in.Databases != nil {
+		out.Databases = make([]LogicalDatabaseSpec, len(in.Databases))
+		for i := range in.Databases {
+			in.Databases[i].DeepCopyInto(&out.Databases[i])
+		}
+	}
+	if in.AllowedCIDRs != nil {
+		out.AllowedCIDRs = make([]string, len(in.AllowedCIDRs))
+		copy(out.AllowedCIDRs, in.AllowedCIDRs)
+	}
+}
+
+// DeepCopyInto copies the role, including its password reference
+func (in *RoleSpec) DeepCopyInto(out *RoleSpec) {
+	*out = *in
+	if in.PasswordSecretRef != nil {
+		out.PasswordSecretRef = new(SecretKeyRef)
+		*out.PasswordSecretRef = *in.PasswordSecretRef
+	}
+}
+
+// DeepCopyInto copies the database, including its extensions
+func (in *LogicalDatabaseSpec) DeepCopyInto(out *LogicalDatabaseSpec) {
+	*out = *in
+	if in.Extensions != nil {
+		out.Extensions = make([]string, len(in.Extensions))
+		copy(out.Extensions, in.Extensions)
+	}
+}
+
+// DeepCopyInto copies the status, including optional pointer fields
+func (in *DatabaseStatus) DeepCopyInto(out *DatabaseStatus) {
+	*out = *in
+	if in.PasswordSecretRef != nil {
+		out.PasswordSecretRef = new(SecretKeyRef)
+		*out.PasswordSecretRef = *in.PasswordSecretRef
+	}
+	if in.Upgrade != nil {
+		out.Upgrade = new(UpgradeStatus)
+		in.Upgrade.DeepCopyInto(out.Upgrade)
+	}
+	if in.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(in.Conditions))
+		for i := range in.Conditions {
+			in.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+	if in.Standbys != nil {
+		out.Standbys = make([]StandbyStatus, len(in.Standbys))
+		copy(out.Standbys, in.Standbys)
+	}
+	if in.Roles != nil {
+		out.Roles = make([]SQLObjectStatus, len(in.Roles))
+		copy(out.Roles, in.Roles)
+	}
+	if in.ReplicationRole != nil {
+		out.ReplicationRole = new(SQLObjectStatus)
+		*out.ReplicationRole = *in.ReplicationRole
+	}
+	if in.AppRole != nil {
+		out.AppRole = new(SQLObjectStatus)
+		*out.AppRole = *in.AppRole
+	}
+	if in.Databases != nil {
+		out.Databases = make([]SQLObjectStatus, len(in.Databases))
+		copy(out.Databases, in.Databases)
+	}
+}
+
+// DeepCopyInto copies the upgrade, including its steps
+func (in *UpgradeStatus) DeepCopyInto(out *UpgradeStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		out.StartTime = in.StartTime.DeepCopy()
+	}
+	if in.Steps != nil {
+		out.Steps = make([]UpgradeStep, len(in.Steps))
+		for i := range in.Steps {
+			in.Steps[i].DeepCopyInto(&out.Steps[i])
+		}
 	}
 }
 
+// DeepCopyInto copies the step, including its times
+func (in *UpgradeStep) DeepCopyInto(out *UpgradeStep) {
+	*out = *in
+	if in.StartTime != nil {
+		out.StartTime = in.StartTime.DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		out.CompletionTime = in.CompletionTime.DeepCopy()
+	}
+}
+
+// DeepCopy returns a copy of the status
+func (in *DatabaseStatus) DeepCopy() *DatabaseStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyObject returns a generically typed copy of an object
 func (in *Database) DeepCopyObject() runtime.Object {
 	out := Database{}
@@ -40,3 +154,127 @@ func (in *DatabaseList) DeepCopyObject() runtime.Object {
 
 	return &out
 }
+
+// DeepCopyInto copies the backup, including its status history
+func (in *DatabaseBackup) DeepCopyInto(out *DatabaseBackup) {
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	if in.Spec.Retention != nil {
+		out.Spec.Retention = new(int32)
+		*out.Spec.Retention = *in.Spec.Retention
+	}
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopyInto copies the status, including the backup records
+func (in *DatabaseBackupStatus) DeepCopyInto(out *DatabaseBackupStatus) {
+	*out = *in
+	if in.LastScheduleTime != nil {
+		out.LastScheduleTime = in.LastScheduleTime.DeepCopy()
+	}
+	if in.Backups != nil {
+		out.Backups = make([]BackupRecord, len(in.Backups))
+		for i := range in.Backups {
+			in.Backups[i].DeepCopyInto(&out.Backups[i])
+		}
+	}
+}
+
+// DeepCopyInto copies the record, including its times
+func (in *BackupRecord) DeepCopyInto(out *BackupRecord) {
+	*out = *in
+	if in.StartTime != nil {
+		out.StartTime = in.StartTime.DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		out.CompletionTime = in.CompletionTime.DeepCopy()
+	}
+}
+
+// DeepCopy returns a copy of the status
+func (in *DatabaseBackupStatus) DeepCopy() *DatabaseBackupStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseBackupStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject returns a generically typed copy of an object
+func (in *DatabaseBackup) DeepCopyObject() runtime.Object {
+	out := DatabaseBackup{}
+	in.DeepCopyInto(&out)
+
+	return &out
+}
+
+// DeepCopyObject returns a generically typed copy of an object
+func (in *DatabaseBackupList) DeepCopyObject() runtime.Object {
+	out := DatabaseBackupList{}
+	out.TypeMeta = in.TypeMeta
+	out.ListMeta = in.ListMeta
+
+	if in.Items != nil {
+		out.Items = make([]DatabaseBackup, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+
+	return &out
+}
+
+// DeepCopyInto copies the restore, including its status times
+func (in *DatabaseRestore) DeepCopyInto(out *DatabaseRestore) {
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopyInto copies the status, including its times
+func (in *DatabaseRestoreStatus) DeepCopyInto(out *DatabaseRestoreStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		out.StartTime = in.StartTime.DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		out.CompletionTime = in.CompletionTime.DeepCopy()
+	}
+}
+
+// DeepCopy returns a copy of the status
+func (in *DatabaseRestoreStatus) DeepCopy() *DatabaseRestoreStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseRestoreStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject returns a generically typed copy of an object
+func (in *DatabaseRestore) DeepCopyObject() runtime.Object {
+	out := DatabaseRestore{}
+	in.DeepCopyInto(&out)
+
+	return &out
+}
+
+// DeepCopyObject returns a generically typed copy of an object
+func (in *DatabaseRestoreList) DeepCopyObject() runtime.Object {
+	out := DatabaseRestoreList{}
+	out.TypeMeta = in.TypeMeta
+	out.ListMeta = in.ListMeta
+
+	if in.Items != nil {
+		out.Items = make([]DatabaseRestore, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+
+	return &out
+}
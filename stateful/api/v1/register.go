@@ -25,6 +25,10 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 	scheme.AddKnownTypes(SchemeGroupVersion,
 		&Database{},
 		&DatabaseList{},
+		&DatabaseBackup{},
+		&DatabaseBackupList{},
+		&DatabaseRestore{},
+		&DatabaseRestoreList{},
 	)
 
 	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
@@ -0,0 +1,64 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Upgrade types
+const (
+	// UpgradeMinor rolls the pods over to the new image, standbys first
+	UpgradeMinor = "Minor"
+	// UpgradeMajor dumps the data, starts the new version on new volumes and restores into it
+	UpgradeMajor = "Major"
+)
+
+// Upgrade steps, in the order they run
+const (
+	// Minor upgrades
+	StepUpdateStandbys = "UpdateStandbys"
+	StepUpdatePrimary  = "UpdatePrimary"
+
+	// Major upgrades
+	// StepBlockWrites makes the old version read-only, so the dump holds every write
+	StepBlockWrites = "BlockWrites"
+	StepBackup      = "Backup"
+	StepStopOld     = "StopOld"
+	StepStartNew    = "StartNew"
+	StepRestore     = "Restore"
+	StepScaleUp     = "ScaleUp"
+	// StepRollback restarts the old version on the old volumes after a failed major upgrade
+	StepRollback = "Rollback"
+)
+
+// PhaseRolledBack means a failed upgrade was undone
+const PhaseRolledBack = "RolledBack"
+
+// UpgradeStep reports one step of an upgrade
+type UpgradeStep struct {
+	Name string `json:"name"`
+	// Phase is one of Running/Completed/Failed
+	Phase          string       `json:"phase"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	Message        string       `json:"message,omitempty"`
+}
+
+// UpgradeStatus reports the latest change of spec.image
+type UpgradeStatus struct {
+	// Type is Minor or Major
+	Type      string `json:"type,omitempty"`
+	FromImage string `json:"fromImage"`
+	ToImage   string `json:"toImage"`
+	// Phase is one of Running/Completed/Failed/RolledBack
+	Phase     string       `json:"phase"`
+	Message   string       `json:"message,omitempty"`
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// Volume claim templates holding the data before and after a major upgrade
+	FromDataVolume string `json:"fromDataVolume,omitempty"`
+	ToDataVolume   string `json:"toDataVolume,omitempty"`
+	// pg_dumpall taken before a major upgrade, on the <databaseName>-upgrade PVC
+	BackupFile     string `json:"backupFile,omitempty"`
+	BackupChecksum string `json:"backupChecksum,omitempty"`
+	// Steps run so far, the last one is the current step
+	Steps []UpgradeStep `json:"steps,omitempty"`
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	"github.com/robfig/cron/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crlog "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// backupLabel marks the Jobs of a DatabaseBackup
+	backupLabel = "databases.stackbalancer.com/backup"
+	// backupFileAnnotation records the dump a backup Job writes, relative to the PVC
+	backupFileAnnotation = "databases.stackbalancer.com/backup-file"
+
+	backupMountPath        = "/backups"
+	defaultBackupRetention = 5
+	defaultBackupStorage   = "1Gi"
+	// failed runs are kept so their error stays visible, but only the latest one
+	failedBackupHistory = 1
+	// maxMissedBackups is how many missed runs are counted before only the latest is looked for
+	maxMissedBackups = 100
+
+	// jobPollInterval is how often running backup and restore Jobs are checked
+	jobPollInterval = 10 * time.Second
+	// databaseWaitInterval is how often a backup or restore checks a Database that isn't Ready
+	databaseWaitInterval = 30 * time.Second
+)
+
+// backupScript dumps PGDATABASE to BACKUP_FILE, removes the dumps beyond RETENTION and
+// reports the size and checksum through the termination message
+const backupScript = `set -eu
+dir=$(dirname "$BACKUP_FILE")
+mkdir -p "$dir"
+pg_dump --format=custom --file="$BACKUP_FILE.partial"
+mv "$BACKUP_FILE.partial" "$BACKUP_FILE"
+size=$(stat -c %s "$BACKUP_FILE")
+checksum=$(sha256sum "$BACKUP_FILE" | cut -d ' ' -f 1)
+ls -1t "$dir"/*.dump | tail -n +$((RETENTION + 1)) | xargs -r rm -f
+printf '{"size":%s,"checksum":"%s"}' "$size" "$checksum" > /dev/termination-log
+`
+
+// backupResult is the termination message of a successful backup Job
+type backupResult struct {
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// DatabaseBackupReconciler reconciles DatabaseBackup resources
+type DatabaseBackupReconciler struct {
+	client.Client
+	Scheme     *runtime.Scheme
+	kubeClient kubernetes.Interface
+}
+
+// Reconcile starts pg_dump Jobs once or on schedule and records their results
+func (r *DatabaseBackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := crlog.FromContext(ctx).WithValues("NamespacedName", req.NamespacedName)
+	log.Info("Reconciling DatabaseBackup", "name", req.Name, "namespace", req.Namespace)
+
+	backup := &dbv1.DatabaseBackup{}
+	if err := r.Get(ctx, req.NamespacedName, backup); err != nil {
+		if k8serrors.IsNotFound(err) {
+			// Jobs and the generated PVC are removed through their owner references
+			log.Info("DatabaseBackup deleted; nothing more to do")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	oldStatus := backup.Status.DeepCopy()
+
+	claimName, err := r.ensureBackupClaim(ctx, backup)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("ensure backup claim: %w", err)
+	}
+	backup.Status.ClaimName = claimName
+
+	jobClient := r.kubeClient.BatchV1().Jobs(req.Namespace)
+	jobs, err := jobClient.List(ctx, metav1.ListOptions{LabelSelector: backupLabel + "=" + backup.Name})
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("list backup jobs: %w", err)
+	}
+
+	// Rebuild the records from the Jobs, newest first. Finished records are kept as they
+	// are, since the pods holding their results may be gone.
+	sort.Slice(jobs.Items, func(i, j int) bool {
+		return jobs.Items[j].CreationTimestamp.Before(&jobs.Items[i].CreationTimestamp)
+	})
+	var records []dbv1.BackupRecord
+	active := false
+	for i := range jobs.Items {
+		record := r.backupRecord(ctx, &jobs.Items[i], backup.Status.Backups)
+		active = active || record.Phase == dbv1.PhaseRunning
+		records = append(records, record)
+	}
+	records = r.pruneBackups(ctx, backup, records)
+
+	result := ctrl.Result{}
+	if active {
+		result.RequeueAfter = jobPollInterval
+	}
+
+	// Work out whether a run is due: a single backup runs when none was taken yet
+	var scheduledTime time.Time
+	due := false
+	if backup.Spec.Schedule == "" {
+		due = len(jobs.Items) == 0
+	} else {
+		schedule, err := cron.ParseStandard(backup.Spec.Schedule)
+		if err != nil {
+			// Requeueing won't fix an invalid schedule, wait for the spec to change
+			log.Error(err, "Invalid schedule", "schedule", backup.Spec.Schedule)
+			return ctrl.Result{}, r.updateBackupStatus(ctx, backup, oldStatus, records, fmt.Sprintf("invalid schedule: %s", err))
+		}
+		now := time.Now()
+		var next time.Time
+		var missed int
+		scheduledTime, next, missed = getNextBackupSchedule(backup, schedule, now)
+		if missed > maxMissedBackups {
+			log.Info("Too many missed backups, only the latest one is started", "missed", fmt.Sprintf("more than %d", maxMissedBackups))
+		}
+		due = !scheduledTime.IsZero()
+		if result.RequeueAfter == 0 || next.Sub(now) < result.RequeueAfter {
+			result.RequeueAfter = next.Sub(now)
+		}
+	}
+
+	// Backups never overlap: a due run waits for the active one
+	if due && !active {
+		db, message, err := getReadyDatabase(ctx, r.Client, req.Namespace, backup.Spec.Database)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if message != "" {
+			log.Info("Waiting for Database", "Database", backup.Spec.Database, "reason", message)
+			return ctrl.Result{RequeueAfter: databaseWaitInterval}, r.updateBackupStatus(ctx, backup, oldStatus, records, message)
+		}
+
+		jobName := backup.Name
+		if !scheduledTime.IsZero() {
+			jobName = fmt.Sprintf("%s-%d", backup.Name, scheduledTime.Unix())
+			backup.Status.LastScheduleTime = &metav1.Time{Time: scheduledTime}
+		}
+		file := path.Join(backup.Name, jobName+".dump")
+		job := makeBackupJob(backup, db, jobName, file, claimName)
+		if _, err := jobClient.Create(ctx, job, metav1.CreateOptions{}); err != nil && !k8serrors.IsAlreadyExists(err) {
+			return ctrl.Result{}, fmt.Errorf("create backup job: %w", err)
+		}
+		log.Info("Created backup Job", "job", jobName, "file", file)
+		records = append([]dbv1.BackupRecord{{JobName: jobName, File: file, Phase: dbv1.PhaseRunning}}, records...)
+		result.RequeueAfter = jobPollInterval
+	}
+
+	return result, r.updateBackupStatus(ctx, backup, oldStatus, records, "")
+}
+
+// updateBackupStatus sets the records and the phase, and writes the status when it changed.
+// The phase is that of the latest run, or Pending with the message when a due run waits.
+func (r *DatabaseBackupReconciler) updateBackupStatus(ctx context.Context, backup *dbv1.DatabaseBackup, oldStatus *dbv1.DatabaseBackupStatus, records []dbv1.BackupRecord, pendingMessage string) error {
+	backup.Status.Backups = records
+	backup.Status.Phase, backup.Status.Message = dbv1.PhasePending, pendingMessage
+	if pendingMessage == "" && len(records) > 0 {
+		backup.Status.Phase = records[0].Phase
+	}
+	if equality.Semantic.DeepEqual(oldStatus, &backup.Status) {
+		return nil
+	}
+	if err := r.Status().Update(ctx, backup); err != nil {
+		return fmt.Errorf("update status: %w", err)
+	}
+	return nil
+}
+
+// ensureBackupClaim returns the PVC the dumps go to, creating <backup>-backups when the spec
+// doesn't name one. The created PVC is owned by the DatabaseBackup and deleted with it.
+func (r *DatabaseBackupReconciler) ensureBackupClaim(ctx context.Context, backup *dbv1.DatabaseBackup) (string, error) {
+	if backup.Spec.Storage.ClaimName != "" {
+		return backup.Spec.Storage.ClaimName, nil
+	}
+
+	name := backup.Name + "-backups"
+	pvcClient := r.kubeClient.CoreV1().PersistentVolumeClaims(backup.Namespace)
+	_, err := pvcClient.Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		return name, nil
+	}
+	if !k8serrors.IsNotFound(err) {
+		return "", err
+	}
+
+	size := backup.Spec.Storage.Size
+	if size == "" {
+		size = defaultBackupStorage
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return "", fmt.Errorf("parse storage size: %w", err)
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Labels:          map[string]string{backupLabel: backup.Name},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(backup, dbv1.SchemeGroupVersion.WithKind("DatabaseBackup"))},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: quantity},
+			},
+		},
+	}
+	if _, err := pvcClient.Create(ctx, pvc, metav1.CreateOptions{}); err != nil {
+		return "", err
+	}
+	crlog.FromContext(ctx).Info("Created backup PVC", "pvc", name)
+	return name, nil
+}
+
+// backupRecord describes the run of a backup Job
+func (r *DatabaseBackupReconciler) backupRecord(ctx context.Context, job *batchv1.Job, previous []dbv1.BackupRecord) dbv1.BackupRecord {
+	phase, finishedAt := jobPhase(job)
+	for _, record := range previous {
+		if record.JobName == job.Name && record.Phase == phase && phase != dbv1.PhaseRunning {
+			return record
+		}
+	}
+
+	record := dbv1.BackupRecord{
+		JobName:        job.Name,
+		File:           job.Annotations[backupFileAnnotation],
+		Phase:          phase,
+		StartTime:      job.Status.StartTime,
+		CompletionTime: finishedAt,
+	}
+	message := jobTerminationMessage(ctx, r.kubeClient, job.Namespace, job.Name)
+	switch phase {
+	case dbv1.PhaseCompleted:
+		var result backupResult
+		if err := json.Unmarshal([]byte(message), &result); err != nil {
+			record.Message = fmt.Sprintf("couldn't read backup result: %q", message)
+		}
+		record.Size, record.Checksum = result.Size, result.Checksum
+	case dbv1.PhaseFailed:
+		record.Message = message
+	}
+	return record
+}
+
+// pruneBackups deletes the Jobs of completed runs beyond the retention and of all but the
+// latest failed run. The Jobs remove the dumps beyond the retention themselves.
+func (r *DatabaseBackupReconciler) pruneBackups(ctx context.Context, backup *dbv1.DatabaseBackup, records []dbv1.BackupRecord) []dbv1.BackupRecord {
+	log := crlog.FromContext(ctx)
+	retention := defaultBackupRetention
+	if backup.Spec.Retention != nil {
+		retention = int(*backup.Spec.Retention)
+	}
+
+	var kept []dbv1.BackupRecord
+	completed, failed := 0, 0
+	for _, record := range records {
+		keep := true
+		switch record.Phase {
+		case dbv1.PhaseCompleted:
+			completed++
+			keep = completed <= retention
+		case dbv1.PhaseFailed:
+			failed++
+			keep = failed <= failedBackupHistory
+		}
+		if keep {
+			kept = append(kept, record)
+			continue
+		}
+
+		propagation := metav1.DeletePropagationBackground
+		err := r.kubeClient.BatchV1().Jobs(backup.Namespace).Delete(ctx, record.JobName, metav1.DeleteOptions{PropagationPolicy: &propagation})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			log.Error(err, "Failed to delete old backup Job", "job", record.JobName)
+			kept = append(kept, record)
+			continue
+		}
+		log.Info("Deleted old backup Job", "job", record.JobName)
+	}
+	return kept
+}
+
+// getNextBackupSchedule returns the latest run that is due but not yet started (zero if
+// none), the time of the next run and how many runs were due, up to maxMissedBackups+1
+func getNextBackupSchedule(backup *dbv1.DatabaseBackup, schedule cron.Schedule, now time.Time) (time.Time, time.Time, int) {
+	earliest := backup.CreationTimestamp.Time
+	if backup.Status.LastScheduleTime != nil {
+		earliest = backup.Status.LastScheduleTime.Time
+	}
+
+	var lastMissed time.Time
+	missed := 0
+	for t := schedule.Next(earliest); !t.After(now); t = schedule.Next(t) {
+		if missed == maxMissedBackups {
+			lastMissed = latestBackupRun(schedule, t, now)
+			missed++
+			break
+		}
+		// Only the most recent missed run is started
+		lastMissed = t
+		missed++
+	}
+
+	return lastMissed, schedule.Next(now), missed
+}
+
+// latestBackupRun bisects the seconds between the due run first and now for the last one
+// after which a run is still due
+func latestBackupRun(schedule cron.Schedule, first, now time.Time) time.Time {
+	at := func(seconds int64) time.Time { return time.Unix(seconds, 0).In(first.Location()) }
+	due, notDue := first.Unix()-1, now.Unix()
+	for notDue-due > 1 {
+		mid := due + (notDue-due)/2
+		if schedule.Next(at(mid)).After(now) {
+			notDue = mid
+		} else {
+			due = mid
+		}
+	}
+	return schedule.Next(at(due))
+}
+
+func makeBackupJob(backup *dbv1.DatabaseBackup, db *dbv1.Database, jobName, file, claimName string) *batchv1.Job {
+	retention := int32(defaultBackupRetention)
+	if backup.Spec.Retention != nil {
+		retention = *backup.Spec.Retention
+	}
+	dbname := backup.Spec.DBName
+	if dbname == "" {
+		dbname = postgresUser
+	}
+
+	labels := map[string]string{backupLabel: backup.Name}
+	env := append(databaseJobEnv(db, dbname),
+		corev1.EnvVar{Name: "BACKUP_FILE", Value: path.Join(backupMountPath, file)},
+		corev1.EnvVar{Name: "RETENTION", Value: strconv.Itoa(int(retention))},
+	)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            jobName,
+			Labels:          labels,
+			Annotations:     map[string]string{backupFileAnnotation: file},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(backup, dbv1.SchemeGroupVersion.WithKind("DatabaseBackup"))},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: int32Ptr(2),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:                     "pg-dump",
+							Image:                    postgresImage(db),
+							ImagePullPolicy:          postgresPullPolicy(db),
+							Command:                  []string{"sh", "-c", backupScript},
+							Env:                      env,
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "backups", MountPath: backupMountPath},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "backups",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// getReadyDatabase returns the Database once it is Ready and its password Secret is known,
+// otherwise a message saying what is missing
+func getReadyDatabase(ctx context.Context, c client.Client, namespace, name string) (*dbv1.Database, string, error) {
+	db := &dbv1.Database{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, db); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, fmt.Sprintf("Database %s not found", name), nil
+		}
+		return nil, "", err
+	}
+	if db.Status.Phase != "Ready" {
+		return nil, fmt.Sprintf("Database %s is in phase %q", name, db.Status.Phase), nil
+	}
+	if upgradeRunning(db) {
+		return nil, fmt.Sprintf("Database %s is being upgraded to %s", name, db.Status.Upgrade.ToImage), nil
+	}
+	if db.Status.PasswordSecretRef == nil {
+		return nil, fmt.Sprintf("Database %s has no password Secret yet", name), nil
+	}
+	return db, "", nil
+}
+
+// databaseJobEnv connects the postgres client tools to the primary through the headless Service
+func databaseJobEnv(db *dbv1.Database, dbname string) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: "PGHOST", Value: primaryHost(databaseResourceName(db))},
+		{Name: "PGPORT", Value: strconv.Itoa(postgresPort)},
+		{Name: "PGUSER", Value: postgresUser},
+		{Name: "PGDATABASE", Value: dbname},
+		{Name: "PGPASSWORD", ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: db.Status.PasswordSecretRef.Name},
+				Key:                  db.Status.PasswordSecretRef.Key,
+			},
+		}},
+	}
+}
+
+// jobPhase maps the conditions of a Job to a phase, with the time it finished
+func jobPhase(job *batchv1.Job) (string, *metav1.Time) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			if job.Status.CompletionTime != nil {
+				return dbv1.PhaseCompleted, job.Status.CompletionTime
+			}
+			return dbv1.PhaseCompleted, &condition.LastTransitionTime
+		case batchv1.JobFailed:
+			return dbv1.PhaseFailed, &condition.LastTransitionTime
+		}
+	}
+	return dbv1.PhaseRunning, nil
+}
+
+// jobTerminationMessage returns the termination message of the pod of a Job that finished last
+func jobTerminationMessage(ctx context.Context, kubeClient kubernetes.Interface, namespace, jobName string) string {
+	pods, err := kubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: batchv1.JobNameLabel + "=" + jobName})
+	if err != nil {
+		crlog.FromContext(ctx).Error(err, "Failed to list pods of Job", "job", jobName)
+		return ""
+	}
+
+	var latest *corev1.ContainerStateTerminated
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			terminated := status.State.Terminated
+			if terminated != nil && (latest == nil || terminated.FinishedAt.After(latest.FinishedAt.Time)) {
+				latest = terminated
+			}
+		}
+	}
+	if latest == nil {
+		return ""
+	}
+	return strings.TrimSpace(latest.Message)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	"github.com/robfig/cron/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetNextBackupSchedule(t *testing.T) {
+	schedule, err := cron.ParseStandard("*/5 * * * *")
+	if err != nil {
+		t.Fatalf("ParseStandard() error = %v", err)
+	}
+	now := time.Date(2026, 1, 10, 12, 7, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		lastRun    time.Time
+		wantRun    time.Time
+		wantMissed int
+	}{
+		{name: "nothing due", lastRun: time.Date(2026, 1, 10, 12, 5, 0, 0, time.UTC)},
+		{name: "one missed run", lastRun: time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC), wantRun: time.Date(2026, 1, 10, 12, 5, 0, 0, time.UTC), wantMissed: 1},
+		{name: "three missed runs", lastRun: time.Date(2026, 1, 10, 11, 50, 0, 0, time.UTC), wantRun: time.Date(2026, 1, 10, 12, 5, 0, 0, time.UTC), wantMissed: 3},
+		// a year of runs every five minutes isn't walked one by one
+		{name: "long outage", lastRun: time.Date(2025, 1, 10, 12, 0, 0, 0, time.UTC), wantRun: time.Date(2026, 1, 10, 12, 5, 0, 0, time.UTC), wantMissed: maxMissedBackups + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backup := &dbv1.DatabaseBackup{Status: dbv1.DatabaseBackupStatus{LastScheduleTime: &metav1.Time{Time: tt.lastRun}}}
+			run, next, missed := getNextBackupSchedule(backup, schedule, now)
+			if !run.Equal(tt.wantRun) || missed != tt.wantMissed {
+				t.Errorf("getNextBackupSchedule() = %v, %d missed, want %v, %d missed", run, missed, tt.wantRun, tt.wantMissed)
+			}
+			if want := time.Date(2026, 1, 10, 12, 10, 0, 0, time.UTC); !next.Equal(want) {
+				t.Errorf("next run = %v, want %v", next, want)
+			}
+		})
+	}
+}
+
+func TestGetNextBackupScheduleIrregular(t *testing.T) {
+	schedule, err := cron.ParseStandard("0 0 1,2 * *")
+	if err != nil {
+		t.Fatalf("ParseStandard() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		now     time.Time
+		wantRun time.Time
+	}{
+		// runs a day apart, then a month: the latest run has to be searched for
+		{name: "between runs", now: time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC), wantRun: time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)},
+		{name: "on a run", now: time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC), wantRun: time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)},
+		{name: "after the first of two runs", now: time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC), wantRun: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "between seconds", now: time.Date(2026, 10, 2, 0, 0, 0, 500, time.UTC), wantRun: time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backup := &dbv1.DatabaseBackup{Status: dbv1.DatabaseBackupStatus{LastScheduleTime: &metav1.Time{Time: time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)}}}
+			run, _, missed := getNextBackupSchedule(backup, schedule, tt.now)
+			if !run.Equal(tt.wantRun) || missed != maxMissedBackups+1 {
+				t.Errorf("getNextBackupSchedule() = %v, %d missed, want %v, %d missed", run, missed, tt.wantRun, maxMissedBackups+1)
+			}
+		})
+	}
+}
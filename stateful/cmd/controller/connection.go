@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	crlog "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	postgresPort = 5432
+	// the postgres image creates this superuser and a database of the same name
+	postgresUser = "postgres"
+	// appUser is the role the connection Secret logs in as, with the password in <name>-app.
+	// It owns a database of the same name and has no other privileges.
+	appUser = "app_user"
+)
+
+func connectionSecretName(name string) string {
+	return name + "-conn"
+}
+
+func appSecretName(name string) string {
+	return name + "-app"
+}
+
+// reconcileAppRole creates appUser and its database on the primary, and sets the password
+// again whenever the <name>-app Secret changes
+func (r *DatabaseReconciler) reconcileAppRole(ctx context.Context, db *dbv1.Database, name, password string) dbv1.SQLObjectStatus {
+	status := dbv1.SQLObjectStatus{Name: appUser}
+	if db.Status.AppRole != nil {
+		status.PasswordVersion = db.Status.AppRole.PasswordVersion
+	}
+	addr := sqlAddress(db, name)
+	conn, err := openSQL(ctx, addr, password, postgresUser)
+	if err != nil {
+		return sqlObjectStatus(status, fmt.Errorf("connect to %s: %w", addr, err))
+	}
+	defer conn.Close()
+
+	role := dbv1.RoleSpec{Name: appUser, Login: true, PasswordSecretRef: &dbv1.SecretKeyRef{Name: appSecretName(name)}}
+	if status.PasswordVersion, err = r.reconcileRole(ctx, conn, db.Namespace, role, false, status.PasswordVersion); err != nil {
+		return sqlObjectStatus(status, err)
+	}
+	err = reconcileLogicalDatabase(ctx, conn, addr, password, dbv1.LogicalDatabaseSpec{Name: appUser, Owner: appUser})
+	return sqlObjectStatus(status, err)
+}
+
+// ensureConnectionSecret creates or updates the <name>-conn Secret with the appUser password.
+// Its keys are plain identifiers, so pods can load it with envFrom.
+func (r *DatabaseReconciler) ensureConnectionSecret(ctx context.Context, db *dbv1.Database, name string) error {
+	log := crlog.FromContext(ctx)
+	secretClient := r.kubeClient.CoreV1().Secrets(db.Namespace)
+	password, err := r.readPassword(ctx, db.Namespace, &dbv1.SecretKeyRef{Name: appSecretName(name), Key: defaultPasswordKey})
+	if err != nil {
+		return err
+	}
+	want := makeConnectionSecret(db, name, password)
+
+	secret, err := secretClient.Get(ctx, want.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		if _, err := secretClient.Create(ctx, want, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		log.Info("Created connection Secret", "secret", want.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if equality.Semantic.DeepEqual(secret.Data, want.Data) {
+		return nil
+	}
+	secret.Data = want.Data
+	if _, err := secretClient.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	log.Info("Updated connection Secret", "secret", want.Name)
+	return nil
+}
+
+func makeConnectionSecret(db *dbv1.Database, name, password string) *corev1.Secret {
+	host := fmt.Sprintf("%s.%s.svc", roleServiceName(name, rolePrimary), db.Namespace)
+	port := strconv.Itoa(postgresPort)
+	dbname := appUser
+	hostPort := net.JoinHostPort(host, port)
+
+	uri := url.URL{
+		Scheme: "postgresql",
+		User:   url.UserPassword(appUser, password),
+		Host:   hostPort,
+		Path:   "/" + dbname,
+	}
+	jdbcQuery := url.Values{"user": {appUser}, "password": {password}}
+	jdbcURL := fmt.Sprintf("jdbc:postgresql://%s/%s?%s", hostPort, dbname, jdbcQuery.Encode())
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            connectionSecretName(name),
+			Labels:          map[string]string{"app": name},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(db, dbv1.SchemeGroupVersion.WithKind("Database"))},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"host":     []byte(host),
+			"port":     []byte(port),
+			"user":     []byte(appUser),
+			"password": []byte(password),
+			"dbname":   []byte(dbname),
+			"uri":      []byte(uri.String()),
+			"jdbcUrl":  []byte(jdbcURL),
+		},
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	"github.com/lib/pq"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	crlog "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	defaultPasswordKey = "password"
+	// generated passwords are 24 random bytes, 32 characters once encoded
+	passwordBytes = 24
+)
+
+func credentialsSecretName(name string) string {
+	return name + "-credentials"
+}
+
+// ensureCredentials returns the Secret key the pods read the postgres password from, and the
+// password postgres should use: the one in spec.passwordSecretRef, the deprecated spec.password,
+// or else the one in use. The controller-owned <name>-credentials Secret holds the password in
+// use. It is created with the password the Database is initialised with, and afterwards only
+// rotatePassword changes it.
+func (r *DatabaseReconciler) ensureCredentials(ctx context.Context, db *dbv1.Database, name string) (*dbv1.SecretKeyRef, string, error) {
+	secretClient := r.kubeClient.CoreV1().Secrets(db.Namespace)
+
+	ref := &dbv1.SecretKeyRef{Name: credentialsSecretName(name), Key: defaultPasswordKey}
+	secret, err := secretClient.Get(ctx, ref.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		password, err := r.initialPassword(ctx, db, name)
+		if err != nil {
+			return nil, "", err
+		}
+		if secret, err = secretClient.Create(ctx, makeCredentialsSecret(db, name, password), metav1.CreateOptions{}); err != nil {
+			return nil, "", fmt.Errorf("create credentials secret: %w", err)
+		}
+		crlog.FromContext(ctx).Info("Created credentials Secret", "secret", ref.Name)
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	if own := ownPasswordRef(db); own != nil {
+		password, err := r.readPassword(ctx, db.Namespace, own)
+		if err != nil {
+			return nil, "", err
+		}
+		return own, password, nil
+	}
+	// The deprecated field stays authoritative while it is set
+	if db.Spec.Password != "" {
+		return ref, db.Spec.Password, nil
+	}
+	return ref, string(secret.Data[ref.Key]), nil
+}
+
+// initialPassword returns the password a Database without a credentials Secret uses. Before the
+// connection Secret published an application role, it held the superuser password in use, so
+// that one is taken over when it is still there. A StatefulSet from before the credentials
+// Secret started postgres with spec.password as a literal POSTGRES_PASSWORD, which is taken
+// over next. A password is only generated for a new Database, since one that already ran
+// can't be reached with it.
+func (r *DatabaseReconciler) initialPassword(ctx context.Context, db *dbv1.Database, name string) (string, error) {
+	conn, err := r.kubeClient.CoreV1().Secrets(db.Namespace).Get(ctx, connectionSecretName(name), metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return "", fmt.Errorf("get connection secret: %w", err)
+	}
+	if err == nil && string(conn.Data["user"]) == postgresUser && len(conn.Data["password"]) > 0 {
+		return string(conn.Data["password"]), nil
+	}
+
+	sts, err := r.kubeClient.AppsV1().StatefulSets(db.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return "", fmt.Errorf("get statefulset: %w", err)
+	}
+	if err == nil {
+		if password := literalPassword(sts); password != "" {
+			return password, nil
+		}
+		if db.Spec.Password != "" {
+			return db.Spec.Password, nil
+		}
+		return "", fmt.Errorf("statefulset %s already exists and its password is unknown, set spec.password to the one postgres uses", name)
+	}
+
+	if own := ownPasswordRef(db); own != nil {
+		return r.readPassword(ctx, db.Namespace, own)
+	}
+	if db.Spec.Password != "" {
+		return db.Spec.Password, nil
+	}
+	password, err := generatePassword()
+	if err != nil {
+		return "", fmt.Errorf("generate password: %w", err)
+	}
+	return password, nil
+}
+
+// literalPassword returns the POSTGRES_PASSWORD value set in the postgres container of the
+// StatefulSet, empty when it is read from a Secret
+func literalPassword(sts *appsv1.StatefulSet) string {
+	for _, c := range sts.Spec.Template.Spec.Containers {
+		if c.Name != "postgres" {
+			continue
+		}
+		for _, env := range c.Env {
+			if env.Name == "POSTGRES_PASSWORD" {
+				return env.Value
+			}
+		}
+	}
+	return ""
+}
+
+// ownPasswordRef returns spec.passwordSecretRef with the key defaulted, nil when it is unset
+func ownPasswordRef(db *dbv1.Database) *dbv1.SecretKeyRef {
+	ref := db.Spec.PasswordSecretRef
+	if ref == nil {
+		return nil
+	}
+	key := ref.Key
+	if key == "" {
+		key = defaultPasswordKey
+	}
+	return &dbv1.SecretKeyRef{Name: ref.Name, Key: key}
+}
+
+// currentPassword returns the password postgres uses, the one in the credentials Secret
+func (r *DatabaseReconciler) currentPassword(ctx context.Context, db *dbv1.Database, name string) (string, error) {
+	return r.readPassword(ctx, db.Namespace, &dbv1.SecretKeyRef{Name: credentialsSecretName(name), Key: defaultPasswordKey})
+}
+
+// rotatePassword sets the postgres password to desired with ALTER ROLE, then stores it in the
+// controller-owned credentials Secret. When the current password is refused, an earlier attempt
+// may have set desired without updating the Secret, so desired is tried before giving up.
+func (r *DatabaseReconciler) rotatePassword(ctx context.Context, db *dbv1.Database, name, current, desired string) error {
+	log := crlog.FromContext(ctx)
+	addr := sqlAddress(db, name)
+
+	conn, err := openSQL(ctx, addr, current, postgresUser)
+	if err == nil {
+		defer conn.Close()
+		stmt := fmt.Sprintf("ALTER ROLE %s WITH PASSWORD %s", pq.QuoteIdentifier(postgresUser), pq.QuoteLiteral(desired))
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("alter role: %w", err)
+		}
+	} else {
+		retry, retryErr := openSQL(ctx, addr, desired, postgresUser)
+		if retryErr != nil {
+			return fmt.Errorf("connect to %s: %w", addr, err)
+		}
+		retry.Close()
+	}
+	log.Info("Changed postgres password")
+
+	secretClient := r.kubeClient.CoreV1().Secrets(db.Namespace)
+	secret, err := secretClient.Get(ctx, credentialsSecretName(name), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get credentials secret: %w", err)
+	}
+	if string(secret.Data[defaultPasswordKey]) != desired {
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Data[defaultPasswordKey] = []byte(desired)
+		if _, err := secretClient.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("update credentials secret: %w", err)
+		}
+		log.Info("Updated credentials Secret", "secret", secret.Name)
+	}
+	return nil
+}
+
+func (r *DatabaseReconciler) readPassword(ctx context.Context, namespace string, ref *dbv1.SecretKeyRef) (string, error) {
+	secret, err := r.kubeClient.CoreV1().Secrets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("get password secret %s: %w", ref.Name, err)
+	}
+	if len(secret.Data[ref.Key]) == 0 {
+		return "", fmt.Errorf("password secret %s has no key %q", ref.Name, ref.Key)
+	}
+	return string(secret.Data[ref.Key]), nil
+}
+
+// makeCredentialsSecret returns the <name>-credentials Secret
+func makeCredentialsSecret(db *dbv1.Database, name, password string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            credentialsSecretName(name),
+			Labels:          map[string]string{"app": name},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(db, dbv1.SchemeGroupVersion.WithKind("Database"))},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{defaultPasswordKey: []byte(password)},
+	}
+}
+
+// ensurePasswordSecret creates the Secret secretName with a generated password under
+// defaultPasswordKey, for a role the controller manages. An existing Secret is left as is.
+func (r *DatabaseReconciler) ensurePasswordSecret(ctx context.Context, db *dbv1.Database, name, secretName string) error {
+	secretClient := r.kubeClient.CoreV1().Secrets(db.Namespace)
+	_, err := secretClient.Get(ctx, secretName, metav1.GetOptions{})
+	if !k8serrors.IsNotFound(err) {
+		return err
+	}
+	password, err := generatePassword()
+	if err != nil {
+		return fmt.Errorf("generate password: %w", err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            secretName,
+			Labels:          map[string]string{"app": name},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(db, dbv1.SchemeGroupVersion.WithKind("Database"))},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{defaultPasswordKey: []byte(password)},
+	}
+	if _, err := secretClient.Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+	crlog.FromContext(ctx).Info("Created password Secret", "secret", secretName)
+	return nil
+}
+
+func generatePassword() (string, error) {
+	b := make([]byte, passwordBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// passwordEnv references the password Secret instead of copying the password into the pod spec
+func passwordEnv(ref *dbv1.SecretKeyRef) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: "POSTGRES_PASSWORD",
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: ref.Name},
+				Key:                  ref.Key,
+			},
+		},
+	}
+}
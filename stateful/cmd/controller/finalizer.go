@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	crlog "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// databaseFinalizer blocks removal of a Database until its deletion policy is applied
+	databaseFinalizer = "databases.stackbalancer.com/finalizer"
+
+	// retainedLabel marks the PVCs and credentials Secret a deleted Database left for a new
+	// Database of the same databaseName, with the name of the deleted one
+	retainedLabel = "databases.stackbalancer.com/retained-from"
+	// imageAnnotation and dataVolumeAnnotation record what ran on retained volumes
+	imageAnnotation      = "databases.stackbalancer.com/image"
+	dataVolumeAnnotation = "databases.stackbalancer.com/data-volume"
+	// backupChecksumAnnotation records the SHA-256 of the final backup on its PVC
+	backupChecksumAnnotation = "databases.stackbalancer.com/backup-checksum"
+
+	finalBackupFile = "pg_dumpall.sql"
+)
+
+func deletionPolicy(db *dbv1.Database) string {
+	if db.Spec.DeletionPolicy == "" {
+		return dbv1.DeletionPolicyRetain
+	}
+	return db.Spec.DeletionPolicy
+}
+
+func finalBackupName(name string) string {
+	return name + "-final-backup"
+}
+
+// finalizeDatabase applies the deletion policy: it takes the final backup of the Snapshot
+// policy, deletes the StatefulSet and headless Service, then deletes or retains the data PVCs.
+// The children owned by the Database are left to the garbage collector. It returns false
+// while the final backup runs. It is safe to call repeatedly.
+func (r *DatabaseReconciler) finalizeDatabase(ctx context.Context, db *dbv1.Database, name string) (bool, error) {
+	log := crlog.FromContext(ctx)
+	policy := deletionPolicy(db)
+
+	if policy == dbv1.DeletionPolicySnapshot {
+		done, err := r.finalBackup(ctx, db, name)
+		if err != nil || !done {
+			return false, err
+		}
+		// a Database that never became ready has nothing to dump, its volumes are kept instead
+		if condition := meta.FindStatusCondition(db.Status.Conditions, dbv1.ConditionFinalBackup); condition != nil && condition.Reason == "Skipped" {
+			policy = dbv1.DeletionPolicyRetain
+		}
+	}
+
+	stsClient := r.kubeClient.AppsV1().StatefulSets(db.Namespace)
+	if err := stsClient.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+		return false, fmt.Errorf("delete statefulset: %w", err)
+	}
+	svcClient := r.kubeClient.CoreV1().Services(db.Namespace)
+	if err := svcClient.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+		return false, fmt.Errorf("delete service: %w", err)
+	}
+
+	pvcClient := r.kubeClient.CoreV1().PersistentVolumeClaims(db.Namespace)
+	pvcs, err := pvcClient.List(ctx, metav1.ListOptions{LabelSelector: "app=" + name})
+	if err != nil {
+		return false, fmt.Errorf("list pvcs: %w", err)
+	}
+	claims := 0
+	for _, pvc := range pvcs.Items {
+		// the app label isn't ours alone, only the claims of the data volumes are touched
+		if !isDataClaim(db, name, pvc.Name) {
+			continue
+		}
+		claims++
+		if policy == dbv1.DeletionPolicyRetain {
+			patch, _ := json.Marshal(map[string]any{"metadata": map[string]any{
+				"labels":      map[string]string{retainedLabel: db.Name},
+				"annotations": map[string]string{imageAnnotation: postgresImage(db), dataVolumeAnnotation: dataVolumeName(db)},
+			}})
+			if _, err := pvcClient.Patch(ctx, pvc.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+				return false, fmt.Errorf("label pvc %s: %w", pvc.Name, err)
+			}
+			continue
+		}
+		if err := pvcClient.Delete(ctx, pvc.Name, metav1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+			return false, fmt.Errorf("delete pvc %s: %w", pvc.Name, err)
+		}
+	}
+
+	// The retained volumes and the final backup only open with the password they were made with
+	if policy != dbv1.DeletionPolicyDelete {
+		if err := r.retainCredentials(ctx, db, name); err != nil {
+			return false, err
+		}
+	}
+
+	log.Info("Applied deletion policy", "policy", policy, "pvcs", claims)
+	return true, nil
+}
+
+// isDataClaim tells whether a PVC was created by the StatefulSet from a data volume claim
+// template, named <volume>-<name>-<ordinal>. The volume is the current one, or "data" or
+// "data-pg<major>" of an earlier major version.
+func isDataClaim(db *dbv1.Database, name, claim string) bool {
+	i := strings.LastIndex(claim, "-")
+	if i < 0 || !isDigits(claim[i+1:]) {
+		return false
+	}
+	volume, ok := strings.CutSuffix(claim[:i], "-"+name)
+	if !ok {
+		return false
+	}
+	if volume == defaultDataVolume || volume == dataVolumeName(db) {
+		return true
+	}
+	major, ok := strings.CutPrefix(volume, defaultDataVolume+"-pg")
+	return ok && isDigits(major)
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// finalBackup dumps the cluster to the <name>-final-backup PVC, which isn't owned by the
+// Database and outlives it. It reports the progress in the FinalBackup condition and returns
+// true once the dump completed or was skipped. A failed dump blocks the deletion until the
+// policy is changed.
+func (r *DatabaseReconciler) finalBackup(ctx context.Context, db *dbv1.Database, name string) (bool, error) {
+	log := crlog.FromContext(ctx)
+	if meta.IsStatusConditionTrue(db.Status.Conditions, dbv1.ConditionFinalBackup) {
+		return true, nil
+	}
+
+	setCondition := func(status metav1.ConditionStatus, reason, message string) error {
+		if c := meta.FindStatusCondition(db.Status.Conditions, dbv1.ConditionFinalBackup); c != nil &&
+			c.Status == status && c.Reason == reason && c.Message == message {
+			return nil
+		}
+		setDatabaseCondition(db, dbv1.ConditionFinalBackup, status, reason, message)
+		if err := r.Status().Update(ctx, db); err != nil {
+			return fmt.Errorf("update status: %w", err)
+		}
+		return nil
+	}
+
+	jobName := finalBackupName(name)
+	jobClient := r.kubeClient.BatchV1().Jobs(db.Namespace)
+	job, err := jobClient.Get(ctx, jobName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		if db.Status.ReadyReplicas == 0 || db.Status.PasswordSecretRef == nil || upgradeRunning(db) {
+			log.Info("Database isn't running, retaining its volumes instead of a final backup")
+			return true, setCondition(metav1.ConditionTrue, "Skipped", "the Database wasn't running, its volumes are retained instead")
+		}
+		storage, err := storageRequest(db)
+		if err != nil {
+			return false, err
+		}
+		if err := r.ensureFinalBackupClaim(ctx, db, name, storage); err != nil {
+			return false, fmt.Errorf("ensure final backup pvc: %w", err)
+		}
+		job = makePostgresJob(db, name, jobName, postgresImage(db), dumpAllScript, finalBackupName(name), finalBackupFile, "")
+		if _, err := jobClient.Create(ctx, job, metav1.CreateOptions{}); err != nil && !k8serrors.IsAlreadyExists(err) {
+			return false, fmt.Errorf("create final backup job: %w", err)
+		}
+		log.Info("Created final backup Job", "job", jobName)
+		return false, setCondition(metav1.ConditionFalse, "Running", "dumping the cluster to PVC "+finalBackupName(name))
+	}
+	if err != nil {
+		return false, fmt.Errorf("get final backup job: %w", err)
+	}
+
+	phase, _ := jobPhase(job)
+	switch phase {
+	case dbv1.PhaseRunning:
+		return false, nil
+	case dbv1.PhaseFailed:
+		message := jobTerminationMessage(ctx, r.kubeClient, db.Namespace, jobName)
+		return false, setCondition(metav1.ConditionFalse, "Failed",
+			fmt.Sprintf("final backup failed: %s; delete Job %s to retry, or change spec.deletionPolicy", message, jobName))
+	}
+
+	message := jobTerminationMessage(ctx, r.kubeClient, db.Namespace, jobName)
+	var result backupResult
+	if err := json.Unmarshal([]byte(message), &result); err != nil || result.Checksum == "" {
+		return false, setCondition(metav1.ConditionFalse, "Failed", fmt.Sprintf("couldn't read backup result: %q", message))
+	}
+	patch, _ := json.Marshal(map[string]any{"metadata": map[string]any{
+		"annotations": map[string]string{backupFileAnnotation: finalBackupFile, backupChecksumAnnotation: result.Checksum, imageAnnotation: postgresImage(db)},
+	}})
+	if _, err := r.kubeClient.CoreV1().PersistentVolumeClaims(db.Namespace).Patch(ctx, finalBackupName(name), types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return false, fmt.Errorf("annotate final backup pvc: %w", err)
+	}
+	log.Info("Completed final backup", "pvc", finalBackupName(name), "checksum", result.Checksum)
+	return true, setCondition(metav1.ConditionTrue, "Completed",
+		fmt.Sprintf("%s on PVC %s, %d bytes, sha256 %s", finalBackupFile, finalBackupName(name), result.Size, result.Checksum))
+}
+
+// ensureFinalBackupClaim creates the PVC of the final backup, as large as the data volumes
+func (r *DatabaseReconciler) ensureFinalBackupClaim(ctx context.Context, db *dbv1.Database, name string, storage resource.Quantity) error {
+	pvcClient := r.kubeClient.CoreV1().PersistentVolumeClaims(db.Namespace)
+	_, err := pvcClient.Get(ctx, finalBackupName(name), metav1.GetOptions{})
+	if !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   finalBackupName(name),
+			Labels: map[string]string{retainedLabel: db.Name},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: storage},
+			},
+		},
+	}
+	if _, err := pvcClient.Create(ctx, pvc, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+	crlog.FromContext(ctx).Info("Created final backup PVC", "pvc", pvc.Name)
+	return nil
+}
+
+// retainCredentials releases the generated credentials Secret from the Database, so the
+// garbage collector keeps it. Secrets the user referenced are never owned and need nothing.
+func (r *DatabaseReconciler) retainCredentials(ctx context.Context, db *dbv1.Database, name string) error {
+	secretClient := r.kubeClient.CoreV1().Secrets(db.Namespace)
+	secret, err := secretClient.Get(ctx, credentialsSecretName(name), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if owner := metav1.GetControllerOf(secret); owner == nil || owner.UID != db.UID {
+		return nil
+	}
+
+	secret.OwnerReferences = nil
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	secret.Labels[retainedLabel] = db.Name
+	if _, err := secretClient.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("retain credentials secret: %w", err)
+	}
+	return nil
+}
+
+// adoptRetained takes over the data PVCs and credentials Secret a deleted Database of the same
+// databaseName retained. It returns the image and data volume recorded on the PVCs, empty when
+// there were none.
+func (r *DatabaseReconciler) adoptRetained(ctx context.Context, db *dbv1.Database, name string) (string, string, error) {
+	log := crlog.FromContext(ctx)
+	selector := "app=" + name + "," + retainedLabel
+
+	secretClient := r.kubeClient.CoreV1().Secrets(db.Namespace)
+	secret, err := secretClient.Get(ctx, credentialsSecretName(name), metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return "", "", err
+	}
+	if err == nil && secret.Labels[retainedLabel] != "" {
+		delete(secret.Labels, retainedLabel)
+		secret.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(db, dbv1.SchemeGroupVersion.WithKind("Database"))}
+		if _, err := secretClient.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return "", "", fmt.Errorf("adopt credentials secret: %w", err)
+		}
+		log.Info("Adopted retained credentials Secret", "secret", secret.Name)
+	}
+
+	pvcClient := r.kubeClient.CoreV1().PersistentVolumeClaims(db.Namespace)
+	pvcs, err := pvcClient.List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return "", "", fmt.Errorf("list retained pvcs: %w", err)
+	}
+	var image, volume string
+	for _, pvc := range pvcs.Items {
+		image, volume = pvc.Annotations[imageAnnotation], pvc.Annotations[dataVolumeAnnotation]
+		patch := fmt.Sprintf(`{"metadata":{"labels":{%q:null}}}`, retainedLabel)
+		if _, err := pvcClient.Patch(ctx, pvc.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+			return "", "", fmt.Errorf("adopt pvc %s: %w", pvc.Name, err)
+		}
+		log.Info("Adopted retained PVC", "pvc", pvc.Name, "image", image)
+	}
+	return image, volume, nil
+}
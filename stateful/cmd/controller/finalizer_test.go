@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newClaim(name string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+		Name:      name,
+		Namespace: "default",
+		Labels:    map[string]string{"app": "pg"},
+	}}
+}
+
+func TestFinalizeDatabaseOnlyTouchesDataClaims(t *testing.T) {
+	dataClaims := []string{"data-pg-0", "data-pg-1", "data-pg16-pg-0"}
+	otherClaims := []string{"cache-pg-0", "data-pg-1-0", "pg-upgrade", "data-pg"}
+	tests := []struct {
+		policy   string
+		wantLeft []string
+	}{
+		{policy: dbv1.DeletionPolicyDelete, wantLeft: otherClaims},
+		{policy: dbv1.DeletionPolicyRetain, wantLeft: append(append([]string{}, dataClaims...), otherClaims...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			ctx := context.Background()
+			db := newTestDatabase()
+			db.Spec.DatabaseName = "pg"
+			db.Spec.DeletionPolicy = tt.policy
+			db.Status.DataVolume = "data-pg16"
+			var objects []runtime.Object
+			for _, name := range append(append([]string{}, dataClaims...), otherClaims...) {
+				objects = append(objects, newClaim(name))
+			}
+			r := &DatabaseReconciler{kubeClient: fake.NewClientset(objects...)}
+
+			done, err := r.finalizeDatabase(ctx, db, "pg")
+			if err != nil || !done {
+				t.Fatalf("finalizeDatabase() = %v, %v", done, err)
+			}
+			pvcs, err := r.kubeClient.CoreV1().PersistentVolumeClaims("default").List(ctx, metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("couldn't list pvcs: %v", err)
+			}
+			var left []string
+			for _, pvc := range pvcs.Items {
+				left = append(left, pvc.Name)
+				retained := pvc.Labels[retainedLabel] != ""
+				if isData := isDataClaim(db, "pg", pvc.Name); retained != isData {
+					t.Errorf("pvc %s retained = %v, want %v", pvc.Name, retained, isData)
+				}
+			}
+			sort.Strings(left)
+			want := append([]string{}, tt.wantLeft...)
+			sort.Strings(want)
+			if len(left) != len(want) {
+				t.Fatalf("pvcs left = %v, want %v", left, want)
+			}
+			for i := range want {
+				if left[i] != want[i] {
+					t.Fatalf("pvcs left = %v, want %v", left, want)
+				}
+			}
+		})
+	}
+}
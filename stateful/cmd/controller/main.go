@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
@@ -13,10 +15,14 @@ import (
 	"go.uber.org/zap/zapcore"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/kubernetes"
@@ -24,9 +30,16 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	crlog "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
 var (
@@ -36,12 +49,13 @@ var (
 
 func init() {
 	utilruntime.Must(dbv1.AddToScheme(scheme))
+	utilruntime.Must(corev1.AddToScheme(scheme))
 }
 
 type DatabaseReconciler struct {
 	client.Client
 	Scheme     *runtime.Scheme
-	kubeClient *kubernetes.Clientset
+	kubeClient kubernetes.Interface
 }
 
 func (r *DatabaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -51,7 +65,7 @@ func (r *DatabaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	db := &dbv1.Database{}
 	if err := r.Get(ctx, req.NamespacedName, db); err != nil {
 		if k8serrors.IsNotFound(err) {
-			// resource deleted -> ensure StatefulSet/service removed
+			// Children were handled by the finalizer and the garbage collector
 			log.Info("Database CR deleted; nothing more to do")
 			return ctrl.Result{}, nil
 		}
@@ -59,9 +73,48 @@ func (r *DatabaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	}
 
 	// Determine a stable name for resources
-	name := db.Spec.DatabaseName
-	if name == "" {
-		name = db.Name // fallback to CR name
+	name := databaseResourceName(db)
+
+	// Apply the deletion policy before the Database is removed
+	if !db.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(db, databaseFinalizer) {
+			done, err := r.finalizeDatabase(ctx, db, name)
+			if err != nil {
+				return ctrl.Result{}, fmt.Errorf("finalize database: %w", err)
+			}
+			if !done {
+				return ctrl.Result{RequeueAfter: jobPollInterval}, nil
+			}
+			controllerutil.RemoveFinalizer(db, databaseFinalizer)
+			if err := r.Update(ctx, db); err != nil {
+				return ctrl.Result{}, fmt.Errorf("remove finalizer: %w", err)
+			}
+			log.Info("Finalized Database", "policy", deletionPolicy(db))
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// Make sure the Database can't go away before its deletion policy is applied
+	if !controllerutil.ContainsFinalizer(db, databaseFinalizer) {
+		controllerutil.AddFinalizer(db, databaseFinalizer)
+		if err := r.Update(ctx, db); err != nil {
+			return ctrl.Result{}, fmt.Errorf("add finalizer: %w", err)
+		}
+	}
+
+	storage, err := storageRequest(db)
+	if err != nil {
+		// Requeueing won't fix an invalid size, wait for the spec to change
+		log.Error(err, "Invalid storage size", "storage", db.Spec.Storage)
+		oldStatus := db.Status.DeepCopy()
+		setDatabaseCondition(db, dbv1.ConditionStorageResized, metav1.ConditionFalse, "InvalidStorage",
+			fmt.Sprintf("spec.storage %q is not a valid quantity: %s", db.Spec.Storage, err))
+		if !equality.Semantic.DeepEqual(oldStatus, &db.Status) {
+			if err := r.Status().Update(ctx, db); err != nil {
+				return ctrl.Result{}, fmt.Errorf("update status: %w", err)
+			}
+		}
+		return ctrl.Result{}, nil
 	}
 
 	// clients for core operations
@@ -70,7 +123,7 @@ func (r *DatabaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	//pvcClient := r.kubeClient.CoreV1().PersistentVolumeClaims(req.Namespace)
 
 	// ensure headless service exists (for stable DNS)
-	_, err := svcClient.Get(ctx, name, metav1.GetOptions{})
+	_, err = svcClient.Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
 		if k8serrors.IsNotFound(err) {
 			svc := makeHeadlessService(name)
@@ -83,29 +136,101 @@ func (r *DatabaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		}
 	}
 
-	// ensure statefulset exists
-	sts, err := stsClient.Get(ctx, name, metav1.GetOptions{})
-	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			stsObj := makeStatefulSet(db, name)
-			if _, err := stsClient.Create(ctx, stsObj, metav1.CreateOptions{}); err != nil {
-				return ctrl.Result{}, fmt.Errorf("create statefulset: %w", err)
+	// ensure the read-write and read-only services, the pg_hba.conf, and the passwords of the
+	// role the standbys replicate with and the role clients connect as
+	if err := r.ensureRoleServices(ctx, db, name); err != nil {
+		return ctrl.Result{}, fmt.Errorf("ensure role services: %w", err)
+	}
+	if err := r.ensureConfigMap(ctx, db, name); err != nil {
+		return ctrl.Result{}, fmt.Errorf("ensure configmap: %w", err)
+	}
+	if err := r.ensurePasswordSecret(ctx, db, name, replicationSecretName(name)); err != nil {
+		return ctrl.Result{}, fmt.Errorf("ensure replication secret: %w", err)
+	}
+	if err := r.ensurePasswordSecret(ctx, db, name, appSecretName(name)); err != nil {
+		return ctrl.Result{}, fmt.Errorf("ensure app secret: %w", err)
+	}
+
+	// a new Database takes over the volumes and credentials a deleted one of the same
+	// databaseName retained, and starts on the image they were written by
+	if db.Status.Image == "" {
+		image, volume, err := r.adoptRetained(ctx, db, name)
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("adopt retained resources: %w", err)
+		}
+		if image != "" {
+			db.Status.Image = image
+			db.Status.DataVolume = volume
+			if err := r.Status().Update(ctx, db); err != nil {
+				return ctrl.Result{}, fmt.Errorf("update status: %w", err)
 			}
-			log.Info("Created StatefulSet", "name", name)
-			// Requeue so status can be observed later
-			return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
 		}
+	}
+
+	// ensure the password Secret exists before pods reference it
+	passwordRef, desiredPassword, err := r.ensureCredentials(ctx, db, name)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("ensure credentials: %w", err)
+	}
+	password, err := r.currentPassword(ctx, db, name)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("get current password: %w", err)
+	}
+
+	// start or move forward an upgrade when spec.image changed. This decides the image and
+	// volumes the StatefulSet runs, and recreates it when a major upgrade swaps the volumes.
+	db.Status.PasswordSecretRef = passwordRef
+	sts, err := stsClient.Get(ctx, name, metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
 		return ctrl.Result{}, err
 	}
+	if err != nil {
+		sts = nil
+	}
+	if sts != nil && sts.DeletionTimestamp != nil {
+		log.Info("Waiting for the StatefulSet to be deleted", "name", name)
+		return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+	}
+	deleted, err := r.reconcileUpgrade(ctx, db, name, password, sts, storage)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("reconcile upgrade: %w", err)
+	}
+	if deleted {
+		return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+	}
+
+	// ensure statefulset exists
+	if sts == nil {
+		stsObj := makeStatefulSet(db, name, passwordRef, storage)
+		if _, err := stsClient.Create(ctx, stsObj, metav1.CreateOptions{}); err != nil {
+			return ctrl.Result{}, fmt.Errorf("create statefulset: %w", err)
+		}
+		log.Info("Created StatefulSet", "name", name, "image", postgresImage(db))
+		// Requeue so status can be observed later
+		return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+	}
 
-	// Sync replicas if changed
-	desired := int32(db.Spec.Replicas)
-	if sts.Spec.Replicas == nil || *sts.Spec.Replicas != desired {
-		sts.Spec.Replicas = &desired
+	// Sync replicas and the pod template if changed. Fields the API server defaults are
+	// ignored, so only differences in what the controller sets trigger a rollout.
+	desired := makeStatefulSet(db, name, passwordRef, storage)
+	changed := false
+	if !equality.Semantic.DeepDerivative(desired.Spec.Template, sts.Spec.Template) {
+		sts.Spec.Template = desired.Spec.Template
+		changed = true
+	}
+	if sts.Spec.Replicas == nil || *sts.Spec.Replicas != *desired.Spec.Replicas {
+		sts.Spec.Replicas = desired.Spec.Replicas
+		changed = true
+	}
+	if !equality.Semantic.DeepDerivative(desired.Spec.UpdateStrategy, sts.Spec.UpdateStrategy) {
+		sts.Spec.UpdateStrategy = desired.Spec.UpdateStrategy
+		changed = true
+	}
+	if changed {
 		if _, err := stsClient.Update(ctx, sts, metav1.UpdateOptions{}); err != nil {
-			return ctrl.Result{}, fmt.Errorf("update statefulset replicas: %w", err)
+			return ctrl.Result{}, fmt.Errorf("update statefulset: %w", err)
 		}
-		log.Info("Updated StatefulSet replicas", "name", name, "replicas", desired)
+		log.Info("Updated StatefulSet", "name", name, "replicas", *desired.Spec.Replicas)
 		// requeue to observe readiness
 		return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
 	}
@@ -121,9 +246,56 @@ func (r *DatabaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		phase = "Ready"
 	}
 
-	if db.Status.Phase != phase || db.Status.ReadyReplicas != ready {
-		db.Status.Phase = phase
-		db.Status.ReadyReplicas = ready
+	oldStatus := db.Status.DeepCopy()
+	db.Status.Phase = phase
+	db.Status.ReadyReplicas = ready
+	db.Status.PasswordSecretRef = passwordRef
+	db.Status.Primary = name + "-0"
+	db.Status.ReadWriteService = roleServiceName(name, rolePrimary)
+	db.Status.ReadOnlyService = roleServiceName(name, roleStandby)
+	if err := r.labelPodRoles(ctx, db, name); err != nil {
+		return ctrl.Result{}, fmt.Errorf("label pod roles: %w", err)
+	}
+	if err := r.reconcileStorage(ctx, db, name, storage); err != nil {
+		return ctrl.Result{}, err
+	}
+	// a major upgrade restores the roles and databases from its dump
+	if phase == "Ready" && !upgradeRunning(db) {
+		if password != desiredPassword {
+			if err := r.rotatePassword(ctx, db, name, password, desiredPassword); err != nil {
+				return ctrl.Result{}, fmt.Errorf("rotate password: %w", err)
+			}
+			password = desiredPassword
+		}
+		db.Status.Roles, db.Status.Databases = r.reconcileSQL(ctx, db, name, password)
+
+		// publish the connection details once the role they log in as has the password in them
+		role := r.reconcileAppRole(ctx, db, name, password)
+		db.Status.AppRole = &role
+		if role.Ready {
+			if err := r.ensureConnectionSecret(ctx, db, name); err != nil {
+				return ctrl.Result{}, fmt.Errorf("ensure connection secret: %w", err)
+			}
+			db.Status.ConnectionSecret = connectionSecretName(name)
+		}
+	}
+	if ready > 0 && *sts.Spec.Replicas > 1 {
+		// standbys can't clone the primary until their role exists
+		if !upgradeRunning(db) {
+			role := r.reconcileReplicationRole(ctx, db, name, password)
+			db.Status.ReplicationRole = &role
+		}
+		standbys, err := replicationStatus(ctx, db, name, password, *sts.Spec.Replicas)
+		if err != nil {
+			// keep the last known state, the primary may be restarting
+			log.Error(err, "Failed to read replication status")
+		} else {
+			db.Status.Standbys = standbys
+		}
+	} else {
+		db.Status.Standbys = nil
+	}
+	if !equality.Semantic.DeepEqual(oldStatus, &db.Status) {
 		if err := r.Status().Update(ctx, db); err != nil {
 			return ctrl.Result{}, fmt.Errorf("update status: %w", err)
 		}
@@ -161,23 +333,92 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(config, ctrl.Options{Scheme: scheme})
+	// Only pods of Databases are cached
+	databasePods, err := labels.NewRequirement(databaseLabel, selection.Exists, nil)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	mgr, err := ctrl.NewManager(config, ctrl.Options{
+		Scheme: scheme,
+		Cache: cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				&corev1.Pod{}: {Label: labels.NewSelector().Add(*databasePods)},
+			},
+		},
+	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	databaseReconciler := &DatabaseReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		kubeClient: clientset,
+	}
+	// new pods are labelled with their role as soon as they are created
 	if err := ctrl.NewControllerManagedBy(mgr).
 		For(&dbv1.Database{}).
-		Complete(&DatabaseReconciler{
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(databaseReconciler.mapPodToDatabases),
+			builder.WithPredicates(predicate.Funcs{
+				UpdateFunc: func(e event.UpdateEvent) bool {
+					return e.ObjectOld.GetLabels()[roleLabel] != e.ObjectNew.GetLabels()[roleLabel]
+				},
+				DeleteFunc: func(event.DeleteEvent) bool { return false },
+			})).
+		Complete(databaseReconciler); err != nil {
+		setupLog.Error(err, "unable to create controller")
+		os.Exit(1)
+	}
+
+	if err := ctrl.NewControllerManagedBy(mgr).
+		For(&dbv1.DatabaseBackup{}).
+		Complete(&DatabaseBackupReconciler{
 			Client:     mgr.GetClient(),
 			Scheme:     mgr.GetScheme(),
 			kubeClient: clientset,
 		}); err != nil {
-		setupLog.Error(err, "unable to create controller")
+		setupLog.Error(err, "unable to create backup controller")
+		os.Exit(1)
+	}
+
+	if err := ctrl.NewControllerManagedBy(mgr).
+		For(&dbv1.DatabaseRestore{}).
+		Complete(&DatabaseRestoreReconciler{
+			Client:     mgr.GetClient(),
+			Scheme:     mgr.GetScheme(),
+			kubeClient: clientset,
+		}); err != nil {
+		setupLog.Error(err, "unable to create restore controller")
 		os.Exit(1)
 	}
 
+	// Register the validating webhooks. They need serving certificates, so they are only
+	// enabled when the deployment provides them.
+	if os.Getenv("ENABLE_WEBHOOKS") == "true" {
+		err = ctrl.NewWebhookManagedBy(mgr).
+			For(&dbv1.Database{}).
+			WithValidator(&DatabaseValidator{}).
+			Complete()
+		if err == nil {
+			err = ctrl.NewWebhookManagedBy(mgr).
+				For(&dbv1.DatabaseBackup{}).
+				WithValidator(&DatabaseBackupValidator{}).
+				Complete()
+		}
+		if err == nil {
+			err = ctrl.NewWebhookManagedBy(mgr).
+				For(&dbv1.DatabaseRestore{}).
+				WithValidator(&DatabaseRestoreValidator{}).
+				Complete()
+		}
+		if err != nil {
+			setupLog.Error(err, "unable to create webhook")
+			os.Exit(1)
+		}
+	}
+
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "error running manager")
@@ -193,45 +434,38 @@ func makeHeadlessService(name string) *corev1.Service {
 		Spec: corev1.ServiceSpec{
 			ClusterIP: corev1.ClusterIPNone, // headless
 			Ports: []corev1.ServicePort{
-				{Port: 5432, TargetPort: intstrFromInt(5432)},
+				{Port: postgresPort, TargetPort: intstrFromInt(postgresPort)},
 			},
 			Selector: map[string]string{"app": name},
 		},
 	}
 }
 
-func makeStatefulSet(db *dbv1.Database, name string) *appsv1.StatefulSet {
+func makeStatefulSet(db *dbv1.Database, name string, passwordRef *dbv1.SecretKeyRef, storage resource.Quantity) *appsv1.StatefulSet {
 	replicas := int32(db.Spec.Replicas)
-	storage := db.Spec.Storage
-	if storage == "" {
-		storage = "1Gi"
+	if n, ok := upgradeReplicas(db); ok {
+		replicas = n
 	}
+	partition := upgradePartition(db)
 
 	pvc := corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "data",
+			Name: dataVolumeName(db),
 		},
 		Spec: corev1.PersistentVolumeClaimSpec{
 			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
 			Resources: corev1.VolumeResourceRequirements{
 				Requests: corev1.ResourceList{
-					corev1.ResourceStorage: resource.MustParse(storage),
+					corev1.ResourceStorage: storage,
 				},
 			},
 		},
 	}
 
-	image := db.Spec.Image
-	if image == "" {
-		image = "postgres:15-alpine"
-	}
-
-	pullPolicy := corev1.PullIfNotPresent
-	if db.Spec.ImagePullPolicy != "" {
-		pullPolicy = corev1.PullPolicy(db.Spec.ImagePullPolicy)
-	}
-
 	labels := map[string]string{"app": name}
+	// the selector is immutable, so further pod labels only go into the template
+	podLabels := map[string]string{"app": name, databaseLabel: name}
+	hbaChecksum := sha256.Sum256([]byte(hbaConfig(db)))
 
 	return &appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{Name: name},
@@ -239,27 +473,51 @@ func makeStatefulSet(db *dbv1.Database, name string) *appsv1.StatefulSet {
 			Replicas:    &replicas,
 			Selector:    &metav1.LabelSelector{MatchLabels: labels},
 			ServiceName: name, // headless service
+			// pods are replaced from the highest ordinal down, so standbys update before the primary
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+			},
 			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      podLabels,
+					Annotations: map[string]string{hbaChecksumAnnotation: hex.EncodeToString(hbaChecksum[:])},
+				},
 				Spec: corev1.PodSpec{
+					// standbys clone the primary before postgres starts on them
+					InitContainers: []corev1.Container{standbyInitContainer(db, name)},
 					Containers: []corev1.Container{
 						{
 							Name:            "postgres",
-							Image:           image,
-							ImagePullPolicy: pullPolicy,
-							Ports:           []corev1.ContainerPort{{ContainerPort: 5432}},
-							Env: []corev1.EnvVar{
-								{Name: "POSTGRES_PASSWORD", Value: db.Spec.Password},
-							},
+							Image:           postgresImage(db),
+							ImagePullPolicy: postgresPullPolicy(db),
+							Args:            []string{"postgres", "-c", "hba_file=" + configMountPath + "/pg_hba.conf"},
+							Ports:           []corev1.ContainerPort{{ContainerPort: postgresPort}},
+							Env:             []corev1.EnvVar{passwordEnv(passwordRef)},
 							VolumeMounts: []corev1.VolumeMount{
-								{Name: "data", MountPath: "/var/lib/postgresql/data"},
+								{Name: dataVolumeName(db), MountPath: "/var/lib/postgresql/data"},
+								{Name: "config", MountPath: configMountPath, ReadOnly: true},
 							},
+							// the fields the API server defaults are set, so the template comparison sees no difference
 							ReadinessProbe: &corev1.Probe{
 								ProbeHandler: corev1.ProbeHandler{
-									TCPSocket: &corev1.TCPSocketAction{Port: intstrFromInt(5432)},
+									TCPSocket: &corev1.TCPSocketAction{Port: intstrFromInt(postgresPort)},
 								},
 								InitialDelaySeconds: 5,
 								PeriodSeconds:       5,
+								TimeoutSeconds:      1,
+								SuccessThreshold:    1,
+								FailureThreshold:    3,
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{Name: configMapName(name)},
+								},
 							},
 						},
 					},
@@ -270,6 +528,41 @@ func makeStatefulSet(db *dbv1.Database, name string) *appsv1.StatefulSet {
 	}
 }
 
+// mapPodToDatabases returns the Databases whose databaseName a pod is labelled with
+func (r *DatabaseReconciler) mapPodToDatabases(ctx context.Context, obj client.Object) []reconcile.Request {
+	name, ok := obj.GetLabels()[databaseLabel]
+	if !ok {
+		return nil
+	}
+	var dbs dbv1.DatabaseList
+	if err := r.List(ctx, &dbs, client.InNamespace(obj.GetNamespace())); err != nil {
+		crlog.FromContext(ctx).Error(err, "Failed to list Databases", "pod", obj.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, db := range dbs.Items {
+		if databaseResourceName(&db) == name {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: db.Namespace, Name: db.Name}})
+		}
+	}
+	return requests
+}
+
+// databaseResourceName is the name of the StatefulSet and headless Service of a Database
+func databaseResourceName(db *dbv1.Database) string {
+	if db.Spec.DatabaseName != "" {
+		return db.Spec.DatabaseName
+	}
+	return db.Name // fallback to CR name
+}
+
+func postgresPullPolicy(db *dbv1.Database) corev1.PullPolicy {
+	if db.Spec.ImagePullPolicy == "" {
+		return corev1.PullIfNotPresent
+	}
+	return corev1.PullPolicy(db.Spec.ImagePullPolicy)
+}
+
 // small helper for intstr
 func intstrFromInt(i int) intstr.IntOrString {
 	return intstr.FromInt(i)
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	crlog "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// roleLabel tells the standbys apart for the read-only Service. Pod 0 is the primary.
+	roleLabel   = "databases.stackbalancer.com/role"
+	rolePrimary = "primary"
+	roleStandby = "standby"
+	// podIndexLabel is set by the StatefulSet controller, from Kubernetes 1.28
+	podIndexLabel = "apps.kubernetes.io/pod-index"
+	// databaseLabel marks the pods of a Database with its databaseName, so the controller
+	// only caches and watches those
+	databaseLabel = "databases.stackbalancer.com/database"
+	// hbaChecksumAnnotation restarts the pods when pg_hba.conf changes, since postgres only
+	// reads it on start or reload
+	hbaChecksumAnnotation = "databases.stackbalancer.com/hba-checksum"
+
+	// replicationUser is the role standbys replicate with, with the password in <name>-replication
+	replicationUser = "replicator"
+
+	configMountPath = "/etc/postgresql"
+)
+
+// defaultAllowedCIDRs are the private ranges, which hold the pod network of most clusters
+var defaultAllowedCIDRs = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"}
+
+// hbaConfig returns the pg_hba.conf replacing the one of the image: local connections are
+// trusted, clients may connect from the allowed networks with a password, and only the
+// replication role may stream WAL.
+func hbaConfig(db *dbv1.Database) string {
+	// the webhook is optional, and a line postgres can't parse would keep it from starting
+	var cidrs []string
+	for _, cidr := range db.Spec.AllowedCIDRs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			cidrs = append(cidrs, network.String())
+		}
+	}
+	if len(cidrs) == 0 {
+		cidrs = defaultAllowedCIDRs
+	}
+	var b strings.Builder
+	b.WriteString(`# Managed by the database controller
+local   all          all                       trust
+host    all          all         127.0.0.1/32  trust
+host    all          all         ::1/128       trust
+`)
+	for _, cidr := range cidrs {
+		fmt.Fprintf(&b, "host    replication  %s  %s  scram-sha-256\n", replicationUser, cidr)
+	}
+	for _, cidr := range cidrs {
+		fmt.Fprintf(&b, "host    all          all         %s  scram-sha-256\n", cidr)
+	}
+	return b.String()
+}
+
+// standbyInitScript clones the primary into the empty volume of a standby. Pod 0 is the
+// primary. A volume that already holds a standby isn't cloned again, but its primary_conninfo
+// is rewritten, so standbys cloned as postgres or with an older replication password keep
+// streaming. A volume holding a data directory of its own, left from before replication, may
+// hold the only copy of some writes, so the pod fails rather than wiping it or serving it
+// as a standby.
+const standbyInitScript = `set -eu
+[ "${HOSTNAME##*-}" = 0 ] && exit 0
+conninfo="host=$PRIMARY_HOST port=5432 user=$REPLICATION_USER application_name=$HOSTNAME"
+if [ -s "$PGDATA/PG_VERSION" ] && [ ! -f "$PGDATA/standby.signal" ]; then
+  echo "$PGDATA holds a data directory that wasn't cloned from $PRIMARY_HOST." >&2
+  echo "Move any data only this pod holds to the primary, then delete the PVC of $HOSTNAME and the pod to clone it." >&2
+  exit 1
+fi
+if [ ! -s "$PGDATA/PG_VERSION" ]; then
+  until pg_isready --host="$PRIMARY_HOST" --port=5432; do sleep 2; done
+  pg_basebackup --pgdata="$PGDATA" --wal-method=stream --write-recovery-conf --checkpoint=fast \
+    --dbname="$conninfo" || {
+    find "$PGDATA" -mindepth 1 -delete
+    exit 1
+  }
+fi
+conf="$PGDATA/postgresql.auto.conf"
+grep -v '^primary_conninfo' "$conf" > "$conf.tmp" || true
+echo "primary_conninfo = '$conninfo password=$PGPASSWORD'" >> "$conf.tmp"
+cat "$conf.tmp" > "$conf"
+rm "$conf.tmp"
+`
+
+func replicationSecretName(name string) string {
+	return name + "-replication"
+}
+
+func configMapName(name string) string {
+	return name + "-config"
+}
+
+// primaryHost is the DNS name of pod 0 through the headless Service
+func primaryHost(name string) string {
+	return fmt.Sprintf("%s-0.%s", name, name)
+}
+
+func roleServiceName(name, role string) string {
+	if role == rolePrimary {
+		return name + "-rw"
+	}
+	return name + "-ro"
+}
+
+// ensureConfigMap creates or updates the ConfigMap with the pg_hba.conf of the Database
+func (r *DatabaseReconciler) ensureConfigMap(ctx context.Context, db *dbv1.Database, name string) error {
+	cmClient := r.kubeClient.CoreV1().ConfigMaps(db.Namespace)
+	cm, err := cmClient.Get(ctx, configMapName(name), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            configMapName(name),
+				Labels:          map[string]string{"app": name},
+				OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(db, dbv1.SchemeGroupVersion.WithKind("Database"))},
+			},
+			Data: map[string]string{"pg_hba.conf": hbaConfig(db)},
+		}
+		if _, err := cmClient.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		crlog.FromContext(ctx).Info("Created ConfigMap", "configmap", cm.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data["pg_hba.conf"] == hbaConfig(db) {
+		return nil
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data["pg_hba.conf"] = hbaConfig(db)
+	_, err = cmClient.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// ensureRoleServices creates the read-write Service of the primary and the read-only Service
+// of the standbys, and brings their selectors in line
+func (r *DatabaseReconciler) ensureRoleServices(ctx context.Context, db *dbv1.Database, name string) error {
+	svcClient := r.kubeClient.CoreV1().Services(db.Namespace)
+	for _, role := range []string{rolePrimary, roleStandby} {
+		want := makeRoleService(db, name, role)
+		svc, err := svcClient.Get(ctx, want.Name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			if _, err := svcClient.Create(ctx, want, metav1.CreateOptions{}); err != nil {
+				return err
+			}
+			crlog.FromContext(ctx).Info("Created service", "service", want.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if equality.Semantic.DeepEqual(svc.Spec.Selector, want.Spec.Selector) {
+			continue
+		}
+		svc.Spec.Selector = want.Spec.Selector
+		if _, err := svcClient.Update(ctx, svc, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		crlog.FromContext(ctx).Info("Updated service selector", "service", want.Name)
+	}
+	return nil
+}
+
+func makeRoleService(db *dbv1.Database, name, role string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            roleServiceName(name, role),
+			Labels:          map[string]string{"app": name},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(db, dbv1.SchemeGroupVersion.WithKind("Database"))},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Port: postgresPort, TargetPort: intstrFromInt(postgresPort)},
+			},
+			Selector: roleSelector(name, role),
+		},
+	}
+}
+
+// roleSelector selects the primary by its pod index, which the StatefulSet sets on every pod it
+// creates. Selectors can't exclude a label value, so the standbys need roleLabel.
+func roleSelector(name, role string) map[string]string {
+	if role == rolePrimary {
+		return map[string]string{"app": name, podIndexLabel: "0"}
+	}
+	return map[string]string{"app": name, roleLabel: roleStandby}
+}
+
+// labelPodRoles labels pod 0 as the primary and the other pods as standbys. It runs whenever a
+// pod of the Database is created, so recreated standbys join the read-only Service right away.
+func (r *DatabaseReconciler) labelPodRoles(ctx context.Context, db *dbv1.Database, name string) error {
+	podClient := r.kubeClient.CoreV1().Pods(db.Namespace)
+	pods, err := podClient.List(ctx, metav1.ListOptions{LabelSelector: "app=" + name})
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range pods.Items {
+		role := roleStandby
+		if pod.Name == name+"-0" {
+			role = rolePrimary
+		}
+		if pod.Labels[roleLabel] == role {
+			continue
+		}
+		patch := fmt.Sprintf(`{"metadata":{"labels":{%q:%q}}}`, roleLabel, role)
+		if _, err := podClient.Patch(ctx, pod.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("label pod %s: %w", pod.Name, err)
+		}
+		crlog.FromContext(ctx).Info("Labelled pod", "pod", pod.Name, "role", role)
+	}
+	return nil
+}
+
+// reconcileReplicationRole creates replicationUser on the primary, and sets its password again
+// whenever the replication Secret changes
+func (r *DatabaseReconciler) reconcileReplicationRole(ctx context.Context, db *dbv1.Database, name, password string) dbv1.SQLObjectStatus {
+	status := dbv1.SQLObjectStatus{Name: replicationUser}
+	if db.Status.ReplicationRole != nil {
+		status.PasswordVersion = db.Status.ReplicationRole.PasswordVersion
+	}
+	addr := sqlAddress(db, name)
+	conn, err := openSQL(ctx, addr, password, postgresUser)
+	if err != nil {
+		return sqlObjectStatus(status, fmt.Errorf("connect to %s: %w", addr, err))
+	}
+	defer conn.Close()
+
+	role := dbv1.RoleSpec{Name: replicationUser, Login: true, PasswordSecretRef: &dbv1.SecretKeyRef{Name: replicationSecretName(name)}}
+	status.PasswordVersion, err = r.reconcileRole(ctx, conn, db.Namespace, role, true, status.PasswordVersion)
+	return sqlObjectStatus(status, err)
+}
+
+// replicationStatus reports the standbys of the primary from pg_stat_replication. Standbys
+// that aren't streaming are reported as disconnected.
+func replicationStatus(ctx context.Context, db *dbv1.Database, name, password string, replicas int32) ([]dbv1.StandbyStatus, error) {
+	conn, err := openSQL(ctx, sqlAddress(db, name), password, postgresUser)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, `SELECT application_name, state,
+		COALESCE(pg_wal_lsn_diff(pg_current_wal_lsn(), replay_lsn), 0)::bigint,
+		COALESCE(EXTRACT(EPOCH FROM replay_lag) * 1000, 0)::bigint
+		FROM pg_catalog.pg_stat_replication`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	streaming := map[string]dbv1.StandbyStatus{}
+	for rows.Next() {
+		var standby dbv1.StandbyStatus
+		if err := rows.Scan(&standby.Pod, &standby.State, &standby.LagBytes, &standby.ReplayLagMillis); err != nil {
+			return nil, err
+		}
+		streaming[standby.Pod] = standby
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var standbys []dbv1.StandbyStatus
+	for i := int32(1); i < replicas; i++ {
+		pod := name + "-" + strconv.Itoa(int(i))
+		standby, ok := streaming[pod]
+		if !ok {
+			standby = dbv1.StandbyStatus{Pod: pod, State: "disconnected"}
+		}
+		standbys = append(standbys, standby)
+	}
+	return standbys, nil
+}
+
+// standbyInitContainer runs standbyInitScript before postgres starts
+func standbyInitContainer(db *dbv1.Database, name string) corev1.Container {
+	return corev1.Container{
+		Name:            "init-standby",
+		Image:           postgresImage(db),
+		ImagePullPolicy: postgresPullPolicy(db),
+		Command:         []string{"sh", "-c", standbyInitScript},
+		Env: []corev1.EnvVar{
+			{Name: "PRIMARY_HOST", Value: primaryHost(name)},
+			{Name: "REPLICATION_USER", Value: replicationUser},
+			{
+				Name: "PGPASSWORD",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: replicationSecretName(name)},
+						Key:                  defaultPasswordKey,
+					},
+				},
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: dataVolumeName(db), MountPath: "/var/lib/postgresql/data"},
+		},
+	}
+}
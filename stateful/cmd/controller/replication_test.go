@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHBAConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidrs   []string
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "private ranges by default",
+			want: []string{
+				"host    replication  replicator  10.0.0.0/8  scram-sha-256",
+				"host    all          all         fc00::/7  scram-sha-256",
+			},
+			notWant: []string{"host    all          all    all", "replication  all"},
+		},
+		{
+			name:    "allowed networks",
+			cidrs:   []string{"10.244.1.7/16", "not a network"},
+			want:    []string{"host    replication  replicator  10.244.0.0/16  scram-sha-256", "host    all          all         10.244.0.0/16  scram-sha-256"},
+			notWant: []string{"not a network", "192.168.0.0/16"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDatabase()
+			db.Spec.AllowedCIDRs = tt.cidrs
+			config := hbaConfig(db)
+			for _, line := range tt.want {
+				if !strings.Contains(config, line+"\n") {
+					t.Errorf("pg_hba.conf is missing %q:\n%s", line, config)
+				}
+			}
+			for _, text := range tt.notWant {
+				if strings.Contains(config, text) {
+					t.Errorf("pg_hba.conf contains %q:\n%s", text, config)
+				}
+			}
+		})
+	}
+}
+
+func TestEnsureRoleServicesSelectors(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase()
+	// a read-write Service of an older controller selected the role label
+	old := makeRoleService(db, "postgres-db", rolePrimary)
+	old.Namespace = "default"
+	old.Spec.Selector = map[string]string{"app": "postgres-db", roleLabel: rolePrimary}
+	r := &DatabaseReconciler{kubeClient: fake.NewClientset(old)}
+
+	if err := r.ensureRoleServices(ctx, db, "postgres-db"); err != nil {
+		t.Fatalf("ensureRoleServices() error = %v", err)
+	}
+	for role, want := range map[string]map[string]string{
+		rolePrimary: {"app": "postgres-db", podIndexLabel: "0"},
+		roleStandby: {"app": "postgres-db", roleLabel: roleStandby},
+	} {
+		svc, err := r.kubeClient.CoreV1().Services("default").Get(ctx, roleServiceName("postgres-db", role), metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("couldn't get %s service: %v", role, err)
+		}
+		if len(svc.Spec.Selector) != len(want) || svc.Spec.Selector[podIndexLabel] != want[podIndexLabel] || svc.Spec.Selector[roleLabel] != want[roleLabel] {
+			t.Errorf("%s service selector = %v, want %v", role, svc.Spec.Selector, want)
+		}
+	}
+}
+
+func TestStatefulSetPodTemplate(t *testing.T) {
+	db := newTestDatabase()
+	sts := makeStatefulSet(db, "postgres-db", &dbv1.SecretKeyRef{Name: "postgres-db-credentials", Key: defaultPasswordKey}, resource.MustParse("1Gi"))
+	if got := sts.Spec.Template.Labels[databaseLabel]; got != "postgres-db" {
+		t.Errorf("pod label %s = %q, want postgres-db", databaseLabel, got)
+	}
+	checksum := sts.Spec.Template.Annotations[hbaChecksumAnnotation]
+	db.Spec.AllowedCIDRs = []string{"10.244.0.0/16"}
+	changed := makeStatefulSet(db, "postgres-db", &dbv1.SecretKeyRef{Name: "postgres-db-credentials", Key: defaultPasswordKey}, resource.MustParse("1Gi"))
+	if checksum == "" || changed.Spec.Template.Annotations[hbaChecksumAnnotation] == checksum {
+		t.Error("pods aren't restarted when pg_hba.conf changes")
+	}
+
+	var password *corev1.EnvVar
+	for i, env := range sts.Spec.Template.Spec.InitContainers[0].Env {
+		if env.Name == "PGPASSWORD" {
+			password = &sts.Spec.Template.Spec.InitContainers[0].Env[i]
+		}
+	}
+	if password == nil || password.ValueFrom == nil || password.ValueFrom.SecretKeyRef.Name != replicationSecretName("postgres-db") {
+		t.Errorf("standbys don't read the replication password: %+v", password)
+	}
+}
+
+func TestStandbyInitScript(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		files    []string
+		wantErr  bool
+	}{
+		{name: "primary", hostname: "postgres-db-0", files: []string{"PG_VERSION"}},
+		{name: "cloned standby", hostname: "postgres-db-1", files: []string{"PG_VERSION", "standby.signal", "postgresql.auto.conf"}},
+		// left from before replication, a primary of its own
+		{name: "separate data directory", hostname: "postgres-db-1", files: []string{"PG_VERSION", "postgresql.auto.conf"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pgdata := t.TempDir()
+			for _, file := range tt.files {
+				if err := os.WriteFile(filepath.Join(pgdata, file), []byte("16\n"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cmd := exec.Command("sh", "-c", standbyInitScript)
+			cmd.Env = []string{
+				"HOSTNAME=" + tt.hostname, "PGDATA=" + pgdata, "PGPASSWORD=secret",
+				"PRIMARY_HOST=postgres-db-0.postgres-db", "REPLICATION_USER=" + replicationUser,
+				"PATH=" + os.Getenv("PATH"),
+			}
+			output, err := cmd.CombinedOutput()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("script error = %v, wantErr %v, output:\n%s", err, tt.wantErr, output)
+			}
+			for _, file := range tt.files {
+				if _, err := os.Stat(filepath.Join(pgdata, file)); err != nil {
+					t.Errorf("%s was removed: %v", file, err)
+				}
+			}
+			if tt.wantErr || tt.hostname == "postgres-db-0" {
+				return
+			}
+			conf, _ := os.ReadFile(filepath.Join(pgdata, "postgresql.auto.conf"))
+			if !strings.Contains(string(conf), "user="+replicationUser) {
+				t.Errorf("primary_conninfo wasn't rewritten:\n%s", conf)
+			}
+		})
+	}
+}
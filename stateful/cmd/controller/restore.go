@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crlog "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// restoreLabel marks the Job of a DatabaseRestore
+const restoreLabel = "databases.stackbalancer.com/restore"
+
+// restoreScript checks the dump against its recorded checksum and restores it in a single
+// transaction, replacing the objects it contains
+const restoreScript = `set -eu
+echo "$BACKUP_CHECKSUM  $BACKUP_FILE" | sha256sum -c -
+pg_restore --clean --if-exists --single-transaction --dbname="$PGDATABASE" "$BACKUP_FILE"
+`
+
+// DatabaseRestoreReconciler reconciles DatabaseRestore resources
+type DatabaseRestoreReconciler struct {
+	client.Client
+	Scheme     *runtime.Scheme
+	kubeClient kubernetes.Interface
+}
+
+// Reconcile runs a single pg_restore Job for the restore and records its outcome
+func (r *DatabaseRestoreReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := crlog.FromContext(ctx).WithValues("NamespacedName", req.NamespacedName)
+	log.Info("Reconciling DatabaseRestore", "name", req.Name, "namespace", req.Namespace)
+
+	restore := &dbv1.DatabaseRestore{}
+	if err := r.Get(ctx, req.NamespacedName, restore); err != nil {
+		if k8serrors.IsNotFound(err) {
+			log.Info("DatabaseRestore deleted; nothing more to do")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	// A restore runs once
+	if restore.Status.Phase == dbv1.PhaseCompleted || restore.Status.Phase == dbv1.PhaseFailed {
+		return ctrl.Result{}, nil
+	}
+	oldStatus := restore.Status.DeepCopy()
+
+	jobClient := r.kubeClient.BatchV1().Jobs(req.Namespace)
+	jobName := restore.Name + "-restore"
+	job, err := jobClient.Get(ctx, jobName, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		phase, finishedAt := jobPhase(job)
+		restore.Status.Phase = phase
+		restore.Status.CompletionTime = finishedAt
+		if phase == dbv1.PhaseFailed {
+			restore.Status.Message = jobTerminationMessage(ctx, r.kubeClient, req.Namespace, jobName)
+		}
+	case !k8serrors.IsNotFound(err):
+		return ctrl.Result{}, fmt.Errorf("get restore job: %w", err)
+	case restore.Status.JobName != "":
+		restore.Status.Phase = dbv1.PhaseFailed
+		restore.Status.Message = "restore Job was deleted before it finished"
+	default:
+		message, err := r.startRestore(ctx, restore, jobName)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if message != "" {
+			log.Info("Waiting to restore", "reason", message)
+		}
+	}
+
+	if !equality.Semantic.DeepEqual(oldStatus, &restore.Status) {
+		if err := r.Status().Update(ctx, restore); err != nil {
+			return ctrl.Result{}, fmt.Errorf("update status: %w", err)
+		}
+		log.Info("Updated DatabaseRestore status", "phase", restore.Status.Phase)
+	}
+
+	switch restore.Status.Phase {
+	case dbv1.PhasePending:
+		return ctrl.Result{RequeueAfter: databaseWaitInterval}, nil
+	case dbv1.PhaseRunning:
+		return ctrl.Result{RequeueAfter: jobPollInterval}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// startRestore creates the restore Job once the backup has a completed run and the Database
+// is Ready. Otherwise it leaves the restore Pending and returns what it waits for.
+func (r *DatabaseRestoreReconciler) startRestore(ctx context.Context, restore *dbv1.DatabaseRestore, jobName string) (string, error) {
+	pending := func(message string) (string, error) {
+		restore.Status.Phase = dbv1.PhasePending
+		restore.Status.Message = message
+		return message, nil
+	}
+
+	backup := &dbv1.DatabaseBackup{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: restore.Namespace, Name: restore.Spec.Backup}, backup); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return pending(fmt.Sprintf("DatabaseBackup %s not found", restore.Spec.Backup))
+		}
+		return "", err
+	}
+	record := findRestoreRecord(backup, restore.Spec.BackupJobName)
+	if record == nil {
+		if restore.Spec.BackupJobName != "" {
+			return pending(fmt.Sprintf("DatabaseBackup %s has no completed run %s", backup.Name, restore.Spec.BackupJobName))
+		}
+		return pending(fmt.Sprintf("DatabaseBackup %s has no completed run", backup.Name))
+	}
+
+	db, message, err := getReadyDatabase(ctx, r.Client, restore.Namespace, restore.Spec.Database)
+	if err != nil {
+		return "", err
+	}
+	if message != "" {
+		return pending(message)
+	}
+
+	dbname := restore.Spec.DBName
+	if dbname == "" {
+		dbname = backup.Spec.DBName
+	}
+	if dbname == "" {
+		dbname = postgresUser
+	}
+
+	job := makeRestoreJob(restore, db, jobName, dbname, record, backup.Status.ClaimName)
+	if _, err := r.kubeClient.BatchV1().Jobs(restore.Namespace).Create(ctx, job, metav1.CreateOptions{}); err != nil && !k8serrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("create restore job: %w", err)
+	}
+	crlog.FromContext(ctx).Info("Created restore Job", "job", jobName, "file", record.File)
+
+	now := metav1.Now()
+	restore.Status = dbv1.DatabaseRestoreStatus{
+		Phase:     dbv1.PhaseRunning,
+		JobName:   jobName,
+		File:      record.File,
+		Checksum:  record.Checksum,
+		StartTime: &now,
+	}
+	return "", nil
+}
+
+// findRestoreRecord returns the named completed run of a backup, or its latest one
+func findRestoreRecord(backup *dbv1.DatabaseBackup, jobName string) *dbv1.BackupRecord {
+	for i := range backup.Status.Backups {
+		record := &backup.Status.Backups[i]
+		if record.Phase != dbv1.PhaseCompleted || record.Checksum == "" {
+			continue
+		}
+		if jobName == "" || record.JobName == jobName {
+			return record
+		}
+	}
+	return nil
+}
+
+func makeRestoreJob(restore *dbv1.DatabaseRestore, db *dbv1.Database, jobName, dbname string, record *dbv1.BackupRecord, claimName string) *batchv1.Job {
+	labels := map[string]string{restoreLabel: restore.Name}
+	env := append(databaseJobEnv(db, dbname),
+		corev1.EnvVar{Name: "BACKUP_FILE", Value: path.Join(backupMountPath, record.File)},
+		corev1.EnvVar{Name: "BACKUP_CHECKSUM", Value: record.Checksum},
+	)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            jobName,
+			Labels:          labels,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(restore, dbv1.SchemeGroupVersion.WithKind("DatabaseRestore"))},
+		},
+		Spec: batchv1.JobSpec{
+			// a failed restore is rolled back, retrying it wouldn't help
+			BackoffLimit: int32Ptr(0),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:                     "pg-restore",
+							Image:                    postgresImage(db),
+							ImagePullPolicy:          postgresPullPolicy(db),
+							Command:                  []string{"sh", "-c", restoreScript},
+							Env:                      env,
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "backups", MountPath: backupMountPath, ReadOnly: true},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "backups",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName, ReadOnly: true},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	ctrl "sigs.k8s.io/controller-runtime"
+	crfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestFindRestoreRecord(t *testing.T) {
+	// records are kept newest first
+	backup := &dbv1.DatabaseBackup{Status: dbv1.DatabaseBackupStatus{Backups: []dbv1.BackupRecord{
+		{JobName: "backup-4", Phase: dbv1.PhaseRunning},
+		{JobName: "backup-3", Phase: dbv1.PhaseFailed, Message: "connection refused"},
+		{JobName: "backup-2", Phase: dbv1.PhaseCompleted},
+		{JobName: "backup-1", Phase: dbv1.PhaseCompleted, Checksum: "c1"},
+		{JobName: "backup-0", Phase: dbv1.PhaseCompleted, Checksum: "c0"},
+	}}}
+	tests := []struct {
+		name    string
+		jobName string
+		want    string
+	}{
+		{name: "latest completed run with a checksum", want: "backup-1"},
+		{name: "named run", jobName: "backup-0", want: "backup-0"},
+		{name: "named run still running", jobName: "backup-4"},
+		{name: "named run that failed", jobName: "backup-3"},
+		{name: "named run without a checksum", jobName: "backup-2"},
+		{name: "unknown run", jobName: "backup-9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := findRestoreRecord(backup, tt.jobName)
+			got := ""
+			if record != nil {
+				got = record.JobName
+			}
+			if got != tt.want {
+				t.Errorf("findRestoreRecord(%q) = %q, want %q", tt.jobName, got, tt.want)
+			}
+		})
+	}
+	if record := findRestoreRecord(&dbv1.DatabaseBackup{}, ""); record != nil {
+		t.Errorf("findRestoreRecord() of a backup without runs = %+v, want none", record)
+	}
+}
+
+func TestMakeRestoreJob(t *testing.T) {
+	db := newTestDatabase()
+	db.Status.PasswordSecretRef = &dbv1.SecretKeyRef{Name: "postgres-db-credentials", Key: defaultPasswordKey}
+	restore := &dbv1.DatabaseRestore{ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: "default", UID: "restore-uid"}}
+	record := &dbv1.BackupRecord{JobName: "backup-1", File: "backup-1.dump", Phase: dbv1.PhaseCompleted, Checksum: "c1"}
+
+	job := makeRestoreJob(restore, db, "restore-restore", "app", record, "backup-claim")
+	if job.Spec.BackoffLimit == nil || *job.Spec.BackoffLimit != 0 {
+		t.Errorf("BackoffLimit = %v, want 0", job.Spec.BackoffLimit)
+	}
+	if ref := metav1.GetControllerOf(job); ref == nil || ref.UID != restore.UID {
+		t.Errorf("controller = %+v, want the DatabaseRestore", ref)
+	}
+	pod := job.Spec.Template.Spec
+	if pod.RestartPolicy != corev1.RestartPolicyNever {
+		t.Errorf("RestartPolicy = %s, want Never", pod.RestartPolicy)
+	}
+
+	env := map[string]corev1.EnvVar{}
+	for _, e := range pod.Containers[0].Env {
+		env[e.Name] = e
+	}
+	for name, want := range map[string]string{
+		"PGHOST":          primaryHost("postgres-db"),
+		"PGUSER":          postgresUser,
+		"PGDATABASE":      "app",
+		"BACKUP_FILE":     backupMountPath + "/backup-1.dump",
+		"BACKUP_CHECKSUM": "c1",
+	} {
+		if env[name].Value != want {
+			t.Errorf("env %s = %q, want %q", name, env[name].Value, want)
+		}
+	}
+	if ref := env["PGPASSWORD"].ValueFrom; ref == nil || ref.SecretKeyRef.Name != "postgres-db-credentials" {
+		t.Errorf("PGPASSWORD = %+v, want it from the credentials Secret", env["PGPASSWORD"])
+	}
+
+	mounts := pod.Containers[0].VolumeMounts
+	if len(mounts) != 1 || mounts[0].MountPath != backupMountPath || !mounts[0].ReadOnly {
+		t.Errorf("volume mounts = %+v, want the backups read-only at %s", mounts, backupMountPath)
+	}
+	claim := pod.Volumes[0].PersistentVolumeClaim
+	if claim == nil || claim.ClaimName != "backup-claim" || !claim.ReadOnly {
+		t.Errorf("volume = %+v, want backup-claim read-only", pod.Volumes[0])
+	}
+}
+
+func TestRestoreJobDeleted(t *testing.T) {
+	restore := &dbv1.DatabaseRestore{
+		ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: "default"},
+		Spec:       dbv1.DatabaseRestoreSpec{Database: "postgres-db", Backup: "nightly"},
+		Status:     dbv1.DatabaseRestoreStatus{Phase: dbv1.PhaseRunning, JobName: "restore-restore"},
+	}
+	crClient := crfake.NewClientBuilder().WithScheme(scheme).WithObjects(restore).WithStatusSubresource(restore).Build()
+	r := &DatabaseRestoreReconciler{Client: crClient, Scheme: scheme, kubeClient: fake.NewClientset()}
+
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "default", Name: "restore"}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	got := &dbv1.DatabaseRestore{}
+	if err := crClient.Get(ctx, key, got); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Status.Phase != dbv1.PhaseFailed || got.Status.Message == "" {
+		t.Errorf("status = %+v, want Failed with a message", got.Status)
+	}
+	// a failed restore isn't started again
+	if jobs, _ := r.kubeClient.BatchV1().Jobs("default").List(ctx, metav1.ListOptions{}); len(jobs.Items) != 0 {
+		t.Errorf("%d restore Jobs were created, want none", len(jobs.Items))
+	}
+}
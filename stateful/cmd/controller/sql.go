@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	"github.com/lib/pq"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// sqlAddress returns the host:port the controller runs SQL against: the first pod of the
+// StatefulSet, through the headless Service. DATABASE_ADDRESS overrides it, e.g. with
+// localhost:5432 to run the controller against a local or port-forwarded postgres.
+func sqlAddress(db *dbv1.Database, name string) string {
+	if addr := os.Getenv("DATABASE_ADDRESS"); addr != "" {
+		return addr
+	}
+	return net.JoinHostPort(fmt.Sprintf("%s-0.%s.%s.svc", name, name, db.Namespace), strconv.Itoa(postgresPort))
+}
+
+// openSQL connects to dbname as the postgres superuser
+func openSQL(ctx context.Context, addr, password, dbname string) (*sql.DB, error) {
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(postgresUser, password),
+		Host:     addr,
+		Path:     "/" + dbname,
+		RawQuery: "sslmode=disable&connect_timeout=5",
+	}
+	conn, err := sql.Open("postgres", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.PingContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// reconcileSQL creates and alters the roles and databases of the spec, and returns their
+// status in spec order. Errors are reported per role or database rather than failing the reconcile.
+func (r *DatabaseReconciler) reconcileSQL(ctx context.Context, db *dbv1.Database, name, password string) (roles, databases []dbv1.SQLObjectStatus) {
+	if len(db.Spec.Roles) == 0 && len(db.Spec.Databases) == 0 {
+		return nil, nil
+	}
+
+	addr := sqlAddress(db, name)
+	conn, err := openSQL(ctx, addr, password, postgresUser)
+	if err != nil {
+		err = fmt.Errorf("connect to %s: %w", addr, err)
+	} else {
+		defer conn.Close()
+	}
+
+	for _, role := range db.Spec.Roles {
+		status := dbv1.SQLObjectStatus{Name: role.Name, PasswordVersion: appliedPasswordVersion(db.Status.Roles, role.Name)}
+		roleErr := err
+		// the webhook is optional, so reserved roles are refused here as well
+		if reason := reservedRole(role.Name); reason != "" {
+			roleErr = errors.New(reason)
+		} else if roleErr == nil {
+			status.PasswordVersion, roleErr = r.reconcileRole(ctx, conn, db.Namespace, role, false, status.PasswordVersion)
+		}
+		roles = append(roles, sqlObjectStatus(status, roleErr))
+	}
+
+	for _, spec := range db.Spec.Databases {
+		databaseErr := err
+		if databaseErr == nil {
+			databaseErr = reconcileLogicalDatabase(ctx, conn, addr, password, spec)
+		}
+		databases = append(databases, sqlObjectStatus(dbv1.SQLObjectStatus{Name: spec.Name}, databaseErr))
+	}
+
+	return roles, databases
+}
+
+// reservedRole returns why a role can't be managed through spec.roles, or "" when it can
+func reservedRole(name string) string {
+	switch {
+	case name == postgresUser:
+		return "the postgres superuser is managed through passwordSecretRef"
+	case name == replicationUser:
+		return "the replicator role is managed by the controller for the standbys"
+	case name == appUser:
+		return "the app_user role is managed by the controller for the connection Secret"
+	case strings.HasPrefix(name, "pg_"):
+		return "the pg_ prefix is reserved"
+	}
+	return ""
+}
+
+func sqlObjectStatus(status dbv1.SQLObjectStatus, err error) dbv1.SQLObjectStatus {
+	status.Ready = err == nil
+	if err != nil {
+		status.Message = err.Error()
+	}
+	return status
+}
+
+func appliedPasswordVersion(roles []dbv1.SQLObjectStatus, name string) string {
+	for _, role := range roles {
+		if role.Name == name {
+			return role.PasswordVersion
+		}
+	}
+	return ""
+}
+
+// reconcileRole creates the role or brings its attributes in line with the spec. Only the
+// replication role of the standbys gets the REPLICATION attribute. The password is only set
+// when the Secret's ResourceVersion differs from appliedVersion, since postgres can't report
+// whether it already matches. It returns the version now applied.
+func (r *DatabaseReconciler) reconcileRole(ctx context.Context, conn *sql.DB, namespace string, role dbv1.RoleSpec, replication bool, appliedVersion string) (string, error) {
+	var super, createDB, login, canReplicate bool
+	err := conn.QueryRowContext(ctx,
+		`SELECT rolsuper, rolcreatedb, rolcanlogin, rolreplication FROM pg_catalog.pg_roles WHERE rolname = $1`,
+		role.Name).Scan(&super, &createDB, &login, &canReplicate)
+	exists := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return appliedVersion, fmt.Errorf("get role: %w", err)
+	}
+
+	password, version := "", ""
+	if ref := role.PasswordSecretRef; ref != nil {
+		key := ref.Key
+		if key == "" {
+			key = defaultPasswordKey
+		}
+		secret, err := r.kubeClient.CoreV1().Secrets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return appliedVersion, fmt.Errorf("get password secret %s: %w", ref.Name, err)
+		}
+		if len(secret.Data[key]) == 0 {
+			return appliedVersion, fmt.Errorf("password secret %s has no key %q", ref.Name, key)
+		}
+		password, version = string(secret.Data[key]), secret.ResourceVersion
+	}
+
+	var options []string
+	if !exists || super != role.Superuser || createDB != role.CreateDB || login != role.Login || canReplicate != replication {
+		options = append(options,
+			roleOption(role.Login, "LOGIN", "NOLOGIN"),
+			roleOption(role.Superuser, "SUPERUSER", "NOSUPERUSER"),
+			roleOption(role.CreateDB, "CREATEDB", "NOCREATEDB"),
+			roleOption(replication, "REPLICATION", "NOREPLICATION"))
+	}
+	if !exists || version != appliedVersion {
+		if password == "" {
+			options = append(options, "PASSWORD NULL")
+		} else {
+			options = append(options, "PASSWORD "+pq.QuoteLiteral(password))
+		}
+	}
+	if len(options) == 0 {
+		return appliedVersion, nil
+	}
+
+	verb := "ALTER"
+	if !exists {
+		verb = "CREATE"
+	}
+	stmt := fmt.Sprintf("%s ROLE %s WITH %s", verb, pq.QuoteIdentifier(role.Name), strings.Join(options, " "))
+	if _, err := conn.ExecContext(ctx, stmt); err != nil {
+		return appliedVersion, fmt.Errorf("%s role: %w", strings.ToLower(verb), err)
+	}
+	return version, nil
+}
+
+func roleOption(enabled bool, yes, no string) string {
+	if enabled {
+		return yes
+	}
+	return no
+}
+
+// reconcileLogicalDatabase creates the database or changes its owner, then creates the
+// missing extensions over a connection to that database
+func reconcileLogicalDatabase(ctx context.Context, conn *sql.DB, addr, password string, spec dbv1.LogicalDatabaseSpec) error {
+	owner := spec.Owner
+	if owner == "" {
+		owner = postgresUser
+	}
+
+	var currentOwner string
+	err := conn.QueryRowContext(ctx,
+		`SELECT pg_catalog.pg_get_userbyid(datdba) FROM pg_catalog.pg_database WHERE datname = $1`,
+		spec.Name).Scan(&currentOwner)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		stmt := fmt.Sprintf("CREATE DATABASE %s OWNER %s", pq.QuoteIdentifier(spec.Name), pq.QuoteIdentifier(owner))
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("create database: %w", err)
+		}
+	case err != nil:
+		return fmt.Errorf("get database: %w", err)
+	case currentOwner != owner:
+		stmt := fmt.Sprintf("ALTER DATABASE %s OWNER TO %s", pq.QuoteIdentifier(spec.Name), pq.QuoteIdentifier(owner))
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("alter database owner: %w", err)
+		}
+	}
+
+	if len(spec.Extensions) == 0 {
+		return nil
+	}
+	dbConn, err := openSQL(ctx, addr, password, spec.Name)
+	if err != nil {
+		return fmt.Errorf("connect to database: %w", err)
+	}
+	defer dbConn.Close()
+	for _, extension := range spec.Extensions {
+		if _, err := dbConn.ExecContext(ctx, "CREATE EXTENSION IF NOT EXISTS "+pq.QuoteIdentifier(extension)); err != nil {
+			return fmt.Errorf("create extension %s: %w", extension, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"os"
+	"testing"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	"github.com/lib/pq"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// openTestSQL connects to the database in TEST_DATABASE_URL as postgres
+func openTestSQL(t *testing.T) (*sql.DB, string) {
+	t.Helper()
+	password := testPostgres(t)
+	conn, err := openSQL(context.Background(), os.Getenv("DATABASE_ADDRESS"), password, postgresUser)
+	if err != nil {
+		t.Fatalf("openSQL() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, password
+}
+
+// loginAs checks that role can log in with password
+func loginAs(t *testing.T, role, password string) error {
+	t.Helper()
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(role, password),
+		Host:     os.Getenv("DATABASE_ADDRESS"),
+		Path:     "/postgres",
+		RawQuery: "sslmode=disable&connect_timeout=5",
+	}
+	conn, err := sql.Open("postgres", dsn.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Ping()
+}
+
+func dropRole(t *testing.T, conn *sql.DB, name string) {
+	t.Helper()
+	if _, err := conn.Exec("DROP ROLE IF EXISTS " + pq.QuoteIdentifier(name)); err != nil {
+		t.Fatalf("couldn't drop role %s: %v", name, err)
+	}
+}
+
+func TestReservedRoles(t *testing.T) {
+	// nothing listens there, reserved roles must fail before any SQL
+	t.Setenv("DATABASE_ADDRESS", "127.0.0.1:1")
+	db := newTestDatabase()
+	for _, name := range []string{"postgres", "pg_monitor", "replicator", "app_user"} {
+		db.Spec.Roles = []dbv1.RoleSpec{{Name: name, Login: true}}
+		if errs := validateDatabaseSpec(&db.Spec); len(errs) == 0 {
+			t.Errorf("validateDatabaseSpec() allowed role %s", name)
+		}
+		roles, _ := (&DatabaseReconciler{kubeClient: fake.NewClientset()}).reconcileSQL(context.Background(), db, "postgres-db", "")
+		if len(roles) != 1 || roles[0].Ready || roles[0].Message != reservedRole(name) {
+			t.Errorf("reconcileSQL() roles = %+v, want %s refused as reserved", roles, name)
+		}
+	}
+}
+
+func TestReconcileRole(t *testing.T) {
+	conn, _ := openTestSQL(t)
+	ctx := context.Background()
+	const name = "taskjob_test_app"
+	dropRole(t, conn, name)
+	t.Cleanup(func() { dropRole(t, conn, name) })
+
+	secret := newPasswordSecret("app-password", "first")
+	r := &DatabaseReconciler{kubeClient: fake.NewClientset(secret)}
+	role := dbv1.RoleSpec{Name: name, Login: true, PasswordSecretRef: &dbv1.SecretKeyRef{Name: "app-password"}}
+
+	version, err := r.reconcileRole(ctx, conn, "default", role, false, "")
+	if err != nil {
+		t.Fatalf("reconcileRole() create error = %v", err)
+	}
+	if err := loginAs(t, name, "first"); err != nil {
+		t.Errorf("couldn't log in as the new role: %v", err)
+	}
+
+	// the password is only set again when the Secret's version changes
+	secret.Data[defaultPasswordKey] = []byte("second")
+	if _, err := r.kubeClient.CoreV1().Secrets("default").Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("couldn't update secret: %v", err)
+	}
+	if _, err := r.reconcileRole(ctx, conn, "default", role, false, version+"-stale"); err != nil {
+		t.Fatalf("reconcileRole() password change error = %v", err)
+	}
+	if err := loginAs(t, name, "second"); err != nil {
+		t.Errorf("couldn't log in with the changed password: %v", err)
+	}
+
+	role.CreateDB, role.Login = true, false
+	if _, err := r.reconcileRole(ctx, conn, "default", role, false, version); err != nil {
+		t.Fatalf("reconcileRole() alter error = %v", err)
+	}
+	var createDB, login bool
+	if err := conn.QueryRow(`SELECT rolcreatedb, rolcanlogin FROM pg_catalog.pg_roles WHERE rolname = $1`, name).Scan(&createDB, &login); err != nil {
+		t.Fatalf("couldn't read role: %v", err)
+	}
+	if !createDB || login {
+		t.Errorf("createdb = %v, login = %v, want true and false", createDB, login)
+	}
+}
+
+func TestReconcileLogicalDatabase(t *testing.T) {
+	conn, password := openTestSQL(t)
+	ctx := context.Background()
+	const name, owner = "taskjob_test_db", "taskjob_test_owner"
+	dropDatabase := func() {
+		if _, err := conn.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(name)); err != nil {
+			t.Fatalf("couldn't drop database: %v", err)
+		}
+	}
+	dropDatabase()
+	dropRole(t, conn, owner)
+	t.Cleanup(func() {
+		dropDatabase()
+		dropRole(t, conn, owner)
+	})
+	if _, err := conn.Exec("CREATE ROLE " + pq.QuoteIdentifier(owner)); err != nil {
+		t.Fatalf("couldn't create owner: %v", err)
+	}
+
+	addr := os.Getenv("DATABASE_ADDRESS")
+	spec := dbv1.LogicalDatabaseSpec{Name: name, Extensions: []string{"pgcrypto"}}
+	if err := reconcileLogicalDatabase(ctx, conn, addr, password, spec); err != nil {
+		t.Fatalf("reconcileLogicalDatabase() create error = %v", err)
+	}
+	spec.Owner = owner
+	if err := reconcileLogicalDatabase(ctx, conn, addr, password, spec); err != nil {
+		t.Fatalf("reconcileLogicalDatabase() owner change error = %v", err)
+	}
+
+	var currentOwner string
+	if err := conn.QueryRow(`SELECT pg_catalog.pg_get_userbyid(datdba) FROM pg_catalog.pg_database WHERE datname = $1`, name).Scan(&currentOwner); err != nil {
+		t.Fatalf("couldn't read database: %v", err)
+	}
+	if currentOwner != owner {
+		t.Errorf("owner = %q, want %q", currentOwner, owner)
+	}
+	dbConn, err := openSQL(ctx, addr, password, name)
+	if err != nil {
+		t.Fatalf("couldn't connect to the database: %v", err)
+	}
+	defer dbConn.Close()
+	var extensions int
+	if err := dbConn.QueryRow(`SELECT count(*) FROM pg_catalog.pg_extension WHERE extname = 'pgcrypto'`).Scan(&extensions); err != nil {
+		t.Fatalf("couldn't read extensions: %v", err)
+	}
+	if extensions != 1 {
+		t.Error("extension pgcrypto wasn't created")
+	}
+}
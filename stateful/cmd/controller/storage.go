@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	crlog "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const defaultStorage = "1Gi"
+
+// storageRequest returns the size of the data volumes in spec.storage
+func storageRequest(db *dbv1.Database) (resource.Quantity, error) {
+	storage := db.Spec.Storage
+	if storage == "" {
+		storage = defaultStorage
+	}
+	return resource.ParseQuantity(storage)
+}
+
+func setDatabaseCondition(db *dbv1.Database, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&db.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: db.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// reconcileStorage grows the PVCs of the running data volume to spec.storage, since the
+// volumeClaimTemplates of the StatefulSet can't change after creation, and reports the
+// progress in the StorageResized condition. Volumes are never shrunk.
+func (r *DatabaseReconciler) reconcileStorage(ctx context.Context, db *dbv1.Database, name string, want resource.Quantity) error {
+	log := crlog.FromContext(ctx)
+	pvcClient := r.kubeClient.CoreV1().PersistentVolumeClaims(db.Namespace)
+	pvcs, err := pvcClient.List(ctx, metav1.ListOptions{LabelSelector: "app=" + name})
+	if err != nil {
+		return fmt.Errorf("list pvcs: %w", err)
+	}
+
+	var shrink, failed, pending []string
+	total, resized := 0, 0
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		if !strings.HasPrefix(pvc.Name, dataVolumeName(db)+"-"+name+"-") {
+			continue
+		}
+		total++
+
+		requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+		switch want.Cmp(requested) {
+		case -1:
+			shrink = append(shrink, fmt.Sprintf("%s has %s", pvc.Name, requested.String()))
+			continue
+		case 1:
+			patch := fmt.Sprintf(`{"spec":{"resources":{"requests":{"storage":%q}}}}`, want.String())
+			if _, err := pvcClient.Patch(ctx, pvc.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", pvc.Name, err))
+				continue
+			}
+			log.Info("Requested PVC expansion", "pvc", pvc.Name, "from", requested.String(), "to", want.String())
+		}
+
+		capacity := pvc.Status.Capacity[corev1.ResourceStorage]
+		if capacity.Cmp(want) >= 0 {
+			resized++
+			continue
+		}
+		for _, condition := range pvc.Status.Conditions {
+			if condition.Type == corev1.PersistentVolumeClaimFileSystemResizePending && condition.Status == corev1.ConditionTrue {
+				pending = append(pending, pvc.Name)
+			}
+		}
+	}
+
+	// Nothing to report before the StatefulSet created its volumes
+	if total == 0 {
+		return nil
+	}
+
+	switch {
+	case len(shrink) > 0:
+		setDatabaseCondition(db, dbv1.ConditionStorageResized, metav1.ConditionFalse, "ShrinkNotSupported",
+			fmt.Sprintf("spec.storage %s is smaller than the volumes (%s); volumes can only grow", want.String(), strings.Join(shrink, ", ")))
+	case len(failed) > 0:
+		setDatabaseCondition(db, dbv1.ConditionStorageResized, metav1.ConditionFalse, "ExpansionFailed",
+			fmt.Sprintf("couldn't expand volumes to %s: %s", want.String(), strings.Join(failed, "; ")))
+	case resized < total:
+		message := fmt.Sprintf("%d/%d volumes resized to %s", resized, total, want.String())
+		if len(pending) > 0 {
+			message += fmt.Sprintf(", waiting for the file system resize of %s", strings.Join(pending, ", "))
+		}
+		setDatabaseCondition(db, dbv1.ConditionStorageResized, metav1.ConditionFalse, "Resizing", message)
+	default:
+		setDatabaseCondition(db, dbv1.ConditionStorageResized, metav1.ConditionTrue, "Resized",
+			fmt.Sprintf("%d/%d volumes have %s", resized, total, want.String()))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newDataClaim returns a PVC labelled like those of the postgres-db StatefulSet
+func newDataClaim(name, requested, capacity string, resizePending bool) *corev1.PersistentVolumeClaim {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "postgres-db"}},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.VolumeResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(requested)}},
+		},
+		Status: corev1.PersistentVolumeClaimStatus{Capacity: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(capacity)}},
+	}
+	if resizePending {
+		pvc.Status.Conditions = []corev1.PersistentVolumeClaimCondition{
+			{Type: corev1.PersistentVolumeClaimFileSystemResizePending, Status: corev1.ConditionTrue},
+		}
+	}
+	return pvc
+}
+
+func TestReconcileStorage(t *testing.T) {
+	tests := []struct {
+		name       string
+		want       string
+		objects    []runtime.Object
+		failPatch  bool
+		wantReason string
+		wantPatch  bool
+	}{
+		{name: "no pvcs yet", want: "2Gi"},
+		{
+			name:    "other volumes are ignored",
+			want:    "2Gi",
+			objects: []runtime.Object{newDataClaim("postgres-db-upgrade", "1Gi", "1Gi", false)},
+		},
+		{
+			name:       "resized",
+			want:       "1Gi",
+			objects:    []runtime.Object{newDataClaim("data-postgres-db-0", "1Gi", "1Gi", false), newDataClaim("data-postgres-db-1", "1Gi", "1Gi", false)},
+			wantReason: "Resized",
+		},
+		{
+			name:       "grow",
+			want:       "2Gi",
+			objects:    []runtime.Object{newDataClaim("data-postgres-db-0", "1Gi", "1Gi", false)},
+			wantReason: "Resizing",
+			wantPatch:  true,
+		},
+		{
+			name:       "file system resize pending",
+			want:       "2Gi",
+			objects:    []runtime.Object{newDataClaim("data-postgres-db-0", "2Gi", "1Gi", true)},
+			wantReason: "Resizing",
+		},
+		{
+			name:       "shrink",
+			want:       "1Gi",
+			objects:    []runtime.Object{newDataClaim("data-postgres-db-0", "2Gi", "2Gi", false)},
+			wantReason: "ShrinkNotSupported",
+		},
+		{
+			name:       "patch fails",
+			want:       "2Gi",
+			objects:    []runtime.Object{newDataClaim("data-postgres-db-0", "1Gi", "1Gi", false)},
+			failPatch:  true,
+			wantReason: "ExpansionFailed",
+			wantPatch:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := fake.NewClientset(tt.objects...)
+			patched := false
+			client.PrependReactor("patch", "persistentvolumeclaims", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				patched = true
+				if tt.failPatch {
+					return true, nil, errors.New("storage class doesn't allow volume expansion")
+				}
+				return false, nil, nil
+			})
+			db := newTestDatabase()
+			db.Spec.Storage = tt.want
+			r := &DatabaseReconciler{kubeClient: client}
+
+			if err := r.reconcileStorage(ctx, db, "postgres-db", resource.MustParse(tt.want)); err != nil {
+				t.Fatalf("reconcileStorage() error = %v", err)
+			}
+			if patched != tt.wantPatch {
+				t.Errorf("patched = %v, want %v", patched, tt.wantPatch)
+			}
+			condition := meta.FindStatusCondition(db.Status.Conditions, dbv1.ConditionStorageResized)
+			if tt.wantReason == "" {
+				if condition != nil {
+					t.Errorf("condition = %+v, want none", condition)
+				}
+				return
+			}
+			if condition == nil || condition.Reason != tt.wantReason {
+				t.Fatalf("condition = %+v, want reason %s", condition, tt.wantReason)
+			}
+			if tt.name == "file system resize pending" && !strings.Contains(condition.Message, "data-postgres-db-0") {
+				t.Errorf("message = %q, want the PVC waiting for its file system resize", condition.Message)
+			}
+			if tt.wantPatch && !tt.failPatch {
+				pvc, _ := client.CoreV1().PersistentVolumeClaims("default").Get(ctx, "data-postgres-db-0", metav1.GetOptions{})
+				if got := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; got.Cmp(resource.MustParse(tt.want)) != 0 {
+					t.Errorf("requested storage = %s, want %s", got.String(), tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	crlog "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	defaultDataVolume = "data"
+	dumpMountPath     = "/dumps"
+	// startNewTimeout bounds how long the new version may take to start on its empty volume
+	// before the upgrade is rolled back
+	startNewTimeout = 10 * time.Minute
+)
+
+// dumpAllScript dumps every database and role of the cluster to BACKUP_FILE and reports the
+// size and checksum through the termination message, like backupScript
+const dumpAllScript = `set -eu
+mkdir -p "$(dirname "$BACKUP_FILE")"
+pg_dumpall --file="$BACKUP_FILE.partial"
+mv "$BACKUP_FILE.partial" "$BACKUP_FILE"
+size=$(stat -c %s "$BACKUP_FILE")
+checksum=$(sha256sum "$BACKUP_FILE" | cut -d ' ' -f 1)
+printf '{"size":%s,"checksum":"%s"}' "$size" "$checksum" > /dev/termination-log
+`
+
+// restoreAllScript loads a pg_dumpall into the new cluster. The dump recreates the postgres
+// role, which initdb already created, so that error is the only one tolerated.
+const restoreAllScript = `set -eu
+echo "$BACKUP_CHECKSUM  $BACKUP_FILE" | sha256sum -c -
+psql --no-psqlrc --quiet --dbname=postgres --file="$BACKUP_FILE" > /dev/null 2> /tmp/errors.log || {
+  cat /tmp/errors.log
+  exit 1
+}
+if grep ERROR /tmp/errors.log | grep -v 'role "postgres" already exists'; then
+  exit 1
+fi
+`
+
+// majorVersionPattern reads the major version at the start of an image tag, e.g. 16 in
+// postgres:16.2-alpine
+var majorVersionPattern = regexp.MustCompile(`^(\d+)`)
+
+// majorVersion returns the postgres major version an image tag starts with
+func majorVersion(image string) (int, bool) {
+	image, _, _ = strings.Cut(image, "@")
+	slash := strings.LastIndex(image, "/")
+	colon := strings.LastIndex(image, ":")
+	if colon <= slash {
+		return 0, false
+	}
+	match := majorVersionPattern.FindString(image[colon+1:])
+	if match == "" {
+		return 0, false
+	}
+	major, err := strconv.Atoi(match)
+	return major, err == nil
+}
+
+// desiredImage is the image in the spec, which the StatefulSet runs once an upgrade to it completes
+func desiredImage(db *dbv1.Database) string {
+	if db.Spec.Image == "" {
+		return "postgres:15-alpine"
+	}
+	return db.Spec.Image
+}
+
+// postgresImage is the image the StatefulSet runs
+func postgresImage(db *dbv1.Database) string {
+	if db.Status.Image == "" {
+		return desiredImage(db)
+	}
+	return db.Status.Image
+}
+
+// dataVolumeName is the volume claim template holding the data of the running version
+func dataVolumeName(db *dbv1.Database) string {
+	if db.Status.DataVolume == "" {
+		return defaultDataVolume
+	}
+	return db.Status.DataVolume
+}
+
+func upgradeRunning(db *dbv1.Database) bool {
+	return db.Status.Upgrade != nil && db.Status.Upgrade.Phase == dbv1.PhaseRunning
+}
+
+func currentUpgradeStep(up *dbv1.UpgradeStatus) string {
+	if len(up.Steps) == 0 {
+		return ""
+	}
+	return up.Steps[len(up.Steps)-1].Name
+}
+
+// upgradeReplicas overrides spec.replicas while a major upgrade swaps the volumes: the
+// StatefulSet is stopped before its volumes change, and runs only the primary until the dump
+// is restored into it
+func upgradeReplicas(db *dbv1.Database) (int32, bool) {
+	if !upgradeRunning(db) {
+		return 0, false
+	}
+	up := db.Status.Upgrade
+	switch currentUpgradeStep(up) {
+	case dbv1.StepStopOld:
+		return 0, true
+	case dbv1.StepStartNew, dbv1.StepRestore:
+		return 1, true
+	case dbv1.StepRollback:
+		if db.Status.Image == up.ToImage {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// upgradePartition holds the primary at its revision while the standbys are updated
+func upgradePartition(db *dbv1.Database) int32 {
+	if upgradeRunning(db) && currentUpgradeStep(db.Status.Upgrade) == dbv1.StepUpdateStandbys {
+		return 1
+	}
+	return 0
+}
+
+// startUpgradeStep completes the current step and starts the next one
+func startUpgradeStep(up *dbv1.UpgradeStatus, name, message string) {
+	now := metav1.Now()
+	if n := len(up.Steps); n > 0 && up.Steps[n-1].Phase == dbv1.PhaseRunning {
+		up.Steps[n-1].Phase = dbv1.PhaseCompleted
+		up.Steps[n-1].CompletionTime = &now
+	}
+	up.Steps = append(up.Steps, dbv1.UpgradeStep{Name: name, Phase: dbv1.PhaseRunning, StartTime: &now, Message: message})
+}
+
+// finishUpgrade ends the current step with the phase of the upgrade
+func finishUpgrade(up *dbv1.UpgradeStatus, phase, message string) {
+	now := metav1.Now()
+	if n := len(up.Steps); n > 0 && up.Steps[n-1].Phase == dbv1.PhaseRunning {
+		up.Steps[n-1].Phase = dbv1.PhaseCompleted
+		if phase == dbv1.PhaseFailed {
+			up.Steps[n-1].Phase = dbv1.PhaseFailed
+			up.Steps[n-1].Message = message
+		}
+		up.Steps[n-1].CompletionTime = &now
+	}
+	up.Phase = phase
+	up.Message = message
+}
+
+// rollbackUpgrade fails the current step of a major upgrade and starts restoring the old version
+func rollbackUpgrade(up *dbv1.UpgradeStatus, message string) {
+	now := metav1.Now()
+	n := len(up.Steps)
+	up.Steps[n-1].Phase = dbv1.PhaseFailed
+	up.Steps[n-1].Message = message
+	up.Steps[n-1].CompletionTime = &now
+	up.Message = message
+	startUpgradeStep(up, dbv1.StepRollback, "restarting "+up.FromImage+" on the old volumes")
+}
+
+// reconcileUpgrade starts an upgrade when spec.image changes and moves a running one forward
+// by at most one step. It records the image and volume the StatefulSet must run in the status,
+// and returns true when it deleted the StatefulSet so it is recreated on new volumes.
+func (r *DatabaseReconciler) reconcileUpgrade(ctx context.Context, db *dbv1.Database, name, password string, sts *appsv1.StatefulSet, storage resource.Quantity) (bool, error) {
+	log := crlog.FromContext(ctx)
+	oldStatus := db.Status.DeepCopy()
+
+	// Databases created before upgrades were tracked run the image of their StatefulSet
+	if db.Status.Image == "" {
+		db.Status.Image = desiredImage(db)
+		if sts != nil {
+			for _, container := range sts.Spec.Template.Spec.Containers {
+				if container.Name == "postgres" {
+					db.Status.Image = container.Image
+				}
+			}
+		}
+	}
+	if db.Status.DataVolume == "" {
+		db.Status.DataVolume = defaultDataVolume
+	}
+
+	// An upgrade that failed isn't retried until spec.image changes again
+	to := desiredImage(db)
+	up := db.Status.Upgrade
+	if sts != nil && to != db.Status.Image && !upgradeRunning(db) && (up == nil || up.ToImage != to) {
+		up = startUpgrade(db, to)
+		log.Info("Starting upgrade", "type", up.Type, "from", up.FromImage, "to", up.ToImage, "phase", up.Phase)
+	}
+
+	deleted := false
+	if upgradeRunning(db) && sts != nil {
+		var err error
+		deleted, err = r.progressUpgrade(ctx, db, name, password, sts, storage)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if !equality.Semantic.DeepEqual(oldStatus, &db.Status) {
+		if err := r.Status().Update(ctx, db); err != nil {
+			return false, fmt.Errorf("update status: %w", err)
+		}
+		if up := db.Status.Upgrade; up != nil {
+			log.Info("Updated upgrade status", "phase", up.Phase, "step", currentUpgradeStep(up))
+		}
+	}
+	return deleted, nil
+}
+
+// startUpgrade records an upgrade from the running image to the spec one. Minor upgrades start
+// rolling right away, major ones start by blocking writes to take a backup.
+func startUpgrade(db *dbv1.Database, to string) *dbv1.UpgradeStatus {
+	now := metav1.Now()
+	up := &dbv1.UpgradeStatus{FromImage: db.Status.Image, ToImage: to, Phase: dbv1.PhaseRunning, StartTime: &now}
+	db.Status.Upgrade = up
+
+	fromMajor, fromOK := majorVersion(up.FromImage)
+	toMajor, toOK := majorVersion(to)
+	switch {
+	case !fromOK || !toOK:
+		up.Phase = dbv1.PhaseFailed
+		up.Message = fmt.Sprintf("can't tell the postgres major version of %s and %s from their tags", up.FromImage, to)
+	case toMajor < fromMajor:
+		up.Phase = dbv1.PhaseFailed
+		up.Message = fmt.Sprintf("downgrading postgres %d to %d is not supported", fromMajor, toMajor)
+	case toMajor == fromMajor:
+		up.Type = dbv1.UpgradeMinor
+		db.Status.Image = to
+		if db.Spec.Replicas > 1 {
+			startUpgradeStep(up, dbv1.StepUpdateStandbys, "")
+		} else {
+			startUpgradeStep(up, dbv1.StepUpdatePrimary, "")
+		}
+	default:
+		up.Type = dbv1.UpgradeMajor
+		up.FromDataVolume = dataVolumeName(db)
+		up.ToDataVolume = fmt.Sprintf("%s-pg%d", defaultDataVolume, toMajor)
+		startUpgradeStep(up, dbv1.StepBlockWrites, "")
+	}
+	return up
+}
+
+// progressUpgrade checks whether the current step is done and starts the next one
+func (r *DatabaseReconciler) progressUpgrade(ctx context.Context, db *dbv1.Database, name, password string, sts *appsv1.StatefulSet, storage resource.Quantity) (bool, error) {
+	up := db.Status.Upgrade
+	replicas := int32(db.Spec.Replicas)
+	// the StatefulSet status describes its current spec and the image of the step
+	rolled := sts.Status.ObservedGeneration >= sts.Generation && runsImage(sts, db.Status.Image)
+
+	switch currentUpgradeStep(up) {
+	case dbv1.StepUpdateStandbys:
+		if rolled && sts.Status.UpdatedReplicas >= replicas-1 && sts.Status.ReadyReplicas >= replicas {
+			startUpgradeStep(up, dbv1.StepUpdatePrimary, "")
+		}
+
+	case dbv1.StepUpdatePrimary:
+		if rolled && sts.Status.UpdatedReplicas >= replicas && sts.Status.ReadyReplicas >= replicas &&
+			sts.Status.CurrentRevision == sts.Status.UpdateRevision {
+			finishUpgrade(up, dbv1.PhaseCompleted, "")
+		}
+
+	case dbv1.StepBlockWrites:
+		if err := r.setWritesBlocked(ctx, db, name, password, true); err != nil {
+			return false, fmt.Errorf("block writes: %w", err)
+		}
+		startUpgradeStep(up, dbv1.StepBackup, up.FromImage+" is read-only until the upgrade ends")
+
+	case dbv1.StepBackup:
+		phase, message, err := r.upgradeJob(ctx, db, name, "dump", up.FromImage, dumpAllScript, storage)
+		if err != nil {
+			return false, err
+		}
+		failure := ""
+		switch phase {
+		case dbv1.PhaseFailed:
+			failure = "pre-upgrade backup failed: " + message
+		case dbv1.PhaseCompleted:
+			var result backupResult
+			if err := json.Unmarshal([]byte(message), &result); err != nil || result.Checksum == "" {
+				failure = fmt.Sprintf("couldn't read backup result: %q", message)
+				break
+			}
+			up.BackupFile = upgradeBackupFile(up)
+			up.BackupChecksum = result.Checksum
+			startUpgradeStep(up, dbv1.StepStopOld, "stopping "+up.FromImage)
+		}
+		if failure != "" {
+			// only writes were blocked yet, so that is all there is to roll back
+			if err := r.setWritesBlocked(ctx, db, name, password, false); err != nil {
+				return false, fmt.Errorf("unblock writes: %w", err)
+			}
+			finishUpgrade(up, dbv1.PhaseFailed, failure)
+		}
+
+	case dbv1.StepStopOld:
+		if sts.Status.ObservedGeneration >= sts.Generation && sts.Spec.Replicas != nil && *sts.Spec.Replicas == 0 && sts.Status.Replicas == 0 {
+			startUpgradeStep(up, dbv1.StepStartNew, fmt.Sprintf("starting %s on the %s volumes", up.ToImage, up.ToDataVolume))
+			db.Status.Image = up.ToImage
+			db.Status.DataVolume = up.ToDataVolume
+			return r.deleteStatefulSet(ctx, sts)
+		}
+
+	case dbv1.StepStartNew:
+		if rolled && sts.Status.ReadyReplicas >= 1 {
+			startUpgradeStep(up, dbv1.StepRestore, "")
+			break
+		}
+		step := up.Steps[len(up.Steps)-1]
+		if step.StartTime != nil && time.Since(step.StartTime.Time) > startNewTimeout {
+			rollbackUpgrade(up, fmt.Sprintf("%s didn't become ready within %s", up.ToImage, startNewTimeout))
+		}
+
+	case dbv1.StepRestore:
+		phase, message, err := r.upgradeJob(ctx, db, name, "restore", up.ToImage, restoreAllScript, storage)
+		if err != nil {
+			return false, err
+		}
+		switch phase {
+		case dbv1.PhaseFailed:
+			rollbackUpgrade(up, "restore failed: "+message)
+		case dbv1.PhaseCompleted:
+			startUpgradeStep(up, dbv1.StepScaleUp, "")
+		}
+
+	case dbv1.StepScaleUp:
+		if rolled && sts.Status.ReadyReplicas >= replicas {
+			finishUpgrade(up, dbv1.PhaseCompleted, fmt.Sprintf(
+				"the %s volumes of %s are kept; delete them once the upgrade is verified", up.FromDataVolume, up.FromImage))
+		}
+
+	case dbv1.StepRollback:
+		if db.Status.Image == up.ToImage {
+			// stop the new version before going back to the old volumes
+			if sts.Status.ObservedGeneration >= sts.Generation && sts.Spec.Replicas != nil && *sts.Spec.Replicas == 0 && sts.Status.Replicas == 0 {
+				db.Status.Image = up.FromImage
+				db.Status.DataVolume = up.FromDataVolume
+				return r.deleteStatefulSet(ctx, sts)
+			}
+			break
+		}
+		if rolled && sts.Status.ReadyReplicas >= replicas {
+			// the old volumes still hold the write block of the backup
+			if err := r.setWritesBlocked(ctx, db, name, password, false); err != nil {
+				return false, fmt.Errorf("unblock writes: %w", err)
+			}
+			message := up.Message
+			finishUpgrade(up, dbv1.PhaseRolledBack, fmt.Sprintf("%s; %s is running again, change spec.image to retry", message, up.FromImage))
+		}
+	}
+	return false, nil
+}
+
+// setWritesBlocked makes transactions on the primary read-only by default and ends the sessions
+// of its clients, which would keep their read-write default and open transactions, or lifts
+// the block again. The setting is kept in postgresql.auto.conf, so it holds across restarts of
+// the old version but isn't part of the pg_dumpall restored into the new one.
+func (r *DatabaseReconciler) setWritesBlocked(ctx context.Context, db *dbv1.Database, name, password string, blocked bool) error {
+	addr := sqlAddress(db, name)
+	conn, err := openSQL(ctx, addr, password, postgresUser)
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", addr, err)
+	}
+	defer conn.Close()
+
+	statement := "ALTER SYSTEM RESET default_transaction_read_only"
+	if blocked {
+		statement = "ALTER SYSTEM SET default_transaction_read_only = on"
+	}
+	if _, err := conn.ExecContext(ctx, statement); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_reload_conf()"); err != nil {
+		return err
+	}
+	if !blocked {
+		crlog.FromContext(ctx).Info("Unblocked writes", "address", addr)
+		return nil
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+		WHERE backend_type = 'client backend' AND pid <> pg_backend_pid()`); err != nil {
+		return err
+	}
+	crlog.FromContext(ctx).Info("Blocked writes", "address", addr)
+	return nil
+}
+
+// runsImage tells whether the postgres container of the StatefulSet runs image
+func runsImage(sts *appsv1.StatefulSet, image string) bool {
+	for _, container := range sts.Spec.Template.Spec.Containers {
+		if container.Name == "postgres" {
+			return container.Image == image
+		}
+	}
+	return false
+}
+
+// deleteStatefulSet deletes the stopped StatefulSet, since its volume claim templates can't
+// change. Its volumes are kept.
+func (r *DatabaseReconciler) deleteStatefulSet(ctx context.Context, sts *appsv1.StatefulSet) (bool, error) {
+	err := r.kubeClient.AppsV1().StatefulSets(sts.Namespace).Delete(ctx, sts.Name, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return false, fmt.Errorf("delete statefulset: %w", err)
+	}
+	crlog.FromContext(ctx).Info("Deleted StatefulSet to change its volumes", "name", sts.Name)
+	return true, nil
+}
+
+func upgradeClaimName(name string) string {
+	return name + "-upgrade"
+}
+
+// upgradeJobName is unique per upgrade, so retries don't find the Jobs of an earlier attempt
+func upgradeJobName(name string, up *dbv1.UpgradeStatus, action string) string {
+	return fmt.Sprintf("%s-upgrade-%d-%s", name, up.StartTime.Unix(), action)
+}
+
+func upgradeBackupFile(up *dbv1.UpgradeStatus) string {
+	return fmt.Sprintf("%d-pg_dumpall.sql", up.StartTime.Unix())
+}
+
+// upgradeJob runs the dump or restore Job of a major upgrade and returns its phase, with the
+// termination message once it finished
+func (r *DatabaseReconciler) upgradeJob(ctx context.Context, db *dbv1.Database, name, action, image, script string, storage resource.Quantity) (string, string, error) {
+	up := db.Status.Upgrade
+	jobName := upgradeJobName(name, up, action)
+	jobClient := r.kubeClient.BatchV1().Jobs(db.Namespace)
+	job, err := jobClient.Get(ctx, jobName, metav1.GetOptions{})
+	if err == nil {
+		phase, _ := jobPhase(job)
+		if phase == dbv1.PhaseRunning {
+			return phase, "", nil
+		}
+		return phase, jobTerminationMessage(ctx, r.kubeClient, db.Namespace, jobName), nil
+	}
+	if !k8serrors.IsNotFound(err) {
+		return "", "", fmt.Errorf("get upgrade job: %w", err)
+	}
+
+	if err := r.ensureUpgradeClaim(ctx, db, name, storage); err != nil {
+		return "", "", fmt.Errorf("ensure upgrade pvc: %w", err)
+	}
+	job = makePostgresJob(db, name, jobName, image, script, upgradeClaimName(name), upgradeBackupFile(up), up.BackupChecksum)
+	if _, err := jobClient.Create(ctx, job, metav1.CreateOptions{}); err != nil && !k8serrors.IsAlreadyExists(err) {
+		return "", "", fmt.Errorf("create upgrade job: %w", err)
+	}
+	crlog.FromContext(ctx).Info("Created upgrade Job", "job", jobName, "image", image)
+	return dbv1.PhaseRunning, "", nil
+}
+
+// ensureUpgradeClaim creates the <name>-upgrade PVC holding the pre-upgrade dumps, as large as
+// the data volumes. It is owned by the Database and kept across upgrades.
+func (r *DatabaseReconciler) ensureUpgradeClaim(ctx context.Context, db *dbv1.Database, name string, storage resource.Quantity) error {
+	pvcClient := r.kubeClient.CoreV1().PersistentVolumeClaims(db.Namespace)
+	_, err := pvcClient.Get(ctx, upgradeClaimName(name), metav1.GetOptions{})
+	if !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            upgradeClaimName(name),
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(db, dbv1.SchemeGroupVersion.WithKind("Database"))},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: storage},
+			},
+		},
+	}
+	if _, err := pvcClient.Create(ctx, pvc, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+	crlog.FromContext(ctx).Info("Created upgrade PVC", "pvc", pvc.Name)
+	return nil
+}
+
+// makePostgresJob runs a script against the primary with the claim holding file mounted
+func makePostgresJob(db *dbv1.Database, name, jobName, image, script, claimName, file, checksum string) *batchv1.Job {
+	env := append(databaseJobEnv(db, postgresUser),
+		corev1.EnvVar{Name: "BACKUP_FILE", Value: path.Join(dumpMountPath, file)},
+		corev1.EnvVar{Name: "BACKUP_CHECKSUM", Value: checksum},
+	)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            jobName,
+			Labels:          map[string]string{"app": name},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(db, dbv1.SchemeGroupVersion.WithKind("Database"))},
+		},
+		Spec: batchv1.JobSpec{
+			// failures are reported instead, retrying a half-loaded restore wouldn't help
+			BackoffLimit: int32Ptr(0),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:                     "dump",
+							Image:                    image,
+							ImagePullPolicy:          postgresPullPolicy(db),
+							Command:                  []string{"sh", "-c", script},
+							Env:                      env,
+							TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "dump", MountPath: dumpMountPath},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "dump",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
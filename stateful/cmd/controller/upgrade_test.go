@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// readOnlyError tells whether err is postgres refusing a write in a read-only transaction
+func readOnlyError(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "25006"
+}
+
+func TestSetWritesBlocked(t *testing.T) {
+	password := testPostgres(t)
+	ctx := context.Background()
+	db := newTestDatabase()
+	r := &DatabaseReconciler{kubeClient: fake.NewClientset()}
+
+	// a client session opened before the block must not keep writing
+	client, _ := openTestSQL(t)
+	client.SetMaxOpenConns(1)
+	if _, err := client.Exec("SELECT 1"); err != nil {
+		t.Fatalf("client query error = %v", err)
+	}
+
+	if err := r.setWritesBlocked(ctx, db, "postgres-db", password, true); err != nil {
+		t.Fatalf("setWritesBlocked(true) error = %v", err)
+	}
+	t.Cleanup(func() { r.setWritesBlocked(ctx, db, "postgres-db", password, false) })
+
+	// the old session was ended, the pool reconnects with the read-only default
+	write := func() error {
+		_, err := client.Exec("CREATE TABLE taskjob_test_upgrade (id int)")
+		if err == nil {
+			client.Exec("DROP TABLE taskjob_test_upgrade")
+		}
+		return err
+	}
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = write(); readOnlyError(err) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !readOnlyError(err) {
+		t.Errorf("write error = %v, want a read-only transaction error", err)
+	}
+
+	if err := r.setWritesBlocked(ctx, db, "postgres-db", password, false); err != nil {
+		t.Fatalf("setWritesBlocked(false) error = %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = write(); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("write failed after writes were unblocked: %v", err)
+	}
+}
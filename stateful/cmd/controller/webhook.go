@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	dbv1 "k8s-job-operator/stateful/api/v1"
+
+	"github.com/robfig/cron/v3"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	passwordDeprecationWarning = "spec.password is deprecated and stored in plain text; use spec.passwordSecretRef"
+	maxSQLNameLength           = 63
+)
+
+// DatabaseValidator rejects invalid Databases and warns about deprecated fields on admission
+type DatabaseValidator struct{}
+
+// ValidateCreate validates a new Database
+func (v *DatabaseValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	db, ok := obj.(*dbv1.Database)
+	if !ok {
+		return nil, fmt.Errorf("expected a Database but got %T", obj)
+	}
+	return databaseWarnings(&db.Spec), toInvalidError(db, validateDatabaseSpec(&db.Spec))
+}
+
+// ValidateUpdate validates a changed Database; storage can grow but not shrink, since
+// volumes can't be made smaller, and images can only move to the same or a later major version
+func (v *DatabaseValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	oldDB, ok := oldObj.(*dbv1.Database)
+	if !ok {
+		return nil, fmt.Errorf("expected a Database but got %T", oldObj)
+	}
+	db, ok := newObj.(*dbv1.Database)
+	if !ok {
+		return nil, fmt.Errorf("expected a Database but got %T", newObj)
+	}
+
+	errs := validateDatabaseSpec(&db.Spec)
+	oldStorage, oldErr := storageRequest(oldDB)
+	storage, err := storageRequest(db)
+	if oldErr == nil && err == nil && storage.Cmp(oldStorage) < 0 {
+		errs = append(errs, field.Forbidden(field.NewPath("spec", "storage"),
+			fmt.Sprintf("can't shrink from %s to %s, volumes can only grow", oldStorage.String(), storage.String())))
+	}
+	if desiredImage(db) != desiredImage(oldDB) {
+		errs = append(errs, validateImageChange(oldDB, desiredImage(db))...)
+	}
+	return databaseWarnings(&db.Spec), toInvalidError(db, errs)
+}
+
+// validateImageChange checks that the controller can upgrade the running image to image
+func validateImageChange(oldDB *dbv1.Database, image string) field.ErrorList {
+	var errs field.ErrorList
+	imagePath := field.NewPath("spec", "image")
+
+	if upgradeRunning(oldDB) {
+		return append(errs, field.Forbidden(imagePath,
+			fmt.Sprintf("can't change while the upgrade to %s is running", oldDB.Status.Upgrade.ToImage)))
+	}
+	major, ok := majorVersion(image)
+	if !ok {
+		return append(errs, field.Invalid(imagePath, image, "the tag must start with the postgres version, e.g. postgres:16-alpine"))
+	}
+	if running, ok := majorVersion(postgresImage(oldDB)); ok && major < running {
+		errs = append(errs, field.Forbidden(imagePath,
+			fmt.Sprintf("can't downgrade from postgres %d to %d, the data directory isn't compatible", running, major)))
+	}
+	return errs
+}
+
+// ValidateDelete allows every deletion
+func (v *DatabaseValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func databaseWarnings(spec *dbv1.DatabaseSpec) admission.Warnings {
+	if spec.Password != "" {
+		return admission.Warnings{passwordDeprecationWarning}
+	}
+	return nil
+}
+
+func validateDatabaseSpec(spec *dbv1.DatabaseSpec) field.ErrorList {
+	var errs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	switch spec.DeletionPolicy {
+	case "", dbv1.DeletionPolicyDelete, dbv1.DeletionPolicyRetain, dbv1.DeletionPolicySnapshot:
+	default:
+		errs = append(errs, field.NotSupported(specPath.Child("deletionPolicy"), spec.DeletionPolicy,
+			[]string{dbv1.DeletionPolicyDelete, dbv1.DeletionPolicyRetain, dbv1.DeletionPolicySnapshot}))
+	}
+
+	if spec.Storage != "" {
+		if _, err := resource.ParseQuantity(spec.Storage); err != nil {
+			errs = append(errs, field.Invalid(specPath.Child("storage"), spec.Storage, err.Error()))
+		}
+	}
+
+	if spec.PasswordSecretRef != nil && spec.Password != "" {
+		errs = append(errs, field.Forbidden(specPath.Child("password"), "may not be set together with passwordSecretRef"))
+	}
+	errs = append(errs, validateSecretKeyRef(spec.PasswordSecretRef, specPath.Child("passwordSecretRef"))...)
+
+	for i, cidr := range spec.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, field.Invalid(specPath.Child("allowedCIDRs").Index(i), cidr, "must be a CIDR, e.g. 10.244.0.0/16"))
+		}
+	}
+
+	roles := map[string]bool{}
+	for i, role := range spec.Roles {
+		rolePath := specPath.Child("roles").Index(i)
+		errs = append(errs, validateSQLName(role.Name, rolePath.Child("name"))...)
+		switch reason := reservedRole(role.Name); {
+		case reason != "":
+			errs = append(errs, field.Forbidden(rolePath.Child("name"), reason))
+		case roles[role.Name]:
+			errs = append(errs, field.Duplicate(rolePath.Child("name"), role.Name))
+		}
+		roles[role.Name] = true
+		errs = append(errs, validateSecretKeyRef(role.PasswordSecretRef, rolePath.Child("passwordSecretRef"))...)
+	}
+
+	databases := map[string]bool{}
+	for i, database := range spec.Databases {
+		databasePath := specPath.Child("databases").Index(i)
+		errs = append(errs, validateSQLName(database.Name, databasePath.Child("name"))...)
+		switch {
+		case database.Name == "template0" || database.Name == "template1":
+			errs = append(errs, field.Forbidden(databasePath.Child("name"), "template databases can't be managed"))
+		case databases[database.Name]:
+			errs = append(errs, field.Duplicate(databasePath.Child("name"), database.Name))
+		}
+		databases[database.Name] = true
+		if database.Owner != "" {
+			errs = append(errs, validateSQLName(database.Owner, databasePath.Child("owner"))...)
+		}
+		for j, extension := range database.Extensions {
+			errs = append(errs, validateSQLName(extension, databasePath.Child("extensions").Index(j))...)
+		}
+	}
+
+	return errs
+}
+
+func validateSecretKeyRef(ref *dbv1.SecretKeyRef, path *field.Path) field.ErrorList {
+	if ref == nil {
+		return nil
+	}
+	var errs field.ErrorList
+	if ref.Name == "" {
+		errs = append(errs, field.Required(path.Child("name"), "name must be set"))
+	} else {
+		for _, msg := range validation.IsDNS1123Subdomain(ref.Name) {
+			errs = append(errs, field.Invalid(path.Child("name"), ref.Name, msg))
+		}
+	}
+	if ref.Key != "" {
+		for _, msg := range validation.IsConfigMapKey(ref.Key) {
+			errs = append(errs, field.Invalid(path.Child("key"), ref.Key, msg))
+		}
+	}
+	return errs
+}
+
+// validateSQLName checks a postgres identifier, which is truncated past 63 bytes
+func validateSQLName(name string, path *field.Path) field.ErrorList {
+	if name == "" {
+		return field.ErrorList{field.Required(path, "must be set")}
+	}
+	if len(name) > maxSQLNameLength {
+		return field.ErrorList{field.TooLong(path, name, maxSQLNameLength)}
+	}
+	return nil
+}
+
+func toInvalidError(db *dbv1.Database, errs field.ErrorList) error {
+	return toKindInvalidError("Database", db.Name, errs)
+}
+
+func toKindInvalidError(kind, name string, errs field.ErrorList) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return k8serrors.NewInvalid(schema.GroupKind{Group: dbv1.GroupName, Kind: kind}, name, errs)
+}
+
+// DatabaseBackupValidator rejects invalid DatabaseBackups on admission
+type DatabaseBackupValidator struct{}
+
+// ValidateCreate validates a new DatabaseBackup
+func (v *DatabaseBackupValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	backup, ok := obj.(*dbv1.DatabaseBackup)
+	if !ok {
+		return nil, fmt.Errorf("expected a DatabaseBackup but got %T", obj)
+	}
+	return nil, toKindInvalidError("DatabaseBackup", backup.Name, validateBackupSpec(&backup.Spec))
+}
+
+// ValidateUpdate validates a changed DatabaseBackup; the storage can't change since earlier
+// dumps would be lost to later restores
+func (v *DatabaseBackupValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	oldBackup, ok := oldObj.(*dbv1.DatabaseBackup)
+	if !ok {
+		return nil, fmt.Errorf("expected a DatabaseBackup but got %T", oldObj)
+	}
+	backup, ok := newObj.(*dbv1.DatabaseBackup)
+	if !ok {
+		return nil, fmt.Errorf("expected a DatabaseBackup but got %T", newObj)
+	}
+
+	errs := validateBackupSpec(&backup.Spec)
+	if oldBackup.Spec.Storage != backup.Spec.Storage {
+		errs = append(errs, field.Forbidden(field.NewPath("spec", "storage"), "field is immutable"))
+	}
+	return nil, toKindInvalidError("DatabaseBackup", backup.Name, errs)
+}
+
+// ValidateDelete allows every deletion
+func (v *DatabaseBackupValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func validateBackupSpec(spec *dbv1.DatabaseBackupSpec) field.ErrorList {
+	var errs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if spec.Database == "" {
+		errs = append(errs, field.Required(specPath.Child("database"), "database must be set"))
+	}
+	if spec.DBName != "" {
+		errs = append(errs, validateSQLName(spec.DBName, specPath.Child("dbname"))...)
+	}
+	if spec.Schedule != "" {
+		if _, err := cron.ParseStandard(spec.Schedule); err != nil {
+			errs = append(errs, field.Invalid(specPath.Child("schedule"), spec.Schedule, err.Error()))
+		}
+	}
+	if spec.Retention != nil && *spec.Retention < 1 {
+		errs = append(errs, field.Invalid(specPath.Child("retention"), *spec.Retention, "must be greater than or equal to 1"))
+	}
+	if spec.Storage.Size != "" {
+		if _, err := resource.ParseQuantity(spec.Storage.Size); err != nil {
+			errs = append(errs, field.Invalid(specPath.Child("storage", "size"), spec.Storage.Size, err.Error()))
+		}
+	}
+	return errs
+}
+
+// DatabaseRestoreValidator rejects invalid DatabaseRestores on admission
+type DatabaseRestoreValidator struct{}
+
+// ValidateCreate validates a new DatabaseRestore
+func (v *DatabaseRestoreValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	restore, ok := obj.(*dbv1.DatabaseRestore)
+	if !ok {
+		return nil, fmt.Errorf("expected a DatabaseRestore but got %T", obj)
+	}
+	return nil, toKindInvalidError("DatabaseRestore", restore.Name, validateRestoreSpec(&restore.Spec))
+}
+
+// ValidateUpdate rejects every change to the spec, since a restore runs once
+func (v *DatabaseRestoreValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	oldRestore, ok := oldObj.(*dbv1.DatabaseRestore)
+	if !ok {
+		return nil, fmt.Errorf("expected a DatabaseRestore but got %T", oldObj)
+	}
+	restore, ok := newObj.(*dbv1.DatabaseRestore)
+	if !ok {
+		return nil, fmt.Errorf("expected a DatabaseRestore but got %T", newObj)
+	}
+
+	var errs field.ErrorList
+	if oldRestore.Spec != restore.Spec {
+		errs = append(errs, field.Forbidden(field.NewPath("spec"), "field is immutable"))
+	}
+	return nil, toKindInvalidError("DatabaseRestore", restore.Name, errs)
+}
+
+// ValidateDelete allows every deletion
+func (v *DatabaseRestoreValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func validateRestoreSpec(spec *dbv1.DatabaseRestoreSpec) field.ErrorList {
+	var errs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if spec.Database == "" {
+		errs = append(errs, field.Required(specPath.Child("database"), "database must be set"))
+	}
+	if spec.Backup == "" {
+		errs = append(errs, field.Required(specPath.Child("backup"), "backup must be set"))
+	}
+	if spec.DBName != "" {
+		errs = append(errs, validateSQLName(spec.DBName, specPath.Child("dbname"))...)
+	}
+	return errs
+}
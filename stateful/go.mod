@@ -5,6 +5,8 @@ go 1.24.0
 toolchain go1.24.6
 
 require (
+	github.com/lib/pq v1.10.9
+	github.com/robfig/cron/v3 v3.0.1
 	go.uber.org/zap v1.27.0
 	k8s.io/api v0.34.0
 	k8s.io/apimachinery v0.34.0
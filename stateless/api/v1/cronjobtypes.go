@@ -0,0 +1,54 @@
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Concurrency policies of a CronTaskJob
+const (
+	// AllowConcurrent allows runs to overlap
+	AllowConcurrent = "Allow"
+	// ForbidConcurrent skips a run while the previous one is still active
+	ForbidConcurrent = "Forbid"
+	// ReplaceConcurrent deletes the active runs before starting a new one
+	ReplaceConcurrent = "Replace"
+)
+
+// CronTaskJobSpec defines the desired state of CronTaskJob
+type CronTaskJobSpec struct {
+	// Schedule in standard cron format, e.g. "0 2 * * *"
+	Schedule string `json:"schedule"`
+	// JobTemplate is the spec of the TaskJob created on every run
+	JobTemplate TaskJobSpec `json:"jobTemplate"`
+	// ConcurrencyPolicy is one of Allow (default), Forbid or Replace
+	ConcurrencyPolicy string `json:"concurrencyPolicy,omitempty"`
+	// Number of completed runs to keep (default 3)
+	SuccessfulJobsHistoryLimit *int32 `json:"successfulJobsHistoryLimit,omitempty"`
+	// Number of failed runs to keep (default 1)
+	FailedJobsHistoryLimit *int32 `json:"failedJobsHistoryLimit,omitempty"`
+}
+
+// CronTaskJobStatus defines the observed state of CronTaskJob
+type CronTaskJobStatus struct {
+	// TaskJobs that are currently running
+	Active []corev1.ObjectReference `json:"active,omitempty"`
+	// Last time a TaskJob was scheduled
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+}
+
+// CronTaskJob is the Schema for the CronTaskJob Custom Resource
+type CronTaskJob struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CronTaskJobSpec   `json:"spec,omitempty"`
+	Status CronTaskJobStatus `json:"status,omitempty"`
+}
+
+// CronTaskJobList contains a list of CronTaskJob
+type CronTaskJobList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CronTaskJob `json:"items"`
+}
@@ -1,19 +1,18 @@
 package v1
 
-import "k8s.io/apimachinery/pkg/runtime"
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
 
 // DeepCopyInto copies all properties of this object into another object of the
 // same type that is provided as a pointer.
 func (in *TaskJob) DeepCopyInto(out *TaskJob) {
 	out.TypeMeta = in.TypeMeta
-	out.ObjectMeta = in.ObjectMeta
-	out.Spec = TaskJobSpec{
-		JobName:   in.Spec.JobName,
-		JobParams: in.Spec.JobParams,
-		Image:     in.Spec.Image,
-		ImagePullPolicy: in.Spec.ImagePullPolicy,
-		Replicas:  in.Spec.Replicas,
-	}
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopyObject returns a generically typed copy of an object
@@ -24,6 +23,71 @@ func (in *TaskJob) DeepCopyObject() runtime.Object {
 	return &out
 }
 
+// DeepCopyInto copies the spec, including optional pointer fields
+func (in *TaskJobSpec) DeepCopyInto(out *TaskJobSpec) {
+	*out = *in
+	if in.JobParams != nil {
+		out.JobParams = make(map[string]string, len(in.JobParams))
+		for k, v := range in.JobParams {
+			out.JobParams[k] = v
+		}
+	}
+	if in.ParamsDelivery != nil {
+		out.ParamsDelivery = new(ParamsDelivery)
+		*out.ParamsDelivery = *in.ParamsDelivery
+	}
+	if in.PodTemplate != nil {
+		out.PodTemplate = in.PodTemplate.DeepCopy()
+	}
+	if in.Probes != nil {
+		out.Probes = &Probes{Disabled: in.Probes.Disabled}
+		if in.Probes.Readiness != nil {
+			out.Probes.Readiness = in.Probes.Readiness.DeepCopy()
+		}
+		if in.Probes.Liveness != nil {
+			out.Probes.Liveness = in.Probes.Liveness.DeepCopy()
+		}
+	}
+	if in.DatabaseRef != nil {
+		out.DatabaseRef = new(DatabaseRef)
+		*out.DatabaseRef = *in.DatabaseRef
+	}
+	if in.Metrics != nil {
+		out.Metrics = new(Metrics)
+		*out.Metrics = *in.Metrics
+	}
+	out.Completions = copyInt32Ptr(in.Completions)
+	out.Parallelism = copyInt32Ptr(in.Parallelism)
+	out.BackoffLimit = copyInt32Ptr(in.BackoffLimit)
+}
+
+// DeepCopyInto copies the status
+func (in *TaskJobStatus) DeepCopyInto(out *TaskJobStatus) {
+	*out = *in
+	if in.CompletionTime != nil {
+		out.CompletionTime = in.CompletionTime.DeepCopy()
+	}
+	if in.LastTransitionTime != nil {
+		out.LastTransitionTime = in.LastTransitionTime.DeepCopy()
+	}
+	if in.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(in.Conditions))
+		for i := range in.Conditions {
+			in.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+}
+
+// DeepCopy returns a copy of the status
+func (in *TaskJobStatus) DeepCopy() *TaskJobStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(TaskJobStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyObject returns a generically typed copy of an object
 func (in *TaskJobList) DeepCopyObject() runtime.Object {
 	out := TaskJobList{}
@@ -39,3 +103,74 @@ func (in *TaskJobList) DeepCopyObject() runtime.Object {
 
 	return &out
 }
+
+// DeepCopyInto copies all properties of this object into another object of the
+// same type that is provided as a pointer.
+func (in *CronTaskJob) DeepCopyInto(out *CronTaskJob) {
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopyObject returns a generically typed copy of an object
+func (in *CronTaskJob) DeepCopyObject() runtime.Object {
+	out := CronTaskJob{}
+	in.DeepCopyInto(&out)
+
+	return &out
+}
+
+// DeepCopyInto copies the spec, including the TaskJob template
+func (in *CronTaskJobSpec) DeepCopyInto(out *CronTaskJobSpec) {
+	*out = *in
+	in.JobTemplate.DeepCopyInto(&out.JobTemplate)
+	out.SuccessfulJobsHistoryLimit = copyInt32Ptr(in.SuccessfulJobsHistoryLimit)
+	out.FailedJobsHistoryLimit = copyInt32Ptr(in.FailedJobsHistoryLimit)
+}
+
+// DeepCopyInto copies the status
+func (in *CronTaskJobStatus) DeepCopyInto(out *CronTaskJobStatus) {
+	*out = *in
+	if in.Active != nil {
+		out.Active = make([]corev1.ObjectReference, len(in.Active))
+		copy(out.Active, in.Active)
+	}
+	if in.LastScheduleTime != nil {
+		out.LastScheduleTime = in.LastScheduleTime.DeepCopy()
+	}
+}
+
+// DeepCopy returns a copy of the status
+func (in *CronTaskJobStatus) DeepCopy() *CronTaskJobStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CronTaskJobStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject returns a generically typed copy of an object
+func (in *CronTaskJobList) DeepCopyObject() runtime.Object {
+	out := CronTaskJobList{}
+	out.TypeMeta = in.TypeMeta
+	out.ListMeta = in.ListMeta
+
+	if in.Items != nil {
+		out.Items = make([]CronTaskJob, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+
+	return &out
+}
+
+func copyInt32Ptr(in *int32) *int32 {
+	if in == nil {
+		return nil
+	}
+	out := *in
+	return &out
+}
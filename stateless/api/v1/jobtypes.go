@@ -1,9 +1,71 @@
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// Workload modes supported by a TaskJob
+const (
+	// ModeService runs the job as a long-running Deployment with a Service
+	ModeService = "Service"
+	// ModeBatch runs the job to completion as a batch/v1 Job
+	ModeBatch = "Batch"
+)
+
+// Ways of passing jobParams to the workload
+const (
+	// ParamsDeliveryEnv sets one env var per key, e.g. PARAM_PARAM1=1234
+	ParamsDeliveryEnv = "Env"
+	// ParamsDeliveryJSON sets a single JOB_PARAMS env var holding a JSON object
+	ParamsDeliveryJSON = "JSON"
+	// ParamsDeliveryConfigMap mounts a generated ConfigMap with one file per key
+	ParamsDeliveryConfigMap = "ConfigMap"
+)
+
+// ParamsDelivery defines how jobParams reach the workload
+type ParamsDelivery struct {
+	// Type is one of Env, JSON or ConfigMap
+	Type string `json:"type"`
+	// Env only: prefix of the env var names (default PARAM_)
+	EnvPrefix string `json:"envPrefix,omitempty"`
+	// ConfigMap only: directory the params are mounted in (default /etc/task-job/params)
+	MountPath string `json:"mountPath,omitempty"`
+}
+
+// Probes configures the health checks of the main container
+type Probes struct {
+	// Disabled drops the default probes, for images that don't serve /readyz and /healthz
+	Disabled bool `json:"disabled,omitempty"`
+	// Readiness replaces the default GET /readyz probe
+	Readiness *corev1.Probe `json:"readiness,omitempty"`
+	// Liveness replaces the default GET /healthz probe
+	Liveness *corev1.Probe `json:"liveness,omitempty"`
+}
+
+// Metrics makes the Prometheus metrics of the workload discoverable
+type Metrics struct {
+	// Port serving the metrics (default 8080, the service port)
+	Port int32 `json:"port,omitempty"`
+	// Path of the metrics endpoint (default /metrics)
+	Path string `json:"path,omitempty"`
+}
+
+// DatabaseRef points at a Database custom resource managed by the database controller, in
+// the namespace of the TaskJob
+type DatabaseRef struct {
+	// Name of the Database
+	Name string `json:"name"`
+	// Namespace of the Database; only the TaskJob namespace is allowed
+	Namespace string `json:"namespace,omitempty"`
+	// Role from the Database's spec.roles to connect as, using its passwordSecretRef
+	// (default: the user of the Database's connection Secret)
+	Role string `json:"role,omitempty"`
+	// Database from the Database's spec.databases to connect to (default: the dbname of the
+	// connection Secret)
+	Database string `json:"database,omitempty"`
+}
+
 // TaskJobSpec defines the desired state of TaskJob
 type TaskJobSpec struct {
 	JobName         string            `json:"jobName"`
@@ -11,12 +73,57 @@ type TaskJobSpec struct {
 	Image           string            `json:"image"`
 	ImagePullPolicy string            `json:"imagePullPolicy,omitempty"`
 	Replicas        int               `json:"replicas"`
+	// How jobParams are passed to the workload; unset keeps the legacy JOB_PARAMS format
+	ParamsDelivery *ParamsDelivery `json:"paramsDelivery,omitempty"`
+	// Optional partial pod template, strategic-merged over the controller defaults.
+	// A container without a name (or named like jobName) customizes the main container.
+	PodTemplate *corev1.PodTemplateSpec `json:"podTemplate,omitempty"`
+	// Service mode only: readiness and liveness probes of the main container
+	Probes *Probes `json:"probes,omitempty"`
+	// Service mode only: adds scrape annotations and a port named metrics to the pods and Service
+	Metrics *Metrics `json:"metrics,omitempty"`
+	// Database the workload connects to; pods start once it is Ready and get PG* env vars
+	DatabaseRef *DatabaseRef `json:"databaseRef,omitempty"`
+	// Mode is either Service (default) or Batch
+	Mode string `json:"mode,omitempty"`
+	// Batch mode only: number of successful pods required to complete the job
+	Completions *int32 `json:"completions,omitempty"`
+	// Batch mode only: maximum number of pods running at the same time
+	Parallelism *int32 `json:"parallelism,omitempty"`
+	// Batch mode only: number of retries before the job is marked as failed
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
 }
 
+// Condition types reported in TaskJobStatus
+const (
+	// ConditionAvailable means the workload is serving (Service) or has completed (Batch)
+	ConditionAvailable = "Available"
+	// ConditionProgressing means a rollout or a run is in progress
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded means pods are failing or the rollout is stuck
+	ConditionDegraded = "Degraded"
+	// ConditionDatabaseNotReady means the pods wait for the Database in spec.databaseRef
+	ConditionDatabaseNotReady = "DatabaseNotReady"
+	// ConditionInvalidParams means jobParams can't be delivered, e.g. keys that aren't valid
+	// ConfigMap keys
+	ConditionInvalidParams = "InvalidParams"
+	// ConditionConflict means an object of the name the TaskJob uses exists and isn't
+	// controlled by it, so the TaskJob leaves it alone
+	ConditionConflict = "Conflict"
+)
+
 // TaskJobStatus defines the observed state of TaskJob
 type TaskJobStatus struct {
-	State           string      `json:"state"` // State of the job (Pending, Running, Completed, Failed)                    // Current state of the TaskJob
+	State          string       `json:"state"`                    // State of the job (Pending, Running, Completed, Failed)
 	CompletionTime *metav1.Time `json:"completionTime,omitempty"` // Optional completion timestamp
+	// Generation of the spec the status was computed for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Number of pods that are ready
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+	// Last time the State changed
+	LastTransitionTime *metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Available, Progressing, Degraded and DatabaseNotReady conditions
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // TaskJob is the Schema for the TaskJob Custom Resource
@@ -21,10 +21,12 @@ var (
 
 // addKnownTypes registers the custom resource types in the Scheme
 func addKnownTypes(scheme *runtime.Scheme) error {
-	// Register the resource and its list type TaskJob and TaskJobList
+	// Register the resources and their list types TaskJob, CronTaskJob and their lists
 	scheme.AddKnownTypes(SchemeGroupVersion,
 		&TaskJob{},
 		&TaskJobList{},
+		&CronTaskJob{},
+		&CronTaskJobList{},
 	)
 
 	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
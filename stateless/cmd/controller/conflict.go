@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// conflictPollInterval is how often a TaskJob checks whether a conflicting object is gone.
+// Objects the TaskJob doesn't control aren't watched.
+const conflictPollInterval = 30 * time.Second
+
+// findConflict returns why the TaskJob can't create or apply its children, or "" when it
+// can. A child of the same name that exists without this TaskJob as its controller, e.g. a
+// Deployment created by hand or by another TaskJob, would otherwise be adopted by the owner
+// reference and overwritten by the apply.
+func (r *TaskJobReconciler) findConflict(ctx context.Context, taskJob *taskjobv1.TaskJob) (string, error) {
+	type child struct {
+		kind string
+		obj  client.Object
+		name string
+	}
+	name := getJobName(taskJob)
+	var children []child
+	if getParamsDeliveryType(taskJob) == taskjobv1.ParamsDeliveryConfigMap {
+		children = append(children, child{"ConfigMap", &corev1.ConfigMap{}, getParamsConfigMapName(taskJob)})
+	}
+	if taskJob.Spec.Mode == taskjobv1.ModeBatch {
+		children = append(children, child{"Job", &batchv1.Job{}, name})
+	} else {
+		children = append(children, child{"Deployment", &appsv1.Deployment{}, name}, child{"Service", &corev1.Service{}, name})
+	}
+
+	for _, c := range children {
+		if err := r.Get(ctx, types.NamespacedName{Namespace: taskJob.Namespace, Name: c.name}, c.obj); err != nil {
+			if client.IgnoreNotFound(err) != nil {
+				return "", fmt.Errorf("couldn't get %s: %s", c.kind, err)
+			}
+			continue
+		}
+		if !metav1.IsControlledBy(c.obj, taskJob) {
+			return fmt.Sprintf("%s %s exists and isn't controlled by this TaskJob", c.kind, c.name), nil
+		}
+	}
+	return "", nil
+}
+
+// setConflictCondition sets the Conflict condition with message, or removes it when
+// message is empty
+func (r *TaskJobReconciler) setConflictCondition(ctx context.Context, taskJob *taskjobv1.TaskJob, message string) error {
+	oldStatus := taskJob.Status.DeepCopy()
+	if message == "" {
+		meta.RemoveStatusCondition(&taskJob.Status.Conditions, taskjobv1.ConditionConflict)
+	} else {
+		if taskJob.Status.State == "" {
+			setState(taskJob, "Pending")
+		}
+		setCondition(taskJob, taskjobv1.ConditionConflict, metav1.ConditionTrue, "NotControlled", message)
+	}
+	if equality.Semantic.DeepEqual(oldStatus, &taskJob.Status) {
+		return nil
+	}
+	if err := r.Status().Update(ctx, taskJob); err != nil {
+		return fmt.Errorf("couldn't update status: %s", err)
+	}
+	return nil
+}
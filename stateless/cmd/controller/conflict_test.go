@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+func TestFindConflict(t *testing.T) {
+	self := newTaskJob("task-job")
+	self.UID = "task-job-uid"
+	other := newTaskJob("other")
+	other.UID = "other-uid"
+	controlledBy := func(obj client.Object, controller *taskjobv1.TaskJob) client.Object {
+		if err := controllerutil.SetControllerReference(controller, obj, scheme); err != nil {
+			t.Fatalf("SetControllerReference() error = %v", err)
+		}
+		return obj
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		existing client.Object
+		want     bool
+	}{
+		{name: "nothing there", mode: taskjobv1.ModeBatch},
+		{name: "own job", mode: taskjobv1.ModeBatch, existing: controlledBy(&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "task-job", Namespace: "default"}}, self)},
+		{name: "job without a controller", mode: taskjobv1.ModeBatch, existing: &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "task-job", Namespace: "default"}}, want: true},
+		{name: "deployment of another taskjob", mode: taskjobv1.ModeService, existing: controlledBy(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "task-job", Namespace: "default"}}, other), want: true},
+		// only the children of the current mode are checked
+		{name: "deployment in batch mode", mode: taskjobv1.ModeBatch, existing: &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "task-job", Namespace: "default"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskJob := newTaskJob("task-job")
+			taskJob.UID = self.UID
+			taskJob.Spec.Mode = tt.mode
+			builder := fake.NewClientBuilder().WithScheme(scheme)
+			if tt.existing != nil {
+				builder = builder.WithObjects(tt.existing)
+			}
+			r := &TaskJobReconciler{Client: builder.Build(), scheme: scheme}
+
+			conflict, err := r.findConflict(context.Background(), taskJob)
+			if err != nil {
+				t.Fatalf("findConflict() error = %v", err)
+			}
+			if (conflict != "") != tt.want {
+				t.Errorf("findConflict() = %q, want a conflict: %v", conflict, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileLeavesConflictingJob(t *testing.T) {
+	taskJob := newTaskJob("task-job")
+	taskJob.Spec.Mode = taskjobv1.ModeBatch
+	taskJob.Finalizers = []string{taskJobFinalizer}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "task-job", Namespace: "default", Labels: map[string]string{"owner": "someone-else"}},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(taskJob, job).WithStatusSubresource(taskJob).Build()
+	r := &TaskJobReconciler{Client: c, scheme: scheme}
+
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "default", Name: "task-job"}
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if result.RequeueAfter != conflictPollInterval {
+		t.Errorf("RequeueAfter = %v, want %v", result.RequeueAfter, conflictPollInterval)
+	}
+
+	got := &taskjobv1.TaskJob{}
+	if err := c.Get(ctx, key, got); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !meta.IsStatusConditionTrue(got.Status.Conditions, taskjobv1.ConditionConflict) {
+		t.Errorf("conditions = %+v, want Conflict", got.Status.Conditions)
+	}
+	if err := c.Get(ctx, key, job); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if len(job.OwnerReferences) != 0 || job.Labels["owner"] != "someone-else" {
+		t.Errorf("job = %+v, want it left as it was", job.ObjectMeta)
+	}
+}
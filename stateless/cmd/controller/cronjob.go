@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// cronTaskJobLabel marks TaskJobs created by a CronTaskJob
+	cronTaskJobLabel = "kubernetes.tjob.com/cron-task-job"
+	// scheduledTimeAnnotation records the time a run was scheduled for
+	scheduledTimeAnnotation = "kubernetes.tjob.com/scheduled-at"
+
+	defaultSuccessfulJobsHistoryLimit = 3
+	defaultFailedJobsHistoryLimit     = 1
+
+	// maxMissedRuns bounds how many missed runs are walked one by one, like the CronJob
+	// controller's limit of 100 missed start times
+	maxMissedRuns = 100
+	// maxRunNameLength leaves room for the "-<unix timestamp>" suffix within the 63 characters
+	// of a label value, since run names also name and label the run's workload
+	maxRunNameLength = 52
+	// maxLabelValueLength is the longest label value the API server accepts
+	maxLabelValueLength = 63
+)
+
+// CronTaskJobReconciler reconciles CronTaskJob resources
+type CronTaskJobReconciler struct {
+	client.Client
+	scheme *runtime.Scheme
+}
+
+// Reconcile creates TaskJobs on schedule and keeps track of their runs
+func (r *CronTaskJobReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx).WithValues("NamespacedName", req.NamespacedName)
+	log.Info("Reconciling CronTaskJob", "Namespace", req.Namespace, "Name", req.Name)
+
+	cronTaskJob := &taskjobv1.CronTaskJob{}
+	if err := r.Get(ctx, req.NamespacedName, cronTaskJob); err != nil {
+		if k8serrors.IsNotFound(err) {
+			// Child TaskJobs are removed by the garbage collector through their owner reference
+			log.Info("CronTaskJob resource not found. Ignoring since object must be deleted")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	// List all TaskJobs created by this CronTaskJob
+	var children taskjobv1.TaskJobList
+	if err := r.List(ctx, &children, client.InNamespace(req.Namespace), client.MatchingLabels{cronTaskJobLabel: getRunLabelValue(req.Name)}); err != nil {
+		return ctrl.Result{}, fmt.Errorf("couldn't list child taskjobs: %s", err)
+	}
+
+	var active, successful, failed []*taskjobv1.TaskJob
+	var mostRecent *time.Time
+	for i := range children.Items {
+		child := &children.Items[i]
+		switch child.Status.State {
+		case "Completed":
+			successful = append(successful, child)
+		case "Failed":
+			failed = append(failed, child)
+		default:
+			active = append(active, child)
+		}
+
+		if scheduled, err := getScheduledTime(child); err == nil && scheduled != nil {
+			if mostRecent == nil || scheduled.After(*mostRecent) {
+				mostRecent = scheduled
+			}
+		}
+	}
+
+	// Report the active runs and the last schedule time, which never moves backwards
+	// even when old runs have been removed by the history limits
+	oldStatus := cronTaskJob.Status.DeepCopy()
+	lastSchedule := cronTaskJob.Status.LastScheduleTime
+	if mostRecent != nil && (lastSchedule == nil || mostRecent.After(lastSchedule.Time)) {
+		cronTaskJob.Status.LastScheduleTime = &metav1.Time{Time: *mostRecent}
+	}
+	cronTaskJob.Status.Active = nil
+	for _, child := range active {
+		cronTaskJob.Status.Active = append(cronTaskJob.Status.Active, corev1.ObjectReference{
+			APIVersion: taskjobv1.SchemeGroupVersion.String(),
+			Kind:       "TaskJob",
+			Namespace:  child.Namespace,
+			Name:       child.Name,
+			UID:        child.UID,
+		})
+	}
+	if !equality.Semantic.DeepEqual(oldStatus, &cronTaskJob.Status) {
+		if err := r.Status().Update(ctx, cronTaskJob); err != nil {
+			return ctrl.Result{}, fmt.Errorf("couldn't update crontaskjob status: %s", err)
+		}
+	}
+
+	// Remove runs beyond the history limits
+	r.cleanupHistory(ctx, successful, historyLimit(cronTaskJob.Spec.SuccessfulJobsHistoryLimit, defaultSuccessfulJobsHistoryLimit))
+	r.cleanupHistory(ctx, failed, historyLimit(cronTaskJob.Spec.FailedJobsHistoryLimit, defaultFailedJobsHistoryLimit))
+
+	schedule, err := cron.ParseStandard(cronTaskJob.Spec.Schedule)
+	if err != nil {
+		// Requeueing won't fix an invalid schedule, wait for the spec to change
+		log.Error(err, "Invalid schedule", "schedule", cronTaskJob.Spec.Schedule)
+		return ctrl.Result{}, nil
+	}
+	// Service-mode runs never complete, so they would block Forbid schedules forever
+	if cronTaskJob.Spec.JobTemplate.Mode == taskjobv1.ModeService {
+		log.Error(nil, "Service-mode jobTemplate can't be scheduled, use mode Batch")
+		return ctrl.Result{}, nil
+	}
+
+	now := time.Now()
+	missedRun, nextRun, missed := getNextSchedule(cronTaskJob, schedule, now)
+	if missed > maxMissedRuns {
+		log.Info("Too many missed runs, only the latest one is started", "missed", fmt.Sprintf("more than %d", maxMissedRuns))
+	}
+	result := ctrl.Result{RequeueAfter: nextRun.Sub(now)}
+
+	if missedRun.IsZero() {
+		log.Info("No run due yet", "next", nextRun)
+		return result, nil
+	}
+
+	// Apply the concurrency policy
+	switch cronTaskJob.Spec.ConcurrencyPolicy {
+	case taskjobv1.ForbidConcurrent:
+		if len(active) > 0 {
+			log.Info("Skipping run since previous one is still active", "active", len(active))
+			return result, nil
+		}
+	case taskjobv1.ReplaceConcurrent:
+		for _, child := range active {
+			if err := r.Delete(ctx, child, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+				return ctrl.Result{}, fmt.Errorf("couldn't delete active taskjob: %s", err)
+			}
+			log.Info("Deleted active TaskJob to replace it", "TaskJob", child.Name)
+		}
+	}
+
+	taskJob, err := r.getTaskJobObject(cronTaskJob, missedRun)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.Create(ctx, taskJob); err != nil {
+		if k8serrors.IsAlreadyExists(err) {
+			// Run was already created by a previous reconcile
+			return result, nil
+		}
+		return ctrl.Result{}, fmt.Errorf("couldn't create taskjob: %s", err)
+	}
+
+	log.Info("Created TaskJob for CronTaskJob run", "TaskJob", taskJob.Name, "scheduledAt", missedRun)
+
+	cronTaskJob.Status.LastScheduleTime = &metav1.Time{Time: missedRun}
+	if err := r.Status().Update(ctx, cronTaskJob); err != nil {
+		return ctrl.Result{}, fmt.Errorf("couldn't update crontaskjob status: %s", err)
+	}
+	return result, nil
+}
+
+// getTaskJobObject builds the TaskJob for a run scheduled at the given time
+func (r *CronTaskJobReconciler) getTaskJobObject(cronTaskJob *taskjobv1.CronTaskJob, scheduledTime time.Time) (*taskjobv1.TaskJob, error) {
+	// Timestamped name keeps runs unique and makes creation idempotent
+	name := fmt.Sprintf("%s-%d", getRunNamePrefix(cronTaskJob), scheduledTime.Unix())
+
+	taskJob := &taskjobv1.TaskJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cronTaskJob.Namespace,
+			Labels:      map[string]string{cronTaskJobLabel: getRunLabelValue(cronTaskJob.Name)},
+			Annotations: map[string]string{scheduledTimeAnnotation: scheduledTime.Format(time.RFC3339)},
+		},
+	}
+	cronTaskJob.Spec.JobTemplate.DeepCopyInto(&taskJob.Spec)
+	// Each run gets its own workload, which has to run to completion
+	taskJob.Spec.JobName = name
+	taskJob.Spec.Mode = taskjobv1.ModeBatch
+
+	if err := controllerutil.SetControllerReference(cronTaskJob, taskJob, r.scheme); err != nil {
+		return nil, fmt.Errorf("couldn't set owner reference: %s", err)
+	}
+	return taskJob, nil
+}
+
+// cleanupHistory deletes the oldest runs so that at most limit remain
+func (r *CronTaskJobReconciler) cleanupHistory(ctx context.Context, taskJobs []*taskjobv1.TaskJob, limit int) {
+	log := log.FromContext(ctx)
+
+	if len(taskJobs) <= limit {
+		return
+	}
+	sort.Slice(taskJobs, func(i, j int) bool {
+		return taskJobs[i].CreationTimestamp.Before(&taskJobs[j].CreationTimestamp)
+	})
+	for _, taskJob := range taskJobs[:len(taskJobs)-limit] {
+		if err := r.Delete(ctx, taskJob, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+			log.Error(err, "Failed to delete old TaskJob", "TaskJob", taskJob.Name)
+			continue
+		}
+		log.Info("Deleted old TaskJob", "TaskJob", taskJob.Name)
+	}
+}
+
+// getRunNamePrefix returns the CronTaskJob name, shortened with a hash of the full name
+// when the run names would get too long
+func getRunNamePrefix(cronTaskJob *taskjobv1.CronTaskJob) string {
+	return shortenName(cronTaskJob.Name, maxRunNameLength)
+}
+
+// getRunLabelValue returns the cronTaskJobLabel value of the runs of the named CronTaskJob,
+// which can be longer than a label value
+func getRunLabelValue(name string) string {
+	return shortenName(name, maxLabelValueLength)
+}
+
+// shortenName cuts name to maxLength, ending it with a hash of the full name so names with
+// the same start stay distinct
+func shortenName(name string, maxLength int) string {
+	if len(name) <= maxLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:8]
+	return name[:maxLength-len(hash)-1] + "-" + hash
+}
+
+// getNextSchedule returns the latest run that is due but not yet started (zero if none),
+// the time of the next run and how many runs were missed
+func getNextSchedule(cronTaskJob *taskjobv1.CronTaskJob, schedule cron.Schedule, now time.Time) (time.Time, time.Time, int) {
+	earliest := cronTaskJob.CreationTimestamp.Time
+	if cronTaskJob.Status.LastScheduleTime != nil {
+		earliest = cronTaskJob.Status.LastScheduleTime.Time
+	}
+	lastMissed, missed := getMostRecentRun(schedule, earliest, now)
+	return lastMissed, schedule.Next(now), missed
+}
+
+// getMostRecentRun returns the latest run after earliest that is due at now, and how many
+// were due, counting up to maxMissedRuns+1. Only maxMissedRuns runs are walked one by one,
+// then the latest run is searched backward from now, so a long outage doesn't loop over
+// every missed run.
+func getMostRecentRun(schedule cron.Schedule, earliest, now time.Time) (time.Time, int) {
+	var lastMissed time.Time
+	missed := 0
+	t := schedule.Next(earliest)
+	for ; !t.After(now) && missed < maxMissedRuns; t = schedule.Next(t) {
+		// Only the most recent missed run is started
+		lastMissed = t
+		missed++
+	}
+	if t.After(now) {
+		return lastMissed, missed
+	}
+	return getLatestRun(schedule, t, now), missed + 1
+}
+
+// getLatestRun returns the latest run up to now, given a run first that is due. The
+// window before now is doubled until it holds a run, so only the runs of the last
+// non-empty window are walked, whatever the gaps between runs are.
+func getLatestRun(schedule cron.Schedule, first, now time.Time) time.Time {
+	for window := time.Minute; ; window *= 2 {
+		from := now.Add(-window)
+		if !from.After(first) {
+			from = first.Add(-time.Second)
+		}
+		latest := schedule.Next(from)
+		if latest.After(now) {
+			continue
+		}
+		for t := schedule.Next(latest); !t.After(now); t = schedule.Next(t) {
+			latest = t
+		}
+		return latest
+	}
+}
+
+func getScheduledTime(taskJob *taskjobv1.TaskJob) (*time.Time, error) {
+	value, ok := taskJob.Annotations[scheduledTimeAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func historyLimit(limit *int32, defaultLimit int) int {
+	if limit == nil {
+		return defaultLimit
+	}
+	return int(*limit)
+}
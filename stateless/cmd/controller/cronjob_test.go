@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	"github.com/robfig/cron/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestGetMostRecentRun(t *testing.T) {
+	tests := []struct {
+		name       string
+		schedule   string
+		earliest   time.Time
+		now        time.Time
+		wantRun    time.Time
+		wantMissed int
+	}{
+		{
+			name:     "nothing due",
+			schedule: "*/5 * * * *",
+			earliest: time.Date(2026, 1, 10, 12, 5, 0, 0, time.UTC),
+			now:      time.Date(2026, 1, 10, 12, 7, 0, 0, time.UTC),
+		},
+		{
+			name:       "three missed runs",
+			schedule:   "*/5 * * * *",
+			earliest:   time.Date(2026, 1, 10, 11, 50, 0, 0, time.UTC),
+			now:        time.Date(2026, 1, 10, 12, 7, 0, 0, time.UTC),
+			wantRun:    time.Date(2026, 1, 10, 12, 5, 0, 0, time.UTC),
+			wantMissed: 3,
+		},
+		{
+			name:       "exactly the limit",
+			schedule:   "0 * * * *",
+			earliest:   time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+			now:        time.Date(2026, 1, 5, 4, 30, 0, 0, time.UTC),
+			wantRun:    time.Date(2026, 1, 5, 4, 0, 0, 0, time.UTC),
+			wantMissed: maxMissedRuns,
+		},
+		// a year of runs every five minutes isn't walked one by one
+		{
+			name:       "long outage",
+			schedule:   "*/5 * * * *",
+			earliest:   time.Date(2025, 1, 10, 12, 0, 0, 0, time.UTC),
+			now:        time.Date(2026, 1, 10, 12, 7, 0, 0, time.UTC),
+			wantRun:    time.Date(2026, 1, 10, 12, 5, 0, 0, time.UTC),
+			wantMissed: maxMissedRuns + 1,
+		},
+		// the gap after the 100th run says nothing about the gap before now
+		{
+			name:       "long outage with irregular gaps",
+			schedule:   "0 0 1,2 * *",
+			earliest:   time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC),
+			now:        time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC),
+			wantRun:    time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC),
+			wantMissed: maxMissedRuns + 1,
+		},
+		{
+			name:       "long outage with a run just before now",
+			schedule:   "0 0 1,2 * *",
+			earliest:   time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC),
+			now:        time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC),
+			wantRun:    time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC),
+			wantMissed: maxMissedRuns + 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := cron.ParseStandard(tt.schedule)
+			if err != nil {
+				t.Fatalf("ParseStandard() error = %v", err)
+			}
+			run, missed := getMostRecentRun(schedule, tt.earliest, tt.now)
+			if !run.Equal(tt.wantRun) || missed != tt.wantMissed {
+				t.Errorf("getMostRecentRun() = %v, %d missed, want %v, %d missed", run, missed, tt.wantRun, tt.wantMissed)
+			}
+		})
+	}
+}
+
+func TestGetTaskJobObjectLongName(t *testing.T) {
+	r := &CronTaskJobReconciler{scheme: scheme}
+	scheduledTime := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	names := map[string]string{}
+	for _, name := range []string{"nightly", strings.Repeat("a", 253), strings.Repeat("a", 252) + "b"} {
+		cronTaskJob := &taskjobv1.CronTaskJob{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: "uid"},
+			Spec:       taskjobv1.CronTaskJobSpec{JobTemplate: taskjobv1.TaskJobSpec{Image: "task-job:latest"}},
+		}
+		taskJob, err := r.getTaskJobObject(cronTaskJob, scheduledTime)
+		if err != nil {
+			t.Fatalf("getTaskJobObject() error = %v", err)
+		}
+		for _, msg := range validation.IsDNS1123Label(taskJob.Name) {
+			t.Errorf("run name %q: %s", taskJob.Name, msg)
+		}
+		label := taskJob.Labels[cronTaskJobLabel]
+		for _, msg := range validation.IsValidLabelValue(label) {
+			t.Errorf("label %q: %s", label, msg)
+		}
+		// Reconcile lists the runs by the label value it computes from the request name
+		if label != getRunLabelValue(name) {
+			t.Errorf("label = %q, want %q", label, getRunLabelValue(name))
+		}
+		if len(name) <= maxLabelValueLength && label != name {
+			t.Errorf("label = %q, want the name of the CronTaskJob", label)
+		}
+		if other, ok := names[label]; ok {
+			t.Errorf("%q and %q share the label value %q", other, name, label)
+		}
+		names[label] = name
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// taskJobDatabaseIndex indexes TaskJobs by the "<namespace>/<name>" of their databaseRef
+	taskJobDatabaseIndex = "spec.databaseRef"
+
+	postgresPort        int32 = 5432
+	databasePasswordKey       = "password"
+	// databasePollInterval is how often a waiting TaskJob checks its Database when Databases can't be watched
+	databasePollInterval = 30 * time.Second
+)
+
+// databaseGVK is the Database kind of the database controller. The stateful module isn't a
+// dependency of this one, so Databases are read as unstructured objects.
+var databaseGVK = schema.GroupVersionKind{Group: "databases.stackbalancer.com", Version: "v1", Kind: "Database"}
+
+// databaseConnection holds what pods need to connect to a Ready Database. Credentials stay in
+// the Secrets of the Database, which is in the TaskJob namespace, so pods reference them directly.
+type databaseConnection struct {
+	Host string
+	Port int32
+	// Connection Secret of the Database, holding the user, password and dbname keys of its
+	// application role
+	ConnectionSecret string
+	// Role and database from databaseRef, empty to use the connection Secret
+	User     string
+	Database string
+	// Secret holding the password of User
+	UserPassword *corev1.SecretKeySelector
+}
+
+// getDatabaseKey returns the namespaced name of the Database a TaskJob refers to
+func getDatabaseKey(taskJob *taskjobv1.TaskJob) types.NamespacedName {
+	key := types.NamespacedName{Namespace: taskJob.Spec.DatabaseRef.Namespace, Name: taskJob.Spec.DatabaseRef.Name}
+	if key.Namespace == "" {
+		key.Namespace = taskJob.Namespace
+	}
+	return key
+}
+
+// reconcileDatabaseRef resolves spec.databaseRef. It returns nil without an error while the
+// Database isn't Ready or can't be used, after recording why in the DatabaseNotReady condition.
+// Only Databases in the TaskJob namespace are resolved, so a TaskJob can't get at the
+// credentials of another namespace.
+func (r *TaskJobReconciler) reconcileDatabaseRef(ctx context.Context, taskJob *taskjobv1.TaskJob) (*databaseConnection, error) {
+	log := log.FromContext(ctx)
+	ref := taskJob.Spec.DatabaseRef
+
+	if ref == nil {
+		if meta.RemoveStatusCondition(&taskJob.Status.Conditions, taskjobv1.ConditionDatabaseNotReady) {
+			if err := r.Status().Update(ctx, taskJob); err != nil {
+				return nil, fmt.Errorf("couldn't update status: %s", err)
+			}
+		}
+		return nil, nil
+	}
+
+	key := getDatabaseKey(taskJob)
+	if key.Namespace != taskJob.Namespace {
+		log.Info("Database in another namespace can't be used", "Database", key)
+		return nil, r.setDatabaseCondition(ctx, taskJob, metav1.ConditionTrue, "CrossNamespaceRef",
+			fmt.Sprintf("Database %s is not in namespace %s", key, taskJob.Namespace))
+	}
+
+	db := &unstructured.Unstructured{}
+	db.SetGroupVersionKind(databaseGVK)
+	if err := r.Get(ctx, key, db); err != nil {
+		if !k8serrors.IsNotFound(err) && !meta.IsNoMatchError(err) {
+			return nil, fmt.Errorf("couldn't get database: %s", err)
+		}
+		log.Info("Waiting for Database", "Database", key)
+		return nil, r.setDatabaseCondition(ctx, taskJob, metav1.ConditionTrue, "DatabaseNotFound", fmt.Sprintf("Database %s not found", key))
+	}
+
+	phase, _, _ := unstructured.NestedString(db.Object, "status", "phase")
+	if phase != "Ready" {
+		log.Info("Waiting for Database", "Database", key, "phase", phase)
+		return nil, r.setDatabaseCondition(ctx, taskJob, metav1.ConditionTrue, "WaitingForDatabase", fmt.Sprintf("Database %s is in phase %q", key, phase))
+	}
+
+	conn, reason, message := getDatabaseConnection(db, ref)
+	if conn == nil {
+		log.Info("Waiting for Database", "Database", key, "reason", reason)
+		return nil, r.setDatabaseCondition(ctx, taskJob, metav1.ConditionTrue, reason, message)
+	}
+
+	err := r.setDatabaseCondition(ctx, taskJob, metav1.ConditionFalse, "DatabaseReady", fmt.Sprintf("Database %s is Ready", key))
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// getDatabaseConnection reads the connection settings from a Ready Database. It returns the
+// reason and message of the DatabaseNotReady condition when the Database can't be used yet.
+func getDatabaseConnection(db *unstructured.Unstructured, ref *taskjobv1.DatabaseRef) (*databaseConnection, string, string) {
+	// Writes go to the primary through the read-write Service. Databases reconciled by older
+	// controllers only have the headless Service, named after spec.databaseName.
+	service, _, _ := unstructured.NestedString(db.Object, "status", "readWriteService")
+	if service == "" {
+		service, _, _ = unstructured.NestedString(db.Object, "spec", "databaseName")
+	}
+	if service == "" {
+		service = db.GetName()
+	}
+	conn := &databaseConnection{
+		Host:     fmt.Sprintf("%s.%s.svc", service, db.GetNamespace()),
+		Port:     postgresPort,
+		User:     ref.Role,
+		Database: ref.Database,
+	}
+
+	if ref.Database != "" && ref.Database != "postgres" && !hasNamedItem(db, ref.Database, "spec", "databases") {
+		return nil, "LogicalDatabaseNotFound", fmt.Sprintf("database %q is not in spec.databases of Database %s", ref.Database, db.GetName())
+	}
+
+	if ref.Role != "" {
+		role, ok := getNamedItem(db, ref.Role, "spec", "roles")
+		if !ok {
+			return nil, "RoleNotFound", fmt.Sprintf("role %q is not in spec.roles of Database %s", ref.Role, db.GetName())
+		}
+		name, _, _ := unstructured.NestedString(role, "passwordSecretRef", "name")
+		if name == "" {
+			return nil, "RoleNotFound", fmt.Sprintf("role %q of Database %s has no passwordSecretRef", ref.Role, db.GetName())
+		}
+		if status, ok := getNamedItem(db, ref.Role, "status", "roles"); ok {
+			if ready, _, _ := unstructured.NestedBool(status, "ready"); !ready {
+				return nil, "WaitingForRole", fmt.Sprintf("role %q of Database %s is not ready", ref.Role, db.GetName())
+			}
+		}
+		secretKey, _, _ := unstructured.NestedString(role, "passwordSecretRef", "key")
+		if secretKey == "" {
+			secretKey = databasePasswordKey
+		}
+		conn.UserPassword = &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  secretKey,
+		}
+		return conn, "", ""
+	}
+
+	// Older database controllers published the postgres superuser in the connection Secret.
+	// It is only used once the Database reports the role without privileges it holds now.
+	if ready, _, _ := unstructured.NestedBool(db.Object, "status", "appRole", "ready"); !ready {
+		return nil, "RoleRequired", fmt.Sprintf("Database %s doesn't publish an application role yet, set databaseRef.role to use one of its spec.roles", db.GetName())
+	}
+	conn.ConnectionSecret, _, _ = unstructured.NestedString(db.Object, "status", "connectionSecret")
+	if conn.ConnectionSecret == "" {
+		return nil, "WaitingForDatabase", fmt.Sprintf("Database %s has no connection Secret yet", db.GetName())
+	}
+	return conn, "", ""
+}
+
+// getNamedItem returns the item with the given name from a list of objects in the Database
+func getNamedItem(db *unstructured.Unstructured, name string, fields ...string) (map[string]interface{}, bool) {
+	items, _, _ := unstructured.NestedSlice(db.Object, fields...)
+	for _, item := range items {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if itemName, _, _ := unstructured.NestedString(obj, "name"); itemName == name {
+			return obj, true
+		}
+	}
+	return nil, false
+}
+
+func hasNamedItem(db *unstructured.Unstructured, name string, fields ...string) bool {
+	_, ok := getNamedItem(db, name, fields...)
+	return ok
+}
+
+// setDatabaseCondition sets the DatabaseNotReady condition and writes it right away, since
+// the status updates that follow only compare the fields they compute
+func (r *TaskJobReconciler) setDatabaseCondition(ctx context.Context, taskJob *taskjobv1.TaskJob, status metav1.ConditionStatus, reason, message string) error {
+	oldStatus := taskJob.Status.DeepCopy()
+	if status == metav1.ConditionTrue && taskJob.Status.State == "" {
+		setState(taskJob, "Pending")
+	}
+	setCondition(taskJob, taskjobv1.ConditionDatabaseNotReady, status, reason, message)
+	if equality.Semantic.DeepEqual(oldStatus, &taskJob.Status) {
+		return nil
+	}
+	if err := r.Status().Update(ctx, taskJob); err != nil {
+		return fmt.Errorf("couldn't update status: %s", err)
+	}
+	return nil
+}
+
+// setDatabaseEnv passes the connection settings to the main container the way libpq reads
+// them. Values the TaskJob doesn't choose come from the Database's connection Secret, which
+// logs in as the Database's application role rather than the superuser.
+func setDatabaseEnv(taskJob *taskjobv1.TaskJob, conn *databaseConnection, template *corev1.PodTemplateSpec) {
+	if conn == nil {
+		return
+	}
+	fromConnectionSecret := func(name, key string) corev1.EnvVar {
+		return corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: conn.ConnectionSecret},
+				Key:                  key,
+			},
+		}}
+	}
+
+	env := []corev1.EnvVar{
+		{Name: "PGHOST", Value: conn.Host},
+		{Name: "PGPORT", Value: strconv.Itoa(int(conn.Port))},
+	}
+	if conn.UserPassword != nil {
+		env = append(env,
+			corev1.EnvVar{Name: "PGUSER", Value: conn.User},
+			corev1.EnvVar{Name: "PGPASSWORD", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: conn.UserPassword.DeepCopy()}},
+		)
+	} else {
+		env = append(env, fromConnectionSecret("PGUSER", "user"), fromConnectionSecret("PGPASSWORD", "password"))
+	}
+	switch {
+	case conn.Database != "":
+		env = append(env, corev1.EnvVar{Name: "PGDATABASE", Value: conn.Database})
+	case conn.ConnectionSecret != "":
+		env = append(env, fromConnectionSecret("PGDATABASE", "dbname"))
+	default:
+		env = append(env, corev1.EnvVar{Name: "PGDATABASE", Value: "postgres"})
+	}
+	for i := range template.Spec.Containers {
+		if template.Spec.Containers[i].Name != getJobName(taskJob) {
+			continue
+		}
+		for _, e := range env {
+			setEnvVar(&template.Spec.Containers[i], e)
+		}
+	}
+}
+
+// indexTaskJobByDatabase returns the databaseRef key used by taskJobDatabaseIndex
+func indexTaskJobByDatabase(obj client.Object) []string {
+	taskJob, ok := obj.(*taskjobv1.TaskJob)
+	if !ok || taskJob.Spec.DatabaseRef == nil {
+		return nil
+	}
+	return []string{getDatabaseKey(taskJob).String()}
+}
+
+// mapDatabaseToTaskJobs enqueues the TaskJobs referring to a Database when it changes
+func (r *TaskJobReconciler) mapDatabaseToTaskJobs(ctx context.Context, obj client.Object) []reconcile.Request {
+	taskJobs := &taskjobv1.TaskJobList{}
+	key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	if err := r.List(ctx, taskJobs, client.MatchingFields{taskJobDatabaseIndex: key.String()}); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list TaskJobs of Database", "Database", key)
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(taskJobs.Items))
+	for _, taskJob := range taskJobs.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: taskJob.Namespace, Name: taskJob.Name}})
+	}
+	return requests
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newReadyDatabase() *unstructured.Unstructured {
+	db := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"databaseName": "postgres-db",
+			"roles": []interface{}{
+				map[string]interface{}{"name": "app", "login": true, "passwordSecretRef": map[string]interface{}{"name": "app-password"}},
+				map[string]interface{}{"name": "reporting", "login": true},
+			},
+			"databases": []interface{}{
+				map[string]interface{}{"name": "appdb", "owner": "app"},
+			},
+		},
+		"status": map[string]interface{}{
+			"phase":            "Ready",
+			"readWriteService": "postgres-db-rw",
+			"connectionSecret": "postgres-db-conn",
+			"appRole":          map[string]interface{}{"name": "app_user", "ready": true},
+			"roles": []interface{}{
+				map[string]interface{}{"name": "app", "ready": true},
+			},
+		},
+	}}
+	db.SetGroupVersionKind(databaseGVK)
+	db.SetNamespace("default")
+	db.SetName("postgres-db")
+	return db
+}
+
+func getEnv(t *testing.T, conn *databaseConnection) map[string]corev1.EnvVar {
+	t.Helper()
+	taskJob := newTaskJob("db-client")
+	taskJob.Spec.JobName = "db-client"
+	template := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "db-client"}}}}
+	setDatabaseEnv(taskJob, conn, template)
+
+	env := map[string]corev1.EnvVar{}
+	for _, e := range template.Spec.Containers[0].Env {
+		env[e.Name] = e
+	}
+	return env
+}
+
+func secretRef(e corev1.EnvVar) string {
+	if e.ValueFrom == nil || e.ValueFrom.SecretKeyRef == nil {
+		return ""
+	}
+	return e.ValueFrom.SecretKeyRef.Name + "/" + e.ValueFrom.SecretKeyRef.Key
+}
+
+func TestDatabaseConnectionSecret(t *testing.T) {
+	conn, reason, _ := getDatabaseConnection(newReadyDatabase(), &taskjobv1.DatabaseRef{Name: "postgres-db"})
+	if conn == nil {
+		t.Fatalf("getDatabaseConnection() not usable: %s", reason)
+	}
+	env := getEnv(t, conn)
+
+	if got := env["PGHOST"].Value; got != "postgres-db-rw.default.svc" {
+		t.Errorf("PGHOST = %q", got)
+	}
+	for name, want := range map[string]string{
+		"PGUSER":     "postgres-db-conn/user",
+		"PGPASSWORD": "postgres-db-conn/password",
+		"PGDATABASE": "postgres-db-conn/dbname",
+	} {
+		if got := secretRef(env[name]); got != want {
+			t.Errorf("%s reads %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDatabaseConnectionRole(t *testing.T) {
+	conn, reason, _ := getDatabaseConnection(newReadyDatabase(), &taskjobv1.DatabaseRef{Name: "postgres-db", Role: "app", Database: "appdb"})
+	if conn == nil {
+		t.Fatalf("getDatabaseConnection() not usable: %s", reason)
+	}
+	env := getEnv(t, conn)
+
+	if got := env["PGUSER"].Value; got != "app" {
+		t.Errorf("PGUSER = %q, want app", got)
+	}
+	if got := env["PGDATABASE"].Value; got != "appdb" {
+		t.Errorf("PGDATABASE = %q, want appdb", got)
+	}
+	if got := secretRef(env["PGPASSWORD"]); got != "app-password/password" {
+		t.Errorf("PGPASSWORD reads %q, want app-password/password", got)
+	}
+}
+
+func TestDatabaseConnectionNotUsable(t *testing.T) {
+	tests := []struct {
+		name       string
+		ref        taskjobv1.DatabaseRef
+		mutate     func(*unstructured.Unstructured)
+		wantReason string
+	}{
+		{name: "unknown role", ref: taskjobv1.DatabaseRef{Role: "missing"}, wantReason: "RoleNotFound"},
+		{name: "role without password", ref: taskjobv1.DatabaseRef{Role: "reporting"}, wantReason: "RoleNotFound"},
+		{name: "role not ready", ref: taskjobv1.DatabaseRef{Role: "app"}, mutate: func(db *unstructured.Unstructured) {
+			_ = unstructured.SetNestedSlice(db.Object, []interface{}{map[string]interface{}{"name": "app", "ready": false}}, "status", "roles")
+		}, wantReason: "WaitingForRole"},
+		{name: "unknown database", ref: taskjobv1.DatabaseRef{Database: "missing"}, wantReason: "LogicalDatabaseNotFound"},
+		{name: "no connection secret", mutate: func(db *unstructured.Unstructured) {
+			unstructured.RemoveNestedField(db.Object, "status", "connectionSecret")
+		}, wantReason: "WaitingForDatabase"},
+		// the connection Secret of older database controllers logs in as postgres
+		{name: "no application role", mutate: func(db *unstructured.Unstructured) {
+			unstructured.RemoveNestedField(db.Object, "status", "appRole")
+		}, wantReason: "RoleRequired"},
+		{name: "application role not ready", mutate: func(db *unstructured.Unstructured) {
+			_ = unstructured.SetNestedField(db.Object, false, "status", "appRole", "ready")
+		}, wantReason: "RoleRequired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newReadyDatabase()
+			if tt.mutate != nil {
+				tt.mutate(db)
+			}
+			tt.ref.Name = "postgres-db"
+			conn, reason, _ := getDatabaseConnection(db, &tt.ref)
+			if conn != nil || reason != tt.wantReason {
+				t.Errorf("getDatabaseConnection() = %v, %q, want reason %q", conn, reason, tt.wantReason)
+			}
+		})
+	}
+}
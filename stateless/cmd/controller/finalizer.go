@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// taskJobFinalizer blocks removal of a TaskJob until its children are torn down
+const taskJobFinalizer = "kubernetes.tjob.com/finalizer"
+
+// finalizeTaskJob deletes the Job, Deployment, Service and params ConfigMap of a TaskJob. It is safe to
+// call repeatedly: children that are already gone are skipped.
+func (r *TaskJobReconciler) finalizeTaskJob(ctx context.Context, taskJob *taskjobv1.TaskJob) error {
+	log := log.FromContext(ctx)
+
+	name := getJobName(taskJob)
+
+	if err := r.deleteIfOwned(ctx, taskJob, &batchv1.Job{}, name); err != nil {
+		return fmt.Errorf("couldn't delete job: %s", err)
+	}
+	if err := r.deleteIfOwned(ctx, taskJob, &appsv1.Deployment{}, name); err != nil {
+		return fmt.Errorf("couldn't delete deployment: %s", err)
+	}
+	if err := r.deleteIfOwned(ctx, taskJob, &corev1.Service{}, name); err != nil {
+		return fmt.Errorf("couldn't delete service: %s", err)
+	}
+	if err := r.deleteIfOwned(ctx, taskJob, &corev1.ConfigMap{}, getParamsConfigMapName(taskJob)); err != nil {
+		return fmt.Errorf("couldn't delete configmap: %s", err)
+	}
+
+	log.Info("Deleted children of TaskJob", "TaskJob", name)
+	return nil
+}
+
+// deleteIfOwned deletes the named child if this TaskJob controls it. Objects without a
+// controller or controlled by another object are left alone, since they may have been
+// created by someone else under the same name.
+func (r *TaskJobReconciler) deleteIfOwned(ctx context.Context, taskJob *taskjobv1.TaskJob, obj client.Object, name string) error {
+	if err := r.Get(ctx, types.NamespacedName{Namespace: taskJob.Namespace, Name: name}, obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if owner := metav1.GetControllerOf(obj); owner == nil || owner.UID != taskJob.UID {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, obj, client.PropagationPolicy(metav1.DeletePropagationBackground)))
+}
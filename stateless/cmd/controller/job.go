@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// jobSpecHashAnnotation on a Job records the spec it was created from. The pod template of
+// a Job can't change, so a Job whose hash no longer matches the TaskJob is recreated.
+const jobSpecHashAnnotation = "kubernetes.tjob.com/job-spec-hash"
+
+// reconcileBatch handles TaskJobs in Batch mode, which run to completion as a batch/v1 Job
+func (r *TaskJobReconciler) reconcileBatch(ctx context.Context, taskJob *taskjobv1.TaskJob, jobName string, dbConn *databaseConnection) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	jobObj, err := getJobObject(taskJob, dbConn)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Check if Job exists
+	job := &batchv1.Job{}
+	err = r.Get(ctx, types.NamespacedName{Namespace: taskJob.Namespace, Name: jobName}, job)
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			if err := controllerutil.SetControllerReference(taskJob, jobObj, r.scheme); err != nil {
+				return ctrl.Result{}, fmt.Errorf("couldn't set owner reference: %s", err)
+			}
+			if err := r.Create(ctx, jobObj); err != nil {
+				return ctrl.Result{}, fmt.Errorf("couldn't create job: %s", err)
+			}
+
+			// The Job watch triggers the next reconcile once it starts
+			log.Info("Created Job for TaskJob", "TaskJob", jobName)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, fmt.Errorf("couldn't get object: %s", err)
+	}
+
+	// A finished Job from an older spec is replaced, a running one is reported until it ends.
+	// Jobs created before the hash was recorded are left alone.
+	hash := job.Annotations[jobSpecHashAnnotation]
+	stale := hash != "" && hash != jobObj.Annotations[jobSpecHashAnnotation]
+	if stale && (findJobCondition(job, batchv1.JobComplete) != nil || findJobCondition(job, batchv1.JobFailed) != nil) {
+		if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
+		// The Job watch triggers the next reconcile, which creates the new Job
+		log.Info("Deleted Job created from an older spec", "TaskJob", jobName)
+		return ctrl.Result{}, nil
+	}
+
+	// Update the Job Status
+	log.Info("Updating TaskJob status", "currentState", taskJob.Status.State)
+	if err := r.updateBatchStatus(ctx, taskJob, job, stale); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+func getJobObject(taskJob *taskjobv1.TaskJob, dbConn *databaseConnection) (*batchv1.Job, error) {
+	template, err := getPodTemplate(taskJob)
+	if err != nil {
+		return nil, err
+	}
+	// Jobs only accept Never or OnFailure, keep the user's choice when valid
+	if template.Spec.RestartPolicy != corev1.RestartPolicyOnFailure {
+		template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	}
+	// task-job-service runs the job once and exits instead of serving when RUN_MODE is batch
+	for i := range template.Spec.Containers {
+		if template.Spec.Containers[i].Name == getJobName(taskJob) {
+			setEnvVar(&template.Spec.Containers[i], corev1.EnvVar{Name: "RUN_MODE", Value: "batch"})
+		}
+	}
+	setDatabaseEnv(taskJob, dbConn, &template)
+
+	spec := batchv1.JobSpec{
+		Completions:  taskJob.Spec.Completions,
+		Parallelism:  taskJob.Spec.Parallelism,
+		BackoffLimit: taskJob.Spec.BackoffLimit,
+		Template:     template,
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't hash job spec: %s", err)
+	}
+	sum := sha256.Sum256(data)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        getJobName(taskJob),
+			Namespace:   taskJob.Namespace,
+			Annotations: map[string]string{jobSpecHashAnnotation: hex.EncodeToString(sum[:])[:16]},
+		},
+		Spec: spec,
+	}, nil
+}
+
+// deleteOtherModeChildren removes the children of the mode the TaskJob no longer runs in,
+// so switching between Service and Batch mode doesn't leave the old workload running
+func (r *TaskJobReconciler) deleteOtherModeChildren(ctx context.Context, taskJob *taskjobv1.TaskJob) error {
+	name := getJobName(taskJob)
+	if taskJob.Spec.Mode == taskjobv1.ModeBatch {
+		if err := r.deleteIfOwned(ctx, taskJob, &appsv1.Deployment{}, name); err != nil {
+			return fmt.Errorf("couldn't delete deployment: %s", err)
+		}
+		if err := r.deleteIfOwned(ctx, taskJob, &corev1.Service{}, name); err != nil {
+			return fmt.Errorf("couldn't delete service: %s", err)
+		}
+		return nil
+	}
+	if err := r.deleteIfOwned(ctx, taskJob, &batchv1.Job{}, name); err != nil {
+		return fmt.Errorf("couldn't delete job: %s", err)
+	}
+	return nil
+}
+
+// updateBatchStatus maps the conditions of the Job onto the TaskJob state. A stale Job
+// still running is reported as Progressing until it ends and is replaced.
+func (r *TaskJobReconciler) updateBatchStatus(ctx context.Context, taskJob *taskjobv1.TaskJob, job *batchv1.Job, stale bool) error {
+	log := log.FromContext(ctx)
+
+	oldStatus := taskJob.Status.DeepCopy()
+
+	state := "Pending"
+	var completionTime *metav1.Time
+
+	if c := findJobCondition(job, batchv1.JobComplete); c != nil {
+		state = "Completed"
+		completionTime = job.Status.CompletionTime
+		if completionTime == nil {
+			completionTime = &c.LastTransitionTime
+		}
+		setCondition(taskJob, taskjobv1.ConditionAvailable, metav1.ConditionTrue, "JobComplete", c.Message)
+		setCondition(taskJob, taskjobv1.ConditionProgressing, metav1.ConditionFalse, "JobComplete", c.Message)
+		setCondition(taskJob, taskjobv1.ConditionDegraded, metav1.ConditionFalse, "AsExpected", "")
+	} else if c := findJobCondition(job, batchv1.JobFailed); c != nil {
+		state = "Failed"
+		completionTime = &c.LastTransitionTime
+		setCondition(taskJob, taskjobv1.ConditionAvailable, metav1.ConditionFalse, "JobFailed", c.Message)
+		setCondition(taskJob, taskjobv1.ConditionProgressing, metav1.ConditionFalse, "JobFailed", c.Message)
+		setCondition(taskJob, taskjobv1.ConditionDegraded, metav1.ConditionTrue, "JobFailed", c.Message)
+	} else {
+		reason := "JobPending"
+		if job.Status.Active > 0 {
+			state = "Running"
+			reason = "JobRunning"
+		}
+		message := fmt.Sprintf("%d active, %d succeeded, %d failed", job.Status.Active, job.Status.Succeeded, job.Status.Failed)
+		if stale {
+			reason = "JobOutdated"
+			message += "; the spec changed, the Job is recreated once it finishes"
+		}
+		setCondition(taskJob, taskjobv1.ConditionAvailable, metav1.ConditionFalse, reason, message)
+		setCondition(taskJob, taskjobv1.ConditionProgressing, metav1.ConditionTrue, reason, message)
+		// Failed pods are retried until the backoff limit is reached
+		if job.Status.Failed > 0 {
+			setCondition(taskJob, taskjobv1.ConditionDegraded, metav1.ConditionTrue, "PodFailure", message)
+		} else {
+			setCondition(taskJob, taskjobv1.ConditionDegraded, metav1.ConditionFalse, "AsExpected", "")
+		}
+	}
+
+	setState(taskJob, state)
+	taskJob.Status.CompletionTime = completionTime
+	taskJob.Status.ObservedGeneration = taskJob.Generation
+	taskJob.Status.ReadyReplicas = 0
+	if job.Status.Ready != nil {
+		taskJob.Status.ReadyReplicas = *job.Status.Ready
+	}
+
+	// Only update if status changed
+	if !equality.Semantic.DeepEqual(oldStatus, &taskJob.Status) {
+		if err := r.Status().Update(ctx, taskJob); err != nil {
+			log.Error(err, "Failed to update TaskJob status")
+			return err
+		}
+		log.Info("Updated TaskJob state", "newState", state)
+	}
+
+	return nil
+}
+
+// findJobCondition returns the condition of the given type if it is true
+func findJobCondition(job *batchv1.Job, conditionType batchv1.JobConditionType) *batchv1.JobCondition {
+	for i := range job.Status.Conditions {
+		c := &job.Status.Conditions[i]
+		if c.Type == conditionType && c.Status == corev1.ConditionTrue {
+			return c
+		}
+	}
+	return nil
+}
@@ -6,26 +6,46 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"time"
 
 	taskjobv1 "k8s-job-operator/stateless/api/v1"
 
 	"go.uber.org/zap/zapcore"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// fieldManager owns the fields of the children applied by the TaskJob controller
+	fieldManager = "taskjob-controller"
+	// taskJobLabel on pods holds the name of the TaskJob they belong to
+	taskJobLabel = "kubernetes.tjob.com/taskjob"
+	// podTaskJobIndex indexes cached pods by taskJobLabel
+	podTaskJobIndex = "metadata.labels.taskjob"
+	// servicePort is where task-job-service listens, in pods and on the Service
+	servicePort int32 = 8080
 )
 
 // Register CRD with the Scheme
@@ -35,14 +55,17 @@ var (
 )
 
 func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 	utilruntime.Must(taskjobv1.AddToScheme(scheme))
 }
 
 // TaskJobReconciler reconciles TaskJob resources
 type TaskJobReconciler struct {
 	client.Client
-	scheme     *runtime.Scheme
-	kubeClient *kubernetes.Clientset
+	scheme *runtime.Scheme
+	// watchDatabases is false when the Database CRD isn't installed, TaskJobs waiting for a
+	// Database then check again every databasePollInterval
+	watchDatabases bool
 }
 
 // Reconcile handles changes to TaskJob resources
@@ -51,32 +74,14 @@ func (r *TaskJobReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	log.Info("Reconciling TaskJob", "Namespace", req.Namespace, "Name", req.Name)
 
 	taskJob := &taskjobv1.TaskJob{}
-	// create deployment if not exists
-	deploymentsClient := r.kubeClient.AppsV1().Deployments(req.Namespace)
-	svClient := r.kubeClient.CoreV1().Services(req.Namespace)
-
-	// Define the deployment name based on the TaskJob name
-	jobName := taskJob.Spec.JobName
-	if jobName == "" {
-		jobName = req.Name
-	}
 
 	// Fetch the TaskJob custom resource
 	err := r.Client.Get(ctx, req.NamespacedName, taskJob)
 	if err != nil {
 		if k8serrors.IsNotFound(err) {
-			// handle deletion of TaskJob-related resource if taskJob not found
+			// Children are torn down by the finalizer and the garbage collector
 			log.Info("TaskJob resource not found. Ignoring since object must be deleted", "namespace", req.NamespacedName, "name", req.Name)
-			err = deploymentsClient.Delete(ctx, jobName, metav1.DeleteOptions{})
-			if err != nil {
-				return ctrl.Result{}, fmt.Errorf("couldn't delete deployment: %s", err)
-			}
-			err = svClient.Delete(ctx, jobName, metav1.DeleteOptions{})
-			if err != nil {
-				return ctrl.Result{}, fmt.Errorf("couldn't delete service: %s", err)
-			}
 			return ctrl.Result{}, nil
-
 		}
 		log.Error(err, "Failed to fetch TaskJob resource", "namespace", req.NamespacedName, "name", req.Name)
 		return ctrl.Result{}, err
@@ -84,54 +89,107 @@ func (r *TaskJobReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	log.Info("Fetched TaskJob", "spec", taskJob.Spec, "status", taskJob.Status)
 	//log.Info("Fetched TaskJob resource", "state", taskJob.Status.State, "jobName", taskJob.Spec.JobName)
 
-	// Check if Deployment exists
-	deployment, err := deploymentsClient.Get(ctx, jobName, metav1.GetOptions{})
-	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			// Create Deployment
-			deploymentObj := getDeploymentObject(taskJob)
-			_, err := deploymentsClient.Create(ctx, deploymentObj, metav1.CreateOptions{})
-			if err != nil {
-				return ctrl.Result{}, fmt.Errorf("couldn't create deployment: %s", err)
+	// Define the deployment name based on the TaskJob name
+	jobName := getJobName(taskJob)
+
+	// Tear down children before the TaskJob is removed
+	if !taskJob.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(taskJob, taskJobFinalizer) {
+			if err := r.finalizeTaskJob(ctx, taskJob); err != nil {
+				return ctrl.Result{}, err
 			}
-			// Create Service
-			serviceObj := getServiceObject(taskJob)
-			_, err = svClient.Create(ctx, serviceObj, metav1.CreateOptions{})
-			if err != nil {
-				return ctrl.Result{}, fmt.Errorf("couldn't create service: %s", err)
+			controllerutil.RemoveFinalizer(taskJob, taskJobFinalizer)
+			if err := r.Update(ctx, taskJob); err != nil {
+				return ctrl.Result{}, fmt.Errorf("couldn't remove finalizer: %s", err)
 			}
+			log.Info("Finalized TaskJob", "TaskJob", jobName)
+		}
+		return ctrl.Result{}, nil
+	}
 
-			log.Info("Created Deployment and Service for TaskJob", "TaskJob", jobName)
-			return ctrl.Result{}, nil
-		} else {
-			return ctrl.Result{}, fmt.Errorf("couldn't get object: %s", err)
+	// Make sure the TaskJob can't go away before its children are cleaned up
+	if !controllerutil.ContainsFinalizer(taskJob, taskJobFinalizer) {
+		controllerutil.AddFinalizer(taskJob, taskJobFinalizer)
+		if err := r.Update(ctx, taskJob); err != nil {
+			return ctrl.Result{}, fmt.Errorf("couldn't add finalizer: %s", err)
 		}
 	}
 
-	// Check if the current replica count differs from the desired count
-	if int(*deployment.Spec.Replicas) != taskJob.Spec.Replicas {
-		// Update the deployment replica count to match the TaskJob specification
-		deployment.Spec.Replicas = int32Ptr(int32(taskJob.Spec.Replicas))
+	// Objects of the TaskJob's names that something else controls are never taken over
+	conflict, err := r.findConflict(ctx, taskJob)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.setConflictCondition(ctx, taskJob, conflict); err != nil {
+		return ctrl.Result{}, err
+	}
+	if conflict != "" {
+		log.Info("Waiting for a conflicting object to go away", "reason", conflict)
+		return ctrl.Result{RequeueAfter: conflictPollInterval}, nil
+	}
+
+	// Params ConfigMap must exist before the pods that mount it. Pods aren't created or
+	// changed while jobParams can't be delivered, until the spec is fixed.
+	paramsValid, err := r.reconcileParamsConfigMap(ctx, taskJob)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !paramsValid {
+		return ctrl.Result{}, nil
+	}
 
-		// Apply the update to the cluster
-		_, err := deploymentsClient.Update(ctx, deployment, metav1.UpdateOptions{})
-		if err != nil {
-			return ctrl.Result{}, fmt.Errorf("couldn't update deployment: %s", err)
+	// Pods connecting to a Database aren't created or changed until it is Ready
+	dbConn, err := r.reconcileDatabaseRef(ctx, taskJob)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if taskJob.Spec.DatabaseRef != nil && dbConn == nil {
+		if r.watchDatabases {
+			return ctrl.Result{}, nil
 		}
+		return ctrl.Result{RequeueAfter: databasePollInterval}, nil
+	}
 
-		// Log the update
-		log.Info("Updated Deployment replicas for TaskJob", "TaskJob", jobName)
-		return ctrl.Result{}, nil
+	// Switching modes removes the workload of the previous mode
+	if err := r.deleteOtherModeChildren(ctx, taskJob); err != nil {
+		return ctrl.Result{}, err
 	}
 
+	// Batch TaskJobs run to completion as a batch/v1 Job instead of a Deployment
+	if taskJob.Spec.Mode == taskjobv1.ModeBatch {
+		return r.reconcileBatch(ctx, taskJob, jobName, dbConn)
+	}
+
+	// Compute the desired Deployment and Service and apply them on every pass, which rolls
+	// out spec changes and reverts out-of-band edits of the fields the controller owns
+	deploymentObj, err := getDeploymentObject(taskJob, dbConn)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := controllerutil.SetControllerReference(taskJob, deploymentObj, r.scheme); err != nil {
+		return ctrl.Result{}, fmt.Errorf("couldn't set owner reference: %s", err)
+	}
+	if err := r.Patch(ctx, deploymentObj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		return ctrl.Result{}, fmt.Errorf("couldn't apply deployment: %s", err)
+	}
+
+	serviceObj := getServiceObject(taskJob)
+	if err := controllerutil.SetControllerReference(taskJob, serviceObj, r.scheme); err != nil {
+		return ctrl.Result{}, fmt.Errorf("couldn't set owner reference: %s", err)
+	}
+	if err := r.Patch(ctx, serviceObj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		return ctrl.Result{}, fmt.Errorf("couldn't apply service: %s", err)
+	}
+	log.Info("Applied Deployment and Service for TaskJob", "TaskJob", jobName, "generation", deploymentObj.Generation)
+
 	// Update the Job Status
 	log.Info("Updating TaskJob status", "currentState", taskJob.Status.State)
-	if err := r.updateJobStatus(ctx, taskJob); err != nil {
+	if err := r.updateJobStatus(ctx, taskJob, deploymentObj); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	// Requeue to keep monitoring Pods
-	return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	// Deployment and Pod watches trigger the next reconcile
+	return ctrl.Result{}, nil
 }
 
 func main() {
@@ -157,37 +215,100 @@ func main() {
 		}
 	}
 
-	// Kubernetes client set
-	clientset, err := kubernetes.NewForConfig(config)
+	// Set logger for the controller
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	// Only pods of TaskJobs are cached
+	taskJobPods, err := labels.NewRequirement(taskJobLabel, selection.Exists, nil)
 	if err != nil {
 		panic(err.Error())
 	}
 
-	// Set logger for the controller
-	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
-
 	// Create a new controller manager
 	mgr, err := ctrl.NewManager(config, ctrl.Options{
 		Scheme: scheme,
+		Cache: cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				&corev1.Pod{}: {Label: labels.NewSelector().Add(*taskJobPods)},
+			},
+		},
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	// Register TaskJob controller
-	err = ctrl.NewControllerManagedBy(mgr).
+	// Index pods by the TaskJob they belong to
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, podTaskJobIndex, func(obj client.Object) []string {
+		if name, ok := obj.GetLabels()[taskJobLabel]; ok {
+			return []string{name}
+		}
+		return nil
+	})
+	if err != nil {
+		setupLog.Error(err, "unable to index pods")
+		os.Exit(1)
+	}
+
+	// Index TaskJobs by the Database they refer to
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &taskjobv1.TaskJob{}, taskJobDatabaseIndex, indexTaskJobByDatabase)
+	if err != nil {
+		setupLog.Error(err, "unable to index taskjobs")
+		os.Exit(1)
+	}
+
+	taskJobReconciler := &TaskJobReconciler{
+		Client: mgr.GetClient(),
+		scheme: mgr.GetScheme(),
+	}
+
+	// Register TaskJob controller, reconciling on changes to the TaskJob, its children and its pods
+	taskJobController := ctrl.NewControllerManagedBy(mgr).
 		For(&taskjobv1.TaskJob{}).
-		Complete(&TaskJobReconciler{
-			Client:     mgr.GetClient(),
-			scheme:     mgr.GetScheme(),
-			kubeClient: clientset,
-		})
+		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.Service{}).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&batchv1.Job{}).
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(mapPodToTaskJob))
+
+	// The database controller may not be installed, then databaseRef falls back to polling
+	if _, err := mgr.GetRESTMapper().RESTMapping(databaseGVK.GroupKind(), databaseGVK.Version); err == nil {
+		database := &unstructured.Unstructured{}
+		database.SetGroupVersionKind(databaseGVK)
+		taskJobController = taskJobController.Watches(database, handler.EnqueueRequestsFromMapFunc(taskJobReconciler.mapDatabaseToTaskJobs))
+		taskJobReconciler.watchDatabases = true
+	} else {
+		setupLog.Info("Database CRD not found, TaskJobs with a databaseRef will poll for their Database", "error", err.Error())
+	}
+
+	err = taskJobController.Complete(taskJobReconciler)
 	if err != nil {
 		setupLog.Error(err, "unable to create controller")
 		os.Exit(1)
 	}
 
+	// Register TaskJob defaulting and validating webhooks. They need serving certificates,
+	// so they are only enabled when the deployment provides them.
+	if os.Getenv("ENABLE_WEBHOOKS") == "true" {
+		if err := setupWebhooks(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook")
+			os.Exit(1)
+		}
+	}
+
+	// Register CronTaskJob controller
+	err = ctrl.NewControllerManagedBy(mgr).
+		For(&taskjobv1.CronTaskJob{}).
+		Owns(&taskjobv1.TaskJob{}).
+		Complete(&CronTaskJobReconciler{
+			Client: mgr.GetClient(),
+			scheme: mgr.GetScheme(),
+		})
+	if err != nil {
+		setupLog.Error(err, "unable to create cron controller")
+		os.Exit(1)
+	}
+
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "error running manager")
@@ -196,77 +317,116 @@ func main() {
 
 }
 
-func getDeploymentObject(taskJob *taskjobv1.TaskJob) *appsv1.Deployment {
-	var pullPolicy corev1.PullPolicy
-
-	if taskJob.Spec.ImagePullPolicy != "" {
-		pullPolicy = corev1.PullPolicy(taskJob.Spec.ImagePullPolicy)
-	} else {
-		pullPolicy = corev1.PullIfNotPresent
+func getDeploymentObject(taskJob *taskjobv1.TaskJob, dbConn *databaseConnection) (*appsv1.Deployment, error) {
+	template, err := getPodTemplate(taskJob)
+	if err != nil {
+		return nil, err
 	}
+	// Deployments only accept Always
+	template.Spec.RestartPolicy = corev1.RestartPolicyAlways
+	setGracefulShutdown(taskJob, &template)
+	setProbes(taskJob, &template)
+	setMetrics(taskJob, &template)
+	setDatabaseEnv(taskJob, dbConn, &template)
 
 	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: taskJob.Spec.JobName,
+			Name:      getJobName(taskJob),
+			Namespace: taskJob.Namespace,
 		},
 		Spec: appsv1.DeploymentSpec{
 			Replicas: int32Ptr(int32(taskJob.Spec.Replicas)),
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
-					"app": taskJob.Spec.JobName,
+					"app": getJobName(taskJob),
 				},
 			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": taskJob.Spec.JobName,
-					},
-				},
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Name:            taskJob.Spec.JobName,
-							Image:           taskJob.Spec.Image,
-							ImagePullPolicy: pullPolicy,
-							Ports:           []corev1.ContainerPort{{ContainerPort: 8080}},
-							Env: []corev1.EnvVar{
-								{Name: "JOB_NAME", Value: taskJob.Spec.JobName},
-								{Name: "JOB_PARAMS", Value: fmt.Sprintf("%v", taskJob.Spec.JobParams)}, // Pass taskJob params as env vars
-							},
-						},
-					},
+			Template: template,
+		},
+	}, nil
+}
+
+// getPodTemplate builds the pod template shared by Deployments and Jobs
+func getPodTemplate(taskJob *taskjobv1.TaskJob) (corev1.PodTemplateSpec, error) {
+	var pullPolicy corev1.PullPolicy
+
+	if taskJob.Spec.ImagePullPolicy != "" {
+		pullPolicy = corev1.PullPolicy(taskJob.Spec.ImagePullPolicy)
+	} else {
+		pullPolicy = corev1.PullIfNotPresent
+	}
+
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{
+				"app":        getJobName(taskJob),
+				taskJobLabel: taskJob.Name,
+			},
+			Annotations: map[string]string{
+				paramsHashAnnotation: getParamsHash(taskJob),
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:            getJobName(taskJob),
+					Image:           taskJob.Spec.Image,
+					ImagePullPolicy: pullPolicy,
+					Ports:           []corev1.ContainerPort{{ContainerPort: servicePort}},
+					Env: append([]corev1.EnvVar{
+						{Name: "JOB_NAME", Value: getJobName(taskJob)},
+					}, getParamsEnv(taskJob)...), // Pass taskJob params as env vars
 				},
 			},
 		},
 	}
+
+	if getParamsDeliveryType(taskJob) == taskjobv1.ParamsDeliveryConfigMap {
+		addParamsVolume(taskJob, &template.Spec)
+	}
+
+	return mergePodTemplate(taskJob, template)
 }
 
 func getServiceObject(taskJob *taskjobv1.TaskJob) *corev1.Service {
-	return &corev1.Service{
+	service := &corev1.Service{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: taskJob.Spec.JobName,
+			Name:      getJobName(taskJob),
+			Namespace: taskJob.Namespace,
 		},
 		Spec: corev1.ServiceSpec{
-			Selector: map[string]string{"app": taskJob.Spec.JobName},
+			Selector: map[string]string{"app": getJobName(taskJob)},
 			Ports: []corev1.ServicePort{
 				{
-					Port:       8080,
-					TargetPort: intstr.FromInt(8080),
+					Protocol:   corev1.ProtocolTCP,
+					Port:       servicePort,
+					TargetPort: intstr.FromInt(int(servicePort)),
 				},
 			},
 		},
 	}
+	addMetricsServicePort(taskJob, service)
+	return service
+}
+
+// getJobName returns the name of the children, defaulting to the TaskJob name
+func getJobName(taskJob *taskjobv1.TaskJob) string {
+	if taskJob.Spec.JobName != "" {
+		return taskJob.Spec.JobName
+	}
+	return taskJob.Name
 }
 
-func (r *TaskJobReconciler) updateJobStatus(ctx context.Context, taskJob *taskjobv1.TaskJob) error {
+func (r *TaskJobReconciler) updateJobStatus(ctx context.Context, taskJob *taskjobv1.TaskJob, deployment *appsv1.Deployment) error {
 	log := log.FromContext(ctx)
 
-	// List Pods for this TaskJob (selector must match Deployment labels)
-	pods, err := r.kubeClient.CoreV1().Pods(taskJob.Namespace).List(ctx, metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("app=%s", taskJob.Spec.JobName),
-	})
+	// List Pods for this TaskJob from the cache
+	pods := &corev1.PodList{}
+	err := r.List(ctx, pods, client.InNamespace(taskJob.Namespace), client.MatchingFields{podTaskJobIndex: taskJob.Name})
 	if err != nil {
-		log.Error(err, "Failed to list pods for TaskJob", "jobName", taskJob.Spec.JobName)
+		log.Error(err, "Failed to list pods for TaskJob", "jobName", getJobName(taskJob))
 		return err
 	}
 
@@ -305,14 +465,59 @@ func (r *TaskJobReconciler) updateJobStatus(ctx context.Context, taskJob *taskjo
 		state = "Running"
 	}
 
-	// Only update if state changed
-	if taskJob.Status.State != state {
-		taskJob.Status.State = state
-		if state == "Completed" {
-			now := metav1.Now()
-			taskJob.Status.CompletionTime = &now
-		}
+	oldStatus := taskJob.Status.DeepCopy()
+
+	if state == "Completed" && taskJob.Status.State != state {
+		now := metav1.Now()
+		taskJob.Status.CompletionTime = &now
+	}
+	setState(taskJob, state)
+	taskJob.Status.ObservedGeneration = taskJob.Generation
+	taskJob.Status.ReadyReplicas = deployment.Status.ReadyReplicas
 
+	desired := int32(1)
+	if deployment.Spec.Replicas != nil {
+		desired = *deployment.Spec.Replicas
+	}
+	ready := deployment.Status.ReadyReplicas
+	readyMessage := fmt.Sprintf("%d/%d replicas ready", ready, desired)
+
+	// Available once the Deployment is available with all replicas ready
+	available := getDeploymentCondition(deployment, appsv1.DeploymentAvailable)
+	if available != nil && available.Status == corev1.ConditionTrue && ready >= desired {
+		setCondition(taskJob, taskjobv1.ConditionAvailable, metav1.ConditionTrue, "ReplicasReady", readyMessage)
+	} else {
+		setCondition(taskJob, taskjobv1.ConditionAvailable, metav1.ConditionFalse, "ReplicasNotReady", readyMessage)
+	}
+
+	// Progressing while the Deployment controller is still rolling out the latest template
+	progressing := getDeploymentCondition(deployment, appsv1.DeploymentProgressing)
+	stuck := progressing != nil && progressing.Reason == "ProgressDeadlineExceeded"
+	rollingOut := deployment.Generation > deployment.Status.ObservedGeneration ||
+		deployment.Status.UpdatedReplicas < desired ||
+		deployment.Status.Replicas > deployment.Status.UpdatedReplicas ||
+		deployment.Status.AvailableReplicas < deployment.Status.UpdatedReplicas
+	switch {
+	case stuck:
+		setCondition(taskJob, taskjobv1.ConditionProgressing, metav1.ConditionFalse, "ProgressDeadlineExceeded", "rollout did not finish within the progress deadline")
+	case rollingOut:
+		setCondition(taskJob, taskjobv1.ConditionProgressing, metav1.ConditionTrue, "RollingOut", readyMessage)
+	default:
+		setCondition(taskJob, taskjobv1.ConditionProgressing, metav1.ConditionFalse, "RolloutComplete", readyMessage)
+	}
+
+	// Degraded when pods fail or the rollout is stuck
+	switch {
+	case hasFailed:
+		setCondition(taskJob, taskjobv1.ConditionDegraded, metav1.ConditionTrue, "PodFailure", "one or more pods failed or are crash looping")
+	case stuck:
+		setCondition(taskJob, taskjobv1.ConditionDegraded, metav1.ConditionTrue, "ProgressDeadlineExceeded", "rollout did not finish within the progress deadline")
+	default:
+		setCondition(taskJob, taskjobv1.ConditionDegraded, metav1.ConditionFalse, "AsExpected", "")
+	}
+
+	// Only update if status changed
+	if !equality.Semantic.DeepEqual(oldStatus, &taskJob.Status) {
 		if err := r.Status().Update(ctx, taskJob); err != nil {
 			log.Error(err, "Failed to update TaskJob status")
 			return err
@@ -323,6 +528,25 @@ func (r *TaskJobReconciler) updateJobStatus(ctx context.Context, taskJob *taskjo
 	return nil
 }
 
+// getDeploymentCondition returns the Deployment condition of the given type, if any
+func getDeploymentCondition(deployment *appsv1.Deployment, conditionType appsv1.DeploymentConditionType) *appsv1.DeploymentCondition {
+	for i := range deployment.Status.Conditions {
+		if deployment.Status.Conditions[i].Type == conditionType {
+			return &deployment.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// mapPodToTaskJob enqueues the TaskJob a pod belongs to
+func mapPodToTaskJob(ctx context.Context, obj client.Object) []reconcile.Request {
+	name, ok := obj.GetLabels()[taskJobLabel]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}}}
+}
+
 func int32Ptr(i int32) *int32 {
 	return &i
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strconv"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	metricsPortName    = "metrics"
+	defaultMetricsPath = "/metrics"
+)
+
+func getMetricsPort(taskJob *taskjobv1.TaskJob) int32 {
+	if taskJob.Spec.Metrics.Port != 0 {
+		return taskJob.Spec.Metrics.Port
+	}
+	return servicePort
+}
+
+func getMetricsPath(taskJob *taskjobv1.TaskJob) string {
+	if taskJob.Spec.Metrics.Path != "" {
+		return taskJob.Spec.Metrics.Path
+	}
+	return defaultMetricsPath
+}
+
+// setMetrics adds the prometheus.io scrape annotations and a port named metrics to the pod
+// template. A metrics port other than the service port is passed on as METRICS_PORT.
+func setMetrics(taskJob *taskjobv1.TaskJob, template *corev1.PodTemplateSpec) {
+	if taskJob.Spec.Metrics == nil {
+		return
+	}
+	port := getMetricsPort(taskJob)
+
+	template.Annotations["prometheus.io/scrape"] = "true"
+	template.Annotations["prometheus.io/port"] = strconv.Itoa(int(port))
+	template.Annotations["prometheus.io/path"] = getMetricsPath(taskJob)
+
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if container.Name != getJobName(taskJob) {
+			continue
+		}
+		if port == servicePort {
+			nameContainerPort(container, servicePort, metricsPortName)
+			continue
+		}
+		nameContainerPort(container, servicePort, "http")
+		nameContainerPort(container, port, metricsPortName)
+		setEnvVar(container, corev1.EnvVar{Name: "METRICS_PORT", Value: strconv.Itoa(int(port))})
+	}
+}
+
+// nameContainerPort names the TCP container port with the given number, adding it if needed
+func nameContainerPort(container *corev1.Container, port int32, name string) {
+	for i := range container.Ports {
+		p := &container.Ports[i]
+		if p.ContainerPort == port && (p.Protocol == "" || p.Protocol == corev1.ProtocolTCP) {
+			p.Name = name
+			return
+		}
+	}
+	container.Ports = append(container.Ports, corev1.ContainerPort{Name: name, ContainerPort: port})
+}
+
+// addMetricsServicePort exposes the metrics port on the Service under the name metrics,
+// so a ServiceMonitor can select it
+func addMetricsServicePort(taskJob *taskjobv1.TaskJob, service *corev1.Service) {
+	if taskJob.Spec.Metrics == nil {
+		return
+	}
+	port := getMetricsPort(taskJob)
+
+	if port == servicePort {
+		service.Spec.Ports[0].Name = metricsPortName
+		return
+	}
+	// Services with several ports need every port named
+	service.Spec.Ports[0].Name = "http"
+	service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+		Name:       metricsPortName,
+		Protocol:   corev1.ProtocolTCP,
+		Port:       port,
+		TargetPort: intstr.FromInt(int(port)),
+	})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// paramsHashAnnotation on the pod template makes pods roll when jobParams change
+	paramsHashAnnotation = "kubernetes.tjob.com/params-hash"
+
+	defaultParamsEnvPrefix = "PARAM_"
+	// paramsPrefixEnv and paramsKeysEnv tell task-job-service which env vars hold the params
+	paramsPrefixEnv        = "JOB_PARAMS_PREFIX"
+	paramsKeysEnv          = "JOB_PARAMS_KEYS"
+	defaultParamsMountPath = "/etc/task-job/params"
+	paramsVolumeName       = "job-params"
+)
+
+// getParamsDeliveryType returns the delivery type, empty for the legacy JOB_PARAMS format
+func getParamsDeliveryType(taskJob *taskjobv1.TaskJob) string {
+	if taskJob.Spec.ParamsDelivery == nil {
+		return ""
+	}
+	return taskJob.Spec.ParamsDelivery.Type
+}
+
+// getParamsEnv returns the env vars carrying jobParams for the configured delivery type
+func getParamsEnv(taskJob *taskjobv1.TaskJob) []corev1.EnvVar {
+	switch getParamsDeliveryType(taskJob) {
+	case taskjobv1.ParamsDeliveryEnv:
+		prefix := getParamsEnvPrefix(&taskJob.Spec)
+		var names []string
+		env := []corev1.EnvVar{{Name: paramsPrefixEnv, Value: prefix}, {Name: paramsKeysEnv}}
+		for _, key := range sortedParamKeys(taskJob.Spec.JobParams) {
+			names = append(names, toEnvName(key))
+			env = append(env, corev1.EnvVar{Name: prefix + toEnvName(key), Value: taskJob.Spec.JobParams[key]})
+		}
+		// only the declared names are read, so other env vars with the prefix aren't taken for params
+		env[1].Value = strings.Join(names, ",")
+		return env
+	case taskjobv1.ParamsDeliveryJSON:
+		// Marshalling a map[string]string can't fail, keys are sorted by encoding/json
+		data, _ := json.Marshal(taskJob.Spec.JobParams)
+		return []corev1.EnvVar{{Name: "JOB_PARAMS", Value: string(data)}}
+	case taskjobv1.ParamsDeliveryConfigMap:
+		return []corev1.EnvVar{{Name: "JOB_PARAMS_DIR", Value: getParamsMountPath(taskJob)}}
+	default:
+		return []corev1.EnvVar{{Name: "JOB_PARAMS", Value: fmt.Sprintf("%v", taskJob.Spec.JobParams)}}
+	}
+}
+
+// getParamsHash returns a stable hash of jobParams and their delivery settings
+func getParamsHash(taskJob *taskjobv1.TaskJob) string {
+	h := sha256.New()
+	if taskJob.Spec.ParamsDelivery != nil {
+		fmt.Fprintf(h, "%s|%s|%s\n", taskJob.Spec.ParamsDelivery.Type, taskJob.Spec.ParamsDelivery.EnvPrefix, taskJob.Spec.ParamsDelivery.MountPath)
+	}
+	for _, key := range sortedParamKeys(taskJob.Spec.JobParams) {
+		fmt.Fprintf(h, "%s=%s\n", key, taskJob.Spec.JobParams[key])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func getParamsMountPath(taskJob *taskjobv1.TaskJob) string {
+	if taskJob.Spec.ParamsDelivery != nil && taskJob.Spec.ParamsDelivery.MountPath != "" {
+		return taskJob.Spec.ParamsDelivery.MountPath
+	}
+	return defaultParamsMountPath
+}
+
+func getParamsConfigMapName(taskJob *taskjobv1.TaskJob) string {
+	return getJobName(taskJob) + "-params"
+}
+
+// addParamsVolume mounts the params ConfigMap into every container of the pod spec
+func addParamsVolume(taskJob *taskjobv1.TaskJob, podSpec *corev1.PodSpec) {
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: paramsVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: getParamsConfigMapName(taskJob)},
+			},
+		},
+	})
+	for i := range podSpec.Containers {
+		podSpec.Containers[i].VolumeMounts = append(podSpec.Containers[i].VolumeMounts, corev1.VolumeMount{
+			Name:      paramsVolumeName,
+			MountPath: getParamsMountPath(taskJob),
+			ReadOnly:  true,
+		})
+	}
+}
+
+func getParamsConfigMapObject(taskJob *taskjobv1.TaskJob) *corev1.ConfigMap {
+	data := make(map[string]string, len(taskJob.Spec.JobParams))
+	for k, v := range taskJob.Spec.JobParams {
+		data[k] = v
+	}
+
+	return &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getParamsConfigMapName(taskJob),
+			Namespace: taskJob.Namespace,
+			Labels:    map[string]string{"app": getJobName(taskJob)},
+		},
+		Data: data,
+	}
+}
+
+// getParamsEnvPrefix returns the prefix of the env vars holding jobParams with Env delivery
+func getParamsEnvPrefix(spec *taskjobv1.TaskJobSpec) string {
+	if spec.ParamsDelivery == nil || spec.ParamsDelivery.EnvPrefix == "" {
+		return defaultParamsEnvPrefix
+	}
+	return spec.ParamsDelivery.EnvPrefix
+}
+
+// getCollidingParamKeys returns the jobParams keys whose env var names are the same as those
+// of other keys, e.g. "max-retries" and "max_retries", or as JOB_PARAMS_PREFIX and JOB_PARAMS_KEYS
+func getCollidingParamKeys(spec *taskjobv1.TaskJobSpec) []string {
+	prefix := getParamsEnvPrefix(spec)
+	keys := sortedParamKeys(spec.JobParams)
+	counts := map[string]int{paramsPrefixEnv: 1, paramsKeysEnv: 1}
+	for _, key := range keys {
+		counts[prefix+toEnvName(key)]++
+	}
+	var colliding []string
+	for _, key := range keys {
+		if counts[prefix+toEnvName(key)] > 1 {
+			colliding = append(colliding, key)
+		}
+	}
+	return colliding
+}
+
+// getInvalidParamKeys returns the jobParams keys that can't be delivered: with ConfigMap
+// delivery the keys that can't be ConfigMap keys, and so can't be mounted as files, with Env
+// delivery the keys whose env var names collide
+func getInvalidParamKeys(taskJob *taskjobv1.TaskJob) []string {
+	switch getParamsDeliveryType(taskJob) {
+	case taskjobv1.ParamsDeliveryConfigMap:
+		var invalid []string
+		for _, key := range sortedParamKeys(taskJob.Spec.JobParams) {
+			if len(validation.IsConfigMapKey(key)) > 0 {
+				invalid = append(invalid, key)
+			}
+		}
+		return invalid
+	case taskjobv1.ParamsDeliveryEnv:
+		return getCollidingParamKeys(&taskJob.Spec)
+	}
+	return nil
+}
+
+// reconcileParamsConfigMap applies the params ConfigMap built from jobParams, and removes
+// it once the TaskJob no longer uses ConfigMap delivery. It returns false without an error
+// when jobParams can't be delivered, after recording why in the InvalidParams condition.
+func (r *TaskJobReconciler) reconcileParamsConfigMap(ctx context.Context, taskJob *taskjobv1.TaskJob) (bool, error) {
+	log := log.FromContext(ctx)
+	name := getParamsConfigMapName(taskJob)
+
+	if invalid := getInvalidParamKeys(taskJob); len(invalid) > 0 {
+		log.Info("jobParams keys can't be delivered", "keys", invalid)
+		message := fmt.Sprintf("jobParams keys %s must consist of alphanumeric characters, '-', '_' or '.'", strings.Join(invalid, ", "))
+		if getParamsDeliveryType(taskJob) == taskjobv1.ParamsDeliveryEnv {
+			message = fmt.Sprintf("jobParams keys %s map to the same env var names", strings.Join(invalid, ", "))
+		}
+		return false, r.setParamsCondition(ctx, taskJob, message)
+	}
+	if err := r.setParamsCondition(ctx, taskJob, ""); err != nil {
+		return false, err
+	}
+
+	if getParamsDeliveryType(taskJob) != taskjobv1.ParamsDeliveryConfigMap {
+		if err := r.deleteIfOwned(ctx, taskJob, &corev1.ConfigMap{}, name); err != nil {
+			return false, fmt.Errorf("couldn't delete configmap: %s", err)
+		}
+		return true, nil
+	}
+
+	desired := getParamsConfigMapObject(taskJob)
+	if err := controllerutil.SetControllerReference(taskJob, desired, r.scheme); err != nil {
+		return false, fmt.Errorf("couldn't set owner reference: %s", err)
+	}
+	if err := r.Patch(ctx, desired, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		return false, fmt.Errorf("couldn't apply configmap: %s", err)
+	}
+	log.Info("Applied params ConfigMap for TaskJob", "ConfigMap", name)
+	return true, nil
+}
+
+// setParamsCondition sets the InvalidParams condition with message, or removes it when
+// message is empty
+func (r *TaskJobReconciler) setParamsCondition(ctx context.Context, taskJob *taskjobv1.TaskJob, message string) error {
+	oldStatus := taskJob.Status.DeepCopy()
+	if message == "" {
+		meta.RemoveStatusCondition(&taskJob.Status.Conditions, taskjobv1.ConditionInvalidParams)
+	} else {
+		if taskJob.Status.State == "" {
+			setState(taskJob, "Pending")
+		}
+		setCondition(taskJob, taskjobv1.ConditionInvalidParams, metav1.ConditionTrue, "InvalidKey", message)
+	}
+	if equality.Semantic.DeepEqual(oldStatus, &taskJob.Status) {
+		return nil
+	}
+	if err := r.Status().Update(ctx, taskJob); err != nil {
+		return fmt.Errorf("couldn't update status: %s", err)
+	}
+	return nil
+}
+
+// toEnvName turns a param key into a valid env var name, e.g. "max-retries" -> "MAX_RETRIES"
+func toEnvName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+}
+
+func sortedParamKeys(params map[string]string) []string {
+	return slices.Sorted(maps.Keys(params))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+)
+
+func TestGetInvalidParamKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		delivery string
+		params   map[string]string
+		want     []string
+	}{
+		{name: "valid configmap keys", delivery: taskjobv1.ParamsDeliveryConfigMap, params: map[string]string{"max-retries": "3", "max_retries": "5"}},
+		{name: "invalid configmap key", delivery: taskjobv1.ParamsDeliveryConfigMap, params: map[string]string{"max retries": "3", "timeout": "10"}, want: []string{"max retries"}},
+		{name: "distinct env names", delivery: taskjobv1.ParamsDeliveryEnv, params: map[string]string{"max retries": "3", "timeout": "10"}},
+		{name: "colliding env names", delivery: taskjobv1.ParamsDeliveryEnv, params: map[string]string{"max-retries": "3", "max_retries": "5", "timeout": "10"}, want: []string{"max-retries", "max_retries"}},
+		{name: "colliding keys with JSON", delivery: taskjobv1.ParamsDeliveryJSON, params: map[string]string{"max-retries": "3", "max_retries": "5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskJob := newTaskJob("params")
+			taskJob.Spec.ParamsDelivery = &taskjobv1.ParamsDelivery{Type: tt.delivery}
+			taskJob.Spec.JobParams = tt.params
+			if got := getInvalidParamKeys(taskJob); !slices.Equal(got, tt.want) {
+				t.Errorf("getInvalidParamKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
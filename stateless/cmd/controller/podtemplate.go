@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// mergePodTemplate strategic-merges spec.podTemplate over the controller defaults, then
+// re-applies the fields the controller relies on so that they always win
+func mergePodTemplate(taskJob *taskjobv1.TaskJob, defaults corev1.PodTemplateSpec) (corev1.PodTemplateSpec, error) {
+	if taskJob.Spec.PodTemplate == nil {
+		return defaults, nil
+	}
+
+	// Unnamed containers customize the main container
+	override := taskJob.Spec.PodTemplate.DeepCopy()
+	for i := range override.Spec.Containers {
+		if override.Spec.Containers[i].Name == "" {
+			override.Spec.Containers[i].Name = getJobName(taskJob)
+		}
+	}
+
+	base, err := json.Marshal(defaults)
+	if err != nil {
+		return defaults, fmt.Errorf("couldn't encode pod template: %s", err)
+	}
+	patch, err := toPodTemplatePatch(override)
+	if err != nil {
+		return defaults, fmt.Errorf("couldn't encode spec.podTemplate: %s", err)
+	}
+	merged, err := strategicpatch.StrategicMergePatch(base, patch, corev1.PodTemplateSpec{})
+	if err != nil {
+		return defaults, fmt.Errorf("couldn't merge spec.podTemplate: %s", err)
+	}
+
+	var template corev1.PodTemplateSpec
+	if err := json.Unmarshal(merged, &template); err != nil {
+		return defaults, fmt.Errorf("couldn't decode merged pod template: %s", err)
+	}
+
+	enforceRequiredFields(&template, defaults)
+	return template, nil
+}
+
+// toPodTemplatePatch encodes the user template as a patch. Nulls are dropped since they
+// would delete fields of the defaults, e.g. a template without containers.
+func toPodTemplatePatch(template *corev1.PodTemplateSpec) ([]byte, error) {
+	data, err := json.Marshal(template)
+	if err != nil {
+		return nil, err
+	}
+	var patch map[string]interface{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	dropNulls(patch)
+	return json.Marshal(patch)
+}
+
+func dropNulls(obj map[string]interface{}) {
+	for k, v := range obj {
+		switch value := v.(type) {
+		case nil:
+			delete(obj, k)
+		case map[string]interface{}:
+			dropNulls(value)
+		case []interface{}:
+			for _, item := range value {
+				if m, ok := item.(map[string]interface{}); ok {
+					dropNulls(m)
+				}
+			}
+		}
+	}
+}
+
+// enforceRequiredFields copies labels, annotations, image and env vars of the main container
+// from the controller defaults into the merged template
+func enforceRequiredFields(template *corev1.PodTemplateSpec, defaults corev1.PodTemplateSpec) {
+	if template.Labels == nil {
+		template.Labels = map[string]string{}
+	}
+	for k, v := range defaults.Labels {
+		template.Labels[k] = v
+	}
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	for k, v := range defaults.Annotations {
+		template.Annotations[k] = v
+	}
+
+	main := defaults.Spec.Containers[0]
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if container.Name != main.Name {
+			continue
+		}
+		container.Image = main.Image
+		container.ImagePullPolicy = main.ImagePullPolicy
+		for _, env := range main.Env {
+			setEnvVar(container, env)
+		}
+	}
+}
+
+// setEnvVar adds the env var to the container, replacing any var with the same name
+func setEnvVar(container *corev1.Container, env corev1.EnvVar) {
+	for i := range container.Env {
+		if container.Env[i].Name == env.Name {
+			container.Env[i] = env
+			return
+		}
+	}
+	container.Env = append(container.Env, env)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// getDefaultReadinessProbe checks /readyz, which task-job-service fails while it can't take work
+func getDefaultReadinessProbe() *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{Path: "/readyz", Port: intstr.FromInt(int(servicePort))},
+		},
+		PeriodSeconds:    5,
+		FailureThreshold: 2,
+	}
+}
+
+// getDefaultLivenessProbe checks /healthz, which task-job-service serves as long as it runs
+func getDefaultLivenessProbe() *corev1.Probe {
+	return &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{Path: "/healthz", Port: intstr.FromInt(int(servicePort))},
+		},
+		InitialDelaySeconds: 5,
+		PeriodSeconds:       10,
+		FailureThreshold:    3,
+	}
+}
+
+// setProbes attaches the readiness and liveness probes to the main container. Probes from
+// spec.probes win over those from podTemplate, which win over the defaults.
+func setProbes(taskJob *taskjobv1.TaskJob, template *corev1.PodTemplateSpec) {
+	probes := taskJob.Spec.Probes
+	if probes == nil {
+		probes = &taskjobv1.Probes{}
+	}
+
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if container.Name != getJobName(taskJob) {
+			continue
+		}
+
+		switch {
+		case probes.Readiness != nil:
+			container.ReadinessProbe = probes.Readiness.DeepCopy()
+		case container.ReadinessProbe == nil && !probes.Disabled:
+			container.ReadinessProbe = getDefaultReadinessProbe()
+		}
+		switch {
+		case probes.Liveness != nil:
+			container.LivenessProbe = probes.Liveness.DeepCopy()
+		case container.LivenessProbe == nil && !probes.Disabled:
+			container.LivenessProbe = getDefaultLivenessProbe()
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSetProbes(t *testing.T) {
+	custom := &corev1.Probe{ProbeHandler: corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: []string{"true"}}}}
+	tests := []struct {
+		name          string
+		probes        *taskjobv1.Probes
+		podTemplate   *corev1.Probe
+		wantReadiness string
+		wantLiveness  string
+	}{
+		{name: "defaults", wantReadiness: "/readyz", wantLiveness: "/healthz"},
+		{name: "empty probes keep the defaults", probes: &taskjobv1.Probes{}, wantReadiness: "/readyz", wantLiveness: "/healthz"},
+		{name: "disabled", probes: &taskjobv1.Probes{Disabled: true}},
+		{name: "spec overrides", probes: &taskjobv1.Probes{Readiness: custom, Liveness: custom}, wantReadiness: "exec", wantLiveness: "exec"},
+		{name: "overrides apply when disabled", probes: &taskjobv1.Probes{Disabled: true, Liveness: custom}, wantLiveness: "exec"},
+		{name: "podTemplate readiness wins over the default", podTemplate: custom, wantReadiness: "exec", wantLiveness: "/healthz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskJob := newTaskJob("probes")
+			taskJob.Spec.Probes = tt.probes
+			template := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: getJobName(taskJob), ReadinessProbe: tt.podTemplate},
+				{Name: "sidecar"},
+			}}}
+
+			setProbes(taskJob, template)
+			main := template.Spec.Containers[0]
+			if got := probeTarget(main.ReadinessProbe); got != tt.wantReadiness {
+				t.Errorf("readiness probe = %q, want %q", got, tt.wantReadiness)
+			}
+			if got := probeTarget(main.LivenessProbe); got != tt.wantLiveness {
+				t.Errorf("liveness probe = %q, want %q", got, tt.wantLiveness)
+			}
+			if sidecar := template.Spec.Containers[1]; sidecar.ReadinessProbe != nil || sidecar.LivenessProbe != nil {
+				t.Error("probes were added to a sidecar")
+			}
+		})
+	}
+}
+
+// probeTarget returns the path of an HTTP probe, "exec" for other probes and "" for none
+func probeTarget(probe *corev1.Probe) string {
+	switch {
+	case probe == nil:
+		return ""
+	case probe.HTTPGet != nil:
+		return probe.HTTPGet.Path
+	default:
+		return "exec"
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strconv"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// defaultTerminationGracePeriod is the Kubernetes default
+	defaultTerminationGracePeriod int64 = 30
+	// preStopDelaySeconds keeps the pod serving while it is removed from the Service endpoints
+	preStopDelaySeconds int64 = 5
+	// shutdownMarginSeconds leaves time to report aborted jobs before the kubelet kills the pod
+	shutdownMarginSeconds int64 = 2
+)
+
+// setGracefulShutdown gives the pod a preStop delay and a termination grace period, and tells
+// task-job-service how long it may drain jobs after SIGTERM. The delay uses the kubelet's
+// sleep action, so images without a sleep binary work too. A grace period or preStop hook set
+// through podTemplate is kept.
+func setGracefulShutdown(taskJob *taskjobv1.TaskJob, template *corev1.PodTemplateSpec) {
+	if template.Spec.TerminationGracePeriodSeconds == nil {
+		grace := defaultTerminationGracePeriod
+		template.Spec.TerminationGracePeriodSeconds = &grace
+	}
+
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if container.Name != getJobName(taskJob) {
+			continue
+		}
+		if container.Lifecycle == nil || container.Lifecycle.PreStop == nil {
+			if container.Lifecycle == nil {
+				container.Lifecycle = &corev1.Lifecycle{}
+			}
+			container.Lifecycle.PreStop = &corev1.LifecycleHandler{
+				Sleep: &corev1.SleepAction{Seconds: preStopDelaySeconds},
+			}
+		}
+	}
+	setShutdownGracePeriod(taskJob, template)
+}
+
+// setShutdownGracePeriod sets SHUTDOWN_GRACE_PERIOD from the pod's terminationGracePeriodSeconds,
+// minus the preStop sleep, which counts against the grace period, and a margin
+func setShutdownGracePeriod(taskJob *taskjobv1.TaskJob, template *corev1.PodTemplateSpec) {
+	grace := defaultTerminationGracePeriod
+	if template.Spec.TerminationGracePeriodSeconds != nil {
+		grace = *template.Spec.TerminationGracePeriodSeconds
+	}
+
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if container.Name != getJobName(taskJob) {
+			continue
+		}
+		drain := grace - shutdownMarginSeconds
+		if container.Lifecycle != nil && container.Lifecycle.PreStop != nil && container.Lifecycle.PreStop.Sleep != nil {
+			drain -= container.Lifecycle.PreStop.Sleep.Seconds
+		}
+		setEnvVar(container, corev1.EnvVar{Name: "SHUTDOWN_GRACE_PERIOD", Value: strconv.FormatInt(max(drain, 0), 10)})
+	}
+}
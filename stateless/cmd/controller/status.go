@@ -0,0 +1,30 @@
+package main
+
+import (
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// setState sets the TaskJob state and records when it last changed
+func setState(taskJob *taskjobv1.TaskJob, state string) {
+	if taskJob.Status.State == state {
+		return
+	}
+	now := metav1.Now()
+	taskJob.Status.State = state
+	taskJob.Status.LastTransitionTime = &now
+}
+
+// setCondition sets a condition on the TaskJob for its current generation.
+// The transition time only moves when the condition status changes.
+func setCondition(taskJob *taskjobv1.TaskJob, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&taskJob.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: taskJob.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	"github.com/robfig/cron/v3"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// imagePattern matches image references like "task-job:latest",
+// "registry.local:5000/team/task-job:v1" or "task-job@sha256:<digest>"
+var imagePattern = regexp.MustCompile(`^([a-zA-Z0-9.-]+(:[0-9]+)?/)?[a-z0-9]+([._-]+[a-z0-9]+)*(/[a-z0-9]+([._-]+[a-z0-9]+)*)*(:[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?(@sha256:[a-f0-9]{64})?$`)
+
+// setupWebhooks registers the TaskJob and CronTaskJob webhooks with the manager's webhook server
+func setupWebhooks(mgr ctrl.Manager) error {
+	err := ctrl.NewWebhookManagedBy(mgr).
+		For(&taskjobv1.TaskJob{}).
+		WithDefaulter(&TaskJobDefaulter{}).
+		WithValidator(&TaskJobValidator{}).
+		Complete()
+	if err != nil {
+		return err
+	}
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&taskjobv1.CronTaskJob{}).
+		WithValidator(&CronTaskJobValidator{}).
+		Complete()
+}
+
+// TaskJobDefaulter fills in the optional fields of a TaskJob on admission
+type TaskJobDefaulter struct{}
+
+// Default sets jobName and imagePullPolicy when they are not given, and replicas when a
+// TaskJob is created without them
+func (d *TaskJobDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	taskJob, ok := obj.(*taskjobv1.TaskJob)
+	if !ok {
+		return fmt.Errorf("expected a TaskJob but got %T", obj)
+	}
+
+	if taskJob.Spec.JobName == "" {
+		taskJob.Spec.JobName = taskJob.Name
+	}
+	if taskJob.Spec.ImagePullPolicy == "" {
+		taskJob.Spec.ImagePullPolicy = string(corev1.PullIfNotPresent)
+	}
+	// replicas isn't a pointer, so 0 is treated as unset on creation only, which lets
+	// updates scale a TaskJob down to 0
+	if taskJob.Spec.Replicas == 0 && isCreate(ctx) {
+		taskJob.Spec.Replicas = 1
+	}
+	return nil
+}
+
+// isCreate tells whether the admission request being handled creates the object
+func isCreate(ctx context.Context) bool {
+	req, err := admission.RequestFromContext(ctx)
+	return err == nil && req.Operation == admissionv1.Create
+}
+
+// TaskJobValidator rejects invalid TaskJobs on admission
+type TaskJobValidator struct{}
+
+// ValidateCreate validates a new TaskJob
+func (v *TaskJobValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	taskJob, ok := obj.(*taskjobv1.TaskJob)
+	if !ok {
+		return nil, fmt.Errorf("expected a TaskJob but got %T", obj)
+	}
+	errs := validateTaskJobSpec(&taskJob.Spec, field.NewPath("spec"))
+	errs = append(errs, validateDatabaseRefNamespace(&taskJob.Spec, taskJob.Namespace, field.NewPath("spec"))...)
+	return nil, toInvalidError(taskJob, errs)
+}
+
+// ValidateUpdate validates a changed TaskJob; jobName can't change since it names the children
+func (v *TaskJobValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	oldTaskJob, ok := oldObj.(*taskjobv1.TaskJob)
+	if !ok {
+		return nil, fmt.Errorf("expected a TaskJob but got %T", oldObj)
+	}
+	taskJob, ok := newObj.(*taskjobv1.TaskJob)
+	if !ok {
+		return nil, fmt.Errorf("expected a TaskJob but got %T", newObj)
+	}
+
+	errs := validateTaskJobSpec(&taskJob.Spec, field.NewPath("spec"))
+	errs = append(errs, validateDatabaseRefNamespace(&taskJob.Spec, taskJob.Namespace, field.NewPath("spec"))...)
+	if getJobName(oldTaskJob) != getJobName(taskJob) {
+		errs = append(errs, field.Forbidden(field.NewPath("spec", "jobName"), "field is immutable"))
+	}
+	return nil, toInvalidError(taskJob, errs)
+}
+
+// ValidateDelete allows every deletion
+func (v *TaskJobValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validateTaskJobSpec checks the fields that would otherwise only fail when the children are created
+func validateTaskJobSpec(spec *taskjobv1.TaskJobSpec, specPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	if spec.JobName != "" {
+		for _, msg := range validation.IsDNS1123Label(spec.JobName) {
+			errs = append(errs, field.Invalid(specPath.Child("jobName"), spec.JobName, msg))
+		}
+	}
+
+	if spec.Image == "" {
+		errs = append(errs, field.Required(specPath.Child("image"), "image must be set"))
+	} else if !imagePattern.MatchString(spec.Image) {
+		errs = append(errs, field.Invalid(specPath.Child("image"), spec.Image, "not a valid image reference"))
+	}
+
+	switch corev1.PullPolicy(spec.ImagePullPolicy) {
+	case "", corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		errs = append(errs, field.NotSupported(specPath.Child("imagePullPolicy"), spec.ImagePullPolicy,
+			[]string{string(corev1.PullAlways), string(corev1.PullIfNotPresent), string(corev1.PullNever)}))
+	}
+
+	if spec.Replicas < 0 {
+		errs = append(errs, field.Invalid(specPath.Child("replicas"), spec.Replicas, "must be greater than or equal to 0"))
+	}
+
+	switch spec.Mode {
+	case "", taskjobv1.ModeService, taskjobv1.ModeBatch:
+	default:
+		errs = append(errs, field.NotSupported(specPath.Child("mode"), spec.Mode, []string{taskjobv1.ModeService, taskjobv1.ModeBatch}))
+	}
+	if spec.Completions != nil && *spec.Completions < 1 {
+		errs = append(errs, field.Invalid(specPath.Child("completions"), *spec.Completions, "must be greater than or equal to 1"))
+	}
+	if spec.Parallelism != nil && *spec.Parallelism < 0 {
+		errs = append(errs, field.Invalid(specPath.Child("parallelism"), *spec.Parallelism, "must be greater than or equal to 0"))
+	}
+	if spec.BackoffLimit != nil && *spec.BackoffLimit < 0 {
+		errs = append(errs, field.Invalid(specPath.Child("backoffLimit"), *spec.BackoffLimit, "must be greater than or equal to 0"))
+	}
+
+	if spec.ParamsDelivery != nil {
+		switch spec.ParamsDelivery.Type {
+		case taskjobv1.ParamsDeliveryEnv, taskjobv1.ParamsDeliveryJSON, taskjobv1.ParamsDeliveryConfigMap:
+		default:
+			errs = append(errs, field.NotSupported(specPath.Child("paramsDelivery", "type"), spec.ParamsDelivery.Type,
+				[]string{taskjobv1.ParamsDeliveryEnv, taskjobv1.ParamsDeliveryJSON, taskjobv1.ParamsDeliveryConfigMap}))
+		}
+		// ConfigMap delivery mounts one file per key, so keys must be valid ConfigMap keys
+		if spec.ParamsDelivery.Type == taskjobv1.ParamsDeliveryConfigMap {
+			for _, key := range sortedParamKeys(spec.JobParams) {
+				for _, msg := range validation.IsConfigMapKey(key) {
+					errs = append(errs, field.Invalid(specPath.Child("jobParams").Key(key), key, msg))
+				}
+			}
+		}
+		// Env delivery turns keys into env var names, which must stay distinct
+		if spec.ParamsDelivery.Type == taskjobv1.ParamsDeliveryEnv {
+			prefix := getParamsEnvPrefix(spec)
+			for _, key := range getCollidingParamKeys(spec) {
+				errs = append(errs, field.Invalid(specPath.Child("jobParams").Key(key), key,
+					fmt.Sprintf("env var name %s is also used by another key or by JOB_PARAMS_PREFIX or JOB_PARAMS_KEYS", prefix+toEnvName(key))))
+			}
+		}
+	}
+
+	if spec.DatabaseRef != nil {
+		refPath := specPath.Child("databaseRef")
+		if spec.DatabaseRef.Name == "" {
+			errs = append(errs, field.Required(refPath.Child("name"), "name must be set"))
+		} else {
+			for _, msg := range validation.IsDNS1123Subdomain(spec.DatabaseRef.Name) {
+				errs = append(errs, field.Invalid(refPath.Child("name"), spec.DatabaseRef.Name, msg))
+			}
+		}
+		if spec.DatabaseRef.Namespace != "" {
+			for _, msg := range validation.IsDNS1123Label(spec.DatabaseRef.Namespace) {
+				errs = append(errs, field.Invalid(refPath.Child("namespace"), spec.DatabaseRef.Namespace, msg))
+			}
+		}
+	}
+
+	if spec.Metrics != nil {
+		if spec.Metrics.Port != 0 {
+			for _, msg := range validation.IsValidPortNum(int(spec.Metrics.Port)) {
+				errs = append(errs, field.Invalid(specPath.Child("metrics", "port"), spec.Metrics.Port, msg))
+			}
+		}
+		if spec.Metrics.Path != "" && !strings.HasPrefix(spec.Metrics.Path, "/") {
+			errs = append(errs, field.Invalid(specPath.Child("metrics", "path"), spec.Metrics.Path, "must start with /"))
+		}
+	}
+
+	if spec.Probes != nil {
+		errs = append(errs, validateProbe(spec.Probes.Readiness, specPath.Child("probes", "readiness"))...)
+		errs = append(errs, validateProbe(spec.Probes.Liveness, specPath.Child("probes", "liveness"))...)
+	}
+
+	return errs
+}
+
+// validateDatabaseRefNamespace only allows Databases in the namespace of the TaskJob, whose
+// pods read the Database's Secrets
+func validateDatabaseRefNamespace(spec *taskjobv1.TaskJobSpec, namespace string, specPath *field.Path) field.ErrorList {
+	if spec.DatabaseRef == nil || spec.DatabaseRef.Namespace == "" || spec.DatabaseRef.Namespace == namespace {
+		return nil
+	}
+	return field.ErrorList{field.Invalid(specPath.Child("databaseRef", "namespace"), spec.DatabaseRef.Namespace,
+		"must be empty or the namespace of the TaskJob")}
+}
+
+// validateProbe requires exactly one handler, which the Deployment would otherwise reject
+func validateProbe(probe *corev1.Probe, path *field.Path) field.ErrorList {
+	if probe == nil {
+		return nil
+	}
+	handlers := 0
+	if probe.Exec != nil {
+		handlers++
+	}
+	if probe.HTTPGet != nil {
+		handlers++
+	}
+	if probe.TCPSocket != nil {
+		handlers++
+	}
+	if probe.GRPC != nil {
+		handlers++
+	}
+	if handlers != 1 {
+		return field.ErrorList{field.Invalid(path, "", "must specify exactly one of exec, httpGet, tcpSocket or grpc")}
+	}
+	return nil
+}
+
+func toInvalidError(taskJob *taskjobv1.TaskJob, errs field.ErrorList) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return k8serrors.NewInvalid(schema.GroupKind{Group: taskjobv1.GroupName, Kind: "TaskJob"}, taskJob.Name, errs)
+}
+
+// CronTaskJobValidator rejects invalid CronTaskJobs on admission
+type CronTaskJobValidator struct{}
+
+// ValidateCreate validates a new CronTaskJob
+func (v *CronTaskJobValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	cronTaskJob, ok := obj.(*taskjobv1.CronTaskJob)
+	if !ok {
+		return nil, fmt.Errorf("expected a CronTaskJob but got %T", obj)
+	}
+	return nil, toCronInvalidError(cronTaskJob, validateCronTaskJobSpec(cronTaskJob))
+}
+
+// ValidateUpdate validates a changed CronTaskJob
+func (v *CronTaskJobValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	cronTaskJob, ok := newObj.(*taskjobv1.CronTaskJob)
+	if !ok {
+		return nil, fmt.Errorf("expected a CronTaskJob but got %T", newObj)
+	}
+	return nil, toCronInvalidError(cronTaskJob, validateCronTaskJobSpec(cronTaskJob))
+}
+
+// ValidateDelete allows every deletion
+func (v *CronTaskJobValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validateCronTaskJobSpec checks the schedule and the template of the runs. Runs must complete,
+// since the concurrency policy waits for them, so Service mode is rejected.
+func validateCronTaskJobSpec(cronTaskJob *taskjobv1.CronTaskJob) field.ErrorList {
+	var errs field.ErrorList
+	spec := &cronTaskJob.Spec
+	specPath := field.NewPath("spec")
+
+	if _, err := cron.ParseStandard(spec.Schedule); err != nil {
+		errs = append(errs, field.Invalid(specPath.Child("schedule"), spec.Schedule, err.Error()))
+	}
+	if spec.JobTemplate.Mode == taskjobv1.ModeService {
+		errs = append(errs, field.NotSupported(specPath.Child("jobTemplate", "mode"), spec.JobTemplate.Mode, []string{taskjobv1.ModeBatch}))
+	}
+	errs = append(errs, validateTaskJobSpec(&spec.JobTemplate, specPath.Child("jobTemplate"))...)
+	errs = append(errs, validateDatabaseRefNamespace(&spec.JobTemplate, cronTaskJob.Namespace, specPath.Child("jobTemplate"))...)
+	return errs
+}
+
+func toCronInvalidError(cronTaskJob *taskjobv1.CronTaskJob, errs field.ErrorList) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return k8serrors.NewInvalid(schema.GroupKind{Group: taskjobv1.GroupName, Kind: "CronTaskJob"}, cronTaskJob.Name, errs)
+}
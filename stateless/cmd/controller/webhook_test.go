@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	taskjobv1 "k8s-job-operator/stateless/api/v1"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func admissionContext(op admissionv1.Operation) context.Context {
+	return admission.NewContextWithRequest(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{Operation: op},
+	})
+}
+
+func newTaskJob(name string) *taskjobv1.TaskJob {
+	return &taskjobv1.TaskJob{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       taskjobv1.TaskJobSpec{Image: "task-job:latest"},
+	}
+}
+
+func TestDefaultReplicas(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       admissionv1.Operation
+		replicas int
+		want     int
+	}{
+		{name: "create without replicas", op: admissionv1.Create, replicas: 0, want: 1},
+		{name: "create with replicas", op: admissionv1.Create, replicas: 3, want: 3},
+		{name: "update to zero replicas", op: admissionv1.Update, replicas: 0, want: 0},
+		{name: "update with replicas", op: admissionv1.Update, replicas: 2, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskJob := newTaskJob("defaults")
+			taskJob.Spec.Replicas = tt.replicas
+			if err := (&TaskJobDefaulter{}).Default(admissionContext(tt.op), taskJob); err != nil {
+				t.Fatalf("Default() error = %v", err)
+			}
+			if taskJob.Spec.Replicas != tt.want {
+				t.Errorf("replicas = %d, want %d", taskJob.Spec.Replicas, tt.want)
+			}
+			if taskJob.Spec.JobName != "defaults" {
+				t.Errorf("jobName = %q, want %q", taskJob.Spec.JobName, "defaults")
+			}
+			if taskJob.Spec.ImagePullPolicy != "IfNotPresent" {
+				t.Errorf("imagePullPolicy = %q, want IfNotPresent", taskJob.Spec.ImagePullPolicy)
+			}
+		})
+	}
+}
+
+func TestValidateTaskJob(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(*taskjobv1.TaskJob)
+		wantErr bool
+	}{
+		{name: "valid", mutate: func(tj *taskjobv1.TaskJob) {}},
+		{name: "missing image", mutate: func(tj *taskjobv1.TaskJob) { tj.Spec.Image = "" }, wantErr: true},
+		{name: "malformed image", mutate: func(tj *taskjobv1.TaskJob) { tj.Spec.Image = "Task Job" }, wantErr: true},
+		{name: "invalid jobName", mutate: func(tj *taskjobv1.TaskJob) { tj.Spec.JobName = "Task_Job" }, wantErr: true},
+		{name: "negative replicas", mutate: func(tj *taskjobv1.TaskJob) { tj.Spec.Replicas = -1 }, wantErr: true},
+		{name: "unknown mode", mutate: func(tj *taskjobv1.TaskJob) { tj.Spec.Mode = "Daemon" }, wantErr: true},
+		{name: "invalid configmap param key", mutate: func(tj *taskjobv1.TaskJob) {
+			tj.Spec.ParamsDelivery = &taskjobv1.ParamsDelivery{Type: taskjobv1.ParamsDeliveryConfigMap}
+			tj.Spec.JobParams = map[string]string{"max retries": "3"}
+		}, wantErr: true},
+		{name: "env param key with space", mutate: func(tj *taskjobv1.TaskJob) {
+			tj.Spec.ParamsDelivery = &taskjobv1.ParamsDelivery{Type: taskjobv1.ParamsDeliveryEnv}
+			tj.Spec.JobParams = map[string]string{"max retries": "3"}
+		}},
+		{name: "env param keys with the same env var name", mutate: func(tj *taskjobv1.TaskJob) {
+			tj.Spec.ParamsDelivery = &taskjobv1.ParamsDelivery{Type: taskjobv1.ParamsDeliveryEnv}
+			tj.Spec.JobParams = map[string]string{"max-retries": "3", "max_retries": "5"}
+		}, wantErr: true},
+		{name: "env param key named like the prefix var", mutate: func(tj *taskjobv1.TaskJob) {
+			tj.Spec.ParamsDelivery = &taskjobv1.ParamsDelivery{Type: taskjobv1.ParamsDeliveryEnv, EnvPrefix: "JOB_"}
+			tj.Spec.JobParams = map[string]string{"params-prefix": "x"}
+		}, wantErr: true},
+		{name: "env param key named like the keys var", mutate: func(tj *taskjobv1.TaskJob) {
+			tj.Spec.ParamsDelivery = &taskjobv1.ParamsDelivery{Type: taskjobv1.ParamsDeliveryEnv, EnvPrefix: "JOB_PARAMS_"}
+			tj.Spec.JobParams = map[string]string{"keys": "x"}
+		}, wantErr: true},
+		{name: "json param keys with the same env var name", mutate: func(tj *taskjobv1.TaskJob) {
+			tj.Spec.ParamsDelivery = &taskjobv1.ParamsDelivery{Type: taskjobv1.ParamsDeliveryJSON}
+			tj.Spec.JobParams = map[string]string{"max-retries": "3", "max_retries": "5"}
+		}},
+		{name: "database in the same namespace", mutate: func(tj *taskjobv1.TaskJob) {
+			tj.Spec.DatabaseRef = &taskjobv1.DatabaseRef{Name: "postgres-db", Namespace: "default"}
+		}},
+		{name: "database in another namespace", mutate: func(tj *taskjobv1.TaskJob) {
+			tj.Spec.DatabaseRef = &taskjobv1.DatabaseRef{Name: "postgres-db", Namespace: "other"}
+		}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskJob := newTaskJob("validate")
+			tt.mutate(taskJob)
+			_, err := (&TaskJobValidator{}).ValidateCreate(context.Background(), taskJob)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCreate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateJobNameImmutable(t *testing.T) {
+	oldTaskJob := newTaskJob("immutable")
+	taskJob := oldTaskJob.DeepCopyObject().(*taskjobv1.TaskJob)
+	taskJob.Spec.JobName = "renamed"
+	if _, err := (&TaskJobValidator{}).ValidateUpdate(context.Background(), oldTaskJob, taskJob); err == nil {
+		t.Error("ValidateUpdate() allowed a jobName change")
+	}
+}
+
+func TestValidateCronTaskJob(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule string
+		mode     string
+		wantErr  bool
+	}{
+		{name: "batch", schedule: "*/5 * * * *", mode: taskjobv1.ModeBatch},
+		{name: "default mode", schedule: "0 2 * * *"},
+		{name: "service mode", schedule: "0 2 * * *", mode: taskjobv1.ModeService, wantErr: true},
+		{name: "invalid schedule", schedule: "every minute", mode: taskjobv1.ModeBatch, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cronTaskJob := &taskjobv1.CronTaskJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "cron", Namespace: "default"},
+				Spec: taskjobv1.CronTaskJobSpec{
+					Schedule:    tt.schedule,
+					JobTemplate: taskjobv1.TaskJobSpec{Image: "task-job:latest", Mode: tt.mode},
+				},
+			}
+			_, err := (&CronTaskJobValidator{}).ValidateCreate(context.Background(), cronTaskJob)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCreate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestWebhooks serves the webhooks to a local API server started by envtest, which needs the
+// binaries from setup-envtest in KUBEBUILDER_ASSETS
+func TestWebhooks(t *testing.T) {
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("KUBEBUILDER_ASSETS isn't set, see setup-envtest")
+	}
+	testEnv := &envtest.Environment{
+		CRDInstallOptions: envtest.CRDInstallOptions{
+			Paths:              []string{filepath.Join("..", "..", "..", "k8s", "crd.yaml"), filepath.Join("..", "..", "..", "k8s", "crd-crontaskjob.yaml")},
+			ErrorIfPathMissing: true,
+		},
+		WebhookInstallOptions: envtest.WebhookInstallOptions{
+			Paths: []string{filepath.Join("..", "..", "..", "k8s", "taskjob-webhook.yaml")},
+		},
+	}
+	cfg, err := testEnv.Start()
+	if err != nil {
+		t.Fatalf("couldn't start envtest: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := testEnv.Stop(); err != nil {
+			t.Errorf("couldn't stop envtest: %v", err)
+		}
+	})
+
+	webhookOptions := &testEnv.WebhookInstallOptions
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:  scheme,
+		Metrics: metricsserver.Options{BindAddress: "0"},
+		WebhookServer: webhook.NewServer(webhook.Options{
+			Host:    webhookOptions.LocalServingHost,
+			Port:    webhookOptions.LocalServingPort,
+			CertDir: webhookOptions.LocalServingCertDir,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("couldn't create manager: %v", err)
+	}
+	if err := setupWebhooks(mgr); err != nil {
+		t.Fatalf("couldn't set up webhooks: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		if err := mgr.Start(ctx); err != nil {
+			t.Errorf("manager stopped: %v", err)
+		}
+	}()
+
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		t.Fatalf("couldn't create client: %v", err)
+	}
+	// The API server fails admission until the webhook server is up
+	taskJob := newTaskJob("envtest")
+	deadline := time.Now().Add(30 * time.Second)
+	for err = c.Create(ctx, taskJob); err != nil && !k8serrors.IsInvalid(err) && time.Now().Before(deadline); err = c.Create(ctx, taskJob) {
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("couldn't create TaskJob: %v", err)
+	}
+
+	t.Run("defaults on create", func(t *testing.T) {
+		if taskJob.Spec.Replicas != 1 || taskJob.Spec.JobName != "envtest" || taskJob.Spec.ImagePullPolicy != "IfNotPresent" {
+			t.Errorf("got replicas=%d jobName=%q imagePullPolicy=%q", taskJob.Spec.Replicas, taskJob.Spec.JobName, taskJob.Spec.ImagePullPolicy)
+		}
+	})
+
+	t.Run("keeps zero replicas on update", func(t *testing.T) {
+		taskJob.Spec.Replicas = 0
+		if err := c.Update(ctx, taskJob); err != nil {
+			t.Fatalf("couldn't update TaskJob: %v", err)
+		}
+		if taskJob.Spec.Replicas != 0 {
+			t.Errorf("replicas = %d, want 0", taskJob.Spec.Replicas)
+		}
+	})
+
+	t.Run("rejects jobName change", func(t *testing.T) {
+		changed := taskJob.DeepCopyObject().(*taskjobv1.TaskJob)
+		changed.Spec.JobName = "renamed"
+		if err := c.Update(ctx, changed); !k8serrors.IsInvalid(err) {
+			t.Errorf("Update() error = %v, want Invalid", err)
+		}
+	})
+
+	t.Run("rejects invalid TaskJob", func(t *testing.T) {
+		invalid := newTaskJob("invalid")
+		invalid.Spec.Image = "Task Job"
+		if err := c.Create(ctx, invalid); !k8serrors.IsInvalid(err) {
+			t.Errorf("Create() error = %v, want Invalid", err)
+		}
+	})
+
+	t.Run("rejects Service-mode CronTaskJob", func(t *testing.T) {
+		cronTaskJob := &taskjobv1.CronTaskJob{
+			ObjectMeta: metav1.ObjectMeta{Name: "service-cron", Namespace: "default"},
+			Spec: taskjobv1.CronTaskJobSpec{
+				Schedule:    "*/5 * * * *",
+				JobTemplate: taskjobv1.TaskJobSpec{Image: "task-job:latest", Mode: taskjobv1.ModeService},
+			},
+		}
+		if err := c.Create(ctx, cronTaskJob); !k8serrors.IsInvalid(err) {
+			t.Errorf("Create() error = %v, want Invalid", err)
+		}
+	})
+}
@@ -3,6 +3,7 @@ module k8s-job-operator/stateless
 go 1.23.1
 
 require (
+	github.com/robfig/cron/v3 v3.0.1
 	go.uber.org/zap v1.27.0
 	k8s.io/api v0.32.0
 	k8s.io/apimachinery v0.32.1
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// submitRequest is the body of POST /jobs
+type submitRequest struct {
+	// Handler names the job handler, defaulting to JOB_NAME and sleep otherwise
+	Handler string            `json:"handler"`
+	Params  map[string]string `json:"params"`
+}
+
+// submitJobHandler queues a job and returns its ID right away
+func submitJobHandler(w http.ResponseWriter, r *http.Request) {
+	var req submitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Handler == "" {
+		req.Handler = defaultHandlerName()
+	}
+
+	job, err := jobQueue.Submit(req.Handler, req.Params)
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+
+	log.Printf("Queued %s job %s", job.Handler, job.ID)
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// getJobHandler returns the status and result of a job
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := jobQueue.Get(r.PathValue("id"))
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// cancelJobHandler cancels a queued or running job
+func cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := jobQueue.Cancel(r.PathValue("id"))
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	log.Printf("Cancelled job %s", job.ID)
+	writeJSON(w, http.StatusOK, job)
+}
+
+// listJobsHandler returns all known jobs
+func listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	jobs, err := jobQueue.List()
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// listHandlersHandler returns the registered job handlers and their parameter schemas
+func listHandlersHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]*JobHandler, 0, len(handlers))
+	for _, name := range handlerNames() {
+		list = append(list, handlers[name])
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// healthzHandler reports that the service is up
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler fails while the service can't take new jobs
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case jobQueue.Draining():
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+	case jobQueue.Saturated():
+		http.Error(w, "worker pool saturated", http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+func writeQueueError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidJob):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errQueueFull), errors.Is(err, errShuttingDown):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, errJobNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errJobFinished):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
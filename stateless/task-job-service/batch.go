@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxTerminationMessage is the size limit Kubernetes puts on termination messages
+const maxTerminationMessage = 4096
+
+// runBatch runs the JOB_NAME job with the params of the TaskJob once and returns the exit code
+func runBatch() int {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	// On SIGTERM the job gets shutdownGracePeriod to finish before it is cancelled
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+		case <-ctx.Done():
+			return
+		}
+		log.Printf("Shutting down, letting the job finish for up to %s", shutdownGracePeriod)
+		select {
+		case <-time.After(shutdownGracePeriod):
+			cancel(errAborted)
+		case <-ctx.Done():
+		}
+	}()
+
+	handler, err := lookupHandler(defaultHandlerName())
+	if err != nil {
+		return finishBatch("", err)
+	}
+	params, err := loadJobParams(handler)
+	if err != nil {
+		return finishBatch("", fmt.Errorf("couldn't read job params: %v", err))
+	}
+	validated, err := handler.Validate(params)
+	if err != nil {
+		return finishBatch("", err)
+	}
+
+	log.Printf("Executing %s job in batch mode", handler.Name)
+	result, err := handler.Run(ctx, validated)
+	if err != nil && ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+	return finishBatch(result, err)
+}
+
+// finishBatch logs the outcome, writes it as the termination message and returns the exit code
+func finishBatch(result string, err error) int {
+	message, code := result, 0
+	if err != nil {
+		message, code = err.Error(), 1
+		log.Printf("Job failed: %s", message)
+	} else {
+		log.Printf("Job succeeded: %s", message)
+	}
+
+	if len(message) > maxTerminationMessage {
+		message = message[:maxTerminationMessage]
+	}
+	if werr := os.WriteFile(terminationLogPath, []byte(message), 0644); werr != nil {
+		log.Printf("Failed to write termination message to %s: %v", terminationLogPath, werr)
+	}
+	return code
+}
+
+// loadJobParams reads params from the files in JOB_PARAMS_DIR, from JOB_PARAMS, or from the
+// env vars starting with JOB_PARAMS_PREFIX (PARAM_ by default) named in JOB_PARAMS_KEYS
+func loadJobParams(handler *JobHandler) (map[string]string, error) {
+	if dir := os.Getenv("JOB_PARAMS_DIR"); dir != "" {
+		return readParamsDir(dir)
+	}
+	if value, ok := os.LookupEnv("JOB_PARAMS"); ok {
+		return parseJobParams(value)
+	}
+	prefix := os.Getenv("JOB_PARAMS_PREFIX")
+	if prefix == "" {
+		prefix = "PARAM_"
+	}
+	return readParamsEnv(handler, os.Environ(), prefix, strings.Split(os.Getenv("JOB_PARAMS_KEYS"), ",")), nil
+}
+
+// readParamsEnv reads the params delivered as one env var per key. Only the names the
+// controller declared are read, so env vars Kubernetes adds, e.g. <SERVICE>_SERVICE_HOST, are
+// never taken for params. The controller upper-cases the keys and replaces other characters
+// with _, so names are matched against the handler's params the same way, e.g.
+// PARAM_CONTENTTYPE is contentType. Unknown names are lower-cased.
+func readParamsEnv(handler *JobHandler, environ []string, prefix string, names []string) map[string]string {
+	env := map[string]string{}
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		env[name] = value
+	}
+
+	params := map[string]string{}
+	for _, envName := range names {
+		value, ok := env[prefix+envName]
+		if envName == "" || !ok {
+			continue
+		}
+		key := strings.ToLower(envName)
+		for _, spec := range handler.Params {
+			if toEnvName(spec.Name) == envName {
+				key = spec.Name
+				break
+			}
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// toEnvName matches the controller's env var naming, e.g. "max-retries" -> "MAX_RETRIES"
+func toEnvName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+}
+
+// parseJobParams accepts a JSON object or the legacy "map[k1:v1 k2:v2]" format
+func parseJobParams(value string) (map[string]string, error) {
+	value = strings.TrimSpace(value)
+	params := map[string]string{}
+
+	switch {
+	case value == "":
+		return params, nil
+	case strings.HasPrefix(value, "{"):
+		if err := json.Unmarshal([]byte(value), &params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	case strings.HasPrefix(value, "map[") && strings.HasSuffix(value, "]"):
+		// Values may contain spaces, so a field without a colon continues the previous value
+		var last string
+		for _, field := range strings.Fields(strings.TrimSuffix(strings.TrimPrefix(value, "map["), "]")) {
+			k, v, ok := strings.Cut(field, ":")
+			if !ok {
+				if last == "" {
+					return nil, fmt.Errorf("unexpected %q in %q", field, value)
+				}
+				params[last] += " " + field
+				continue
+			}
+			params[k] = v
+			last = k
+		}
+		return params, nil
+	default:
+		return nil, fmt.Errorf("expected a JSON object or map[key:value ...], got %q", value)
+	}
+}
+
+// readParamsDir reads a mounted params ConfigMap, one file per key
+func readParamsDir(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	params := map[string]string{}
+	for _, entry := range entries {
+		// ConfigMap volumes keep their data behind ..data and dot-prefixed symlinks
+		if strings.HasPrefix(entry.Name(), ".") || entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		params[entry.Name()] = string(data)
+	}
+	return params, nil
+}
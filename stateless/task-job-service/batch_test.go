@@ -0,0 +1,95 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParseJobParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", value: "", want: map[string]string{}},
+		{name: "blank", value: "  \n", want: map[string]string{}},
+		{name: "json", value: `{"url":"http://example.com","method":"POST"}`, want: map[string]string{"url": "http://example.com", "method": "POST"}},
+		{name: "json with spaces and colons", value: ` {"command":"echo a: b"} `, want: map[string]string{"command": "echo a: b"}},
+		{name: "malformed json", value: `{"url":`, wantErr: true},
+		{name: "json with non-string values", value: `{"param2":5}`, wantErr: true},
+		{name: "old format", value: "map[param1:job-1 param2:5]", want: map[string]string{"param1": "job-1", "param2": "5"}},
+		{name: "old format empty", value: "map[]", want: map[string]string{}},
+		{name: "old format value with spaces", value: "map[command:echo hello  world dir:/tmp]", want: map[string]string{"command": "echo hello world", "dir": "/tmp"}},
+		{name: "old format value with colons", value: "map[method:GET url:http://example.com:8080/a]", want: map[string]string{"method": "GET", "url": "http://example.com:8080/a"}},
+		{name: "old format without a key first", value: "map[hello url:http://example.com]", wantErr: true},
+		{name: "neither format", value: "param1=job-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseJobParams(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseJobParams(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && !maps.Equal(got, tt.want) {
+				t.Errorf("parseJobParams(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadParamsEnv(t *testing.T) {
+	handler := &JobHandler{Name: "test", Params: []ParamSpec{
+		{Name: "contentType", Type: ParamString},
+		{Name: "max-retries", Type: ParamInt},
+	}}
+	tests := []struct {
+		name    string
+		environ []string
+		prefix  string
+		names   []string
+		want    map[string]string
+	}{
+		{name: "no params", environ: []string{"PATH=/bin", "JOB_NAME=test"}, prefix: "PARAM_", names: []string{""}, want: map[string]string{}},
+		{
+			name:    "matched to the handler params",
+			environ: []string{"PARAM_CONTENTTYPE=text/plain", "PARAM_MAX_RETRIES=3", "PATH=/bin"},
+			prefix:  "PARAM_",
+			names:   []string{"CONTENTTYPE", "MAX_RETRIES"},
+			want:    map[string]string{"contentType": "text/plain", "max-retries": "3"},
+		},
+		{name: "unknown names are lower-cased", environ: []string{"PARAM_TIMEOUT=10s"}, prefix: "PARAM_", names: []string{"TIMEOUT"}, want: map[string]string{"timeout": "10s"}},
+		{name: "values keep = and spaces", environ: []string{"PARAM_CONTENTTYPE=a=b c"}, prefix: "PARAM_", names: []string{"CONTENTTYPE"}, want: map[string]string{"contentType": "a=b c"}},
+		{name: "empty values", environ: []string{"PARAM_CONTENTTYPE="}, prefix: "PARAM_", names: []string{"CONTENTTYPE"}, want: map[string]string{"contentType": ""}},
+		{name: "prefix alone is skipped", environ: []string{"PARAM_=x"}, prefix: "PARAM_", names: []string{""}, want: map[string]string{}},
+		{name: "declared name not set", environ: []string{"PATH=/bin"}, prefix: "PARAM_", names: []string{"TIMEOUT"}, want: map[string]string{}},
+		{
+			name:    "undeclared names are skipped",
+			environ: []string{"PARAM_CONTENTTYPE=text/plain", "PARAM_EXTRA=1"},
+			prefix:  "PARAM_",
+			names:   []string{"CONTENTTYPE"},
+			want:    map[string]string{"contentType": "text/plain"},
+		},
+		{
+			name:    "service env vars sharing the prefix",
+			environ: []string{"API_URL=http://example.com", "API_SERVICE_HOST=10.0.0.1", "API_SERVICE_PORT=80", "API_PORT=tcp://10.0.0.1:80"},
+			prefix:  "API_",
+			names:   []string{"URL"},
+			want:    map[string]string{"url": "http://example.com"},
+		},
+		{
+			name:    "custom prefix",
+			environ: []string{"JOB_CONTENTTYPE=text/plain", "PARAM_MAX_RETRIES=3"},
+			prefix:  "JOB_",
+			names:   []string{"CONTENTTYPE", "MAX_RETRIES"},
+			want:    map[string]string{"contentType": "text/plain"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readParamsEnv(handler, tt.environ, tt.prefix, tt.names); !maps.Equal(got, tt.want) {
+				t.Errorf("readParamsEnv() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
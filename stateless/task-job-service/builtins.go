@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxResultBytes caps how much output a handler keeps as the job result
+const maxResultBytes = 4096
+
+func init() {
+	registerHandler(&JobHandler{
+		Name:        "sleep",
+		Description: "Simulates work by sleeping, the original task-job behaviour",
+		Params: []ParamSpec{
+			{Name: "param1", Type: ParamString, Description: "Job ID echoed in the result"},
+			{Name: "param2", Type: ParamInt, Description: "Seconds to sleep, defaults to JOBPROCESSINGTIME"},
+		},
+		run: runSleep,
+	})
+	registerHandler(&JobHandler{
+		Name:        "http",
+		Description: "Calls an HTTP endpoint and fails on a non-2xx response",
+		Params: []ParamSpec{
+			{Name: "url", Type: ParamString, Required: true, Description: "URL to call"},
+			{Name: "method", Type: ParamString, Default: http.MethodGet,
+				Values: []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}, Description: "HTTP method"},
+			{Name: "body", Type: ParamString, Description: "Request body"},
+			{Name: "contentType", Type: ParamString, Default: "application/json", Description: "Content-Type of the body"},
+			{Name: "timeout", Type: ParamDuration, Default: "30s", Description: "Request timeout"},
+		},
+		run: runHTTP,
+	})
+	registerHandler(&JobHandler{
+		Name:        "checksum",
+		Description: "Computes the checksum of a file, or of every file in a directory, under DATA_DIR",
+		Params: []ParamSpec{
+			{Name: "path", Type: ParamString, Required: true, Description: "File or directory, relative to DATA_DIR"},
+			{Name: "algorithm", Type: ParamString, Default: "sha256", Values: []string{"sha256", "sha1", "md5"}, Description: "Hash algorithm"},
+		},
+		run: runChecksum,
+	})
+	registerHandler(&JobHandler{
+		Name:        "shell",
+		Description: "Runs a command with sh -c, only when ENABLE_SHELL_HANDLER is true",
+		Params: []ParamSpec{
+			{Name: "command", Type: ParamString, Required: true, Description: "Command line passed to sh -c"},
+			{Name: "dir", Type: ParamString, Description: "Working directory"},
+			{Name: "timeout", Type: ParamDuration, Default: "5m", Description: "Time before the command is killed"},
+		},
+		run:     runShell,
+		enabled: func() bool { return shellHandlerEnabled },
+	})
+}
+
+// runSleep simulates work for param2 seconds (or the default processing time)
+func runSleep(ctx context.Context, params Params) (string, error) {
+	processingTime := time.Duration(defaultProcessing) * time.Second
+	if _, ok := params["param2"]; ok {
+		processingTime = time.Duration(params.Int("param2")) * time.Second
+	}
+
+	select {
+	case <-time.After(processingTime):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	return fmt.Sprintf("Job with ID '%s' completed at %v", params.String("param1"), time.Now()), nil
+}
+
+func runHTTP(ctx context.Context, params Params) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, params.Duration("timeout"))
+	defer cancel()
+
+	var body io.Reader
+	if b := params.String("body"); b != "" {
+		body = strings.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, params.String("method"), params.String("url"), body)
+	if err != nil {
+		return "", fmt.Errorf("invalid request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", params.String("contentType"))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResultBytes))
+	if err != nil {
+		return "", fmt.Errorf("couldn't read response: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("%s returned %s: %s", req.URL, resp.Status, data)
+	}
+	return fmt.Sprintf("%s %s: %s", req.Method, resp.Status, data), nil
+}
+
+func runChecksum(ctx context.Context, params Params) (string, error) {
+	newHash, err := hashFunc(params.String("algorithm"))
+	if err != nil {
+		return "", err
+	}
+	path, err := dataPath(params.String("path"))
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		sum, err := checksumFile(newHash, path)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s  %s", sum, params.String("path")), nil
+	}
+
+	// A directory hashes to the digest of its "<sum>  <relative path>" lines, which
+	// WalkDir produces in lexical order
+	dirHash := newHash()
+	files := 0
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		sum, err := checksumFile(newHash, p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(path, p)
+		fmt.Fprintf(dirHash, "%s  %s\n", sum, filepath.ToSlash(rel))
+		files++
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s  %s (%d files)", hex.EncodeToString(dirHash.Sum(nil)), params.String("path"), files), nil
+}
+
+func runShell(ctx context.Context, params Params) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, params.Duration("timeout"))
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", params.String("command"))
+	cmd.Dir = params.String("dir")
+	// Don't wait forever on children of the shell that keep the output open after a cancel
+	cmd.WaitDelay = 5 * time.Second
+	out, err := cmd.CombinedOutput()
+	if len(out) > maxResultBytes {
+		out = out[len(out)-maxResultBytes:]
+	}
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, out)
+	}
+	return string(out), nil
+}
+
+func hashFunc(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New, nil
+	case "sha1":
+		return sha1.New, nil
+	case "md5":
+		return md5.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+}
+
+// dataPath resolves a path relative to DATA_DIR and refuses to leave it, also through
+// symlinks. Symlinks below a directory aren't followed by the walk in runChecksum.
+func dataPath(path string) (string, error) {
+	full := filepath.Join(dataDir, filepath.FromSlash(path))
+	if !withinDir(dataDir, full) {
+		return "", fmt.Errorf("path %q is outside of %s", path, dataDir)
+	}
+	root, err := filepath.EvalSymlinks(dataDir)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		return "", err
+	}
+	if !withinDir(root, resolved) {
+		return "", fmt.Errorf("path %q is outside of %s", path, dataDir)
+	}
+	return resolved, nil
+}
+
+// withinDir tells whether path is dir or below it, comparing the paths lexically
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func checksumFile(newHash func() hash.Hash, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parameter types understood by the handler schemas
+const (
+	ParamString   = "string"
+	ParamInt      = "int"
+	ParamBool     = "bool"
+	ParamDuration = "duration"
+)
+
+var errInvalidJob = errors.New("invalid job")
+
+// ParamSpec describes one parameter of a job handler
+type ParamSpec struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Required    bool     `json:"required,omitempty"`
+	Default     string   `json:"default,omitempty"`
+	Values      []string `json:"values,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// JobHandler is a named kind of job with a typed parameter schema
+type JobHandler struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Params      []ParamSpec `json:"params"`
+
+	run func(ctx context.Context, params Params) (string, error)
+	// enabled, when set, reports whether the handler may be used
+	enabled func() bool
+}
+
+// Params holds parameters that were validated against a handler schema,
+// so the typed getters never fail
+type Params map[string]string
+
+// String returns a string parameter
+func (p Params) String(name string) string {
+	return p[name]
+}
+
+// Int returns an int parameter
+func (p Params) Int(name string) int {
+	v, _ := strconv.Atoi(p[name])
+	return v
+}
+
+// Bool returns a bool parameter
+func (p Params) Bool(name string) bool {
+	v, _ := strconv.ParseBool(p[name])
+	return v
+}
+
+// Duration returns a duration parameter
+func (p Params) Duration(name string) time.Duration {
+	v, _ := parseDuration(p[name])
+	return v
+}
+
+var handlers = map[string]*JobHandler{}
+
+// registerHandler makes a handler available by name
+func registerHandler(h *JobHandler) {
+	if _, exists := handlers[h.Name]; exists {
+		panic("job handler registered twice: " + h.Name)
+	}
+	handlers[h.Name] = h
+}
+
+// lookupHandler returns the handler with the given name
+func lookupHandler(name string) (*JobHandler, error) {
+	h, ok := handlers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown job handler %q, available handlers: %s", errInvalidJob, name, strings.Join(handlerNames(), ", "))
+	}
+	if h.enabled != nil && !h.enabled() {
+		return nil, fmt.Errorf("%w: job handler %q is disabled", errInvalidJob, name)
+	}
+	return h, nil
+}
+
+// defaultHandlerName picks the handler for requests that don't name one: JOB_NAME when
+// it names a handler, sleep otherwise
+func defaultHandlerName() string {
+	if name := os.Getenv("JOB_NAME"); name != "" {
+		if _, ok := handlers[name]; ok {
+			return name
+		}
+	}
+	return "sleep"
+}
+
+func handlerNames() []string {
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks params against the schema, fills in defaults and rejects unknown params
+func (h *JobHandler) Validate(params map[string]string) (Params, error) {
+	out := Params{}
+	known := map[string]bool{}
+
+	for _, spec := range h.Params {
+		known[spec.Name] = true
+		value, ok := params[spec.Name]
+		if !ok || value == "" {
+			if spec.Required {
+				return nil, fmt.Errorf("%w: %s: missing required parameter %q", errInvalidJob, h.Name, spec.Name)
+			}
+			if spec.Default == "" {
+				continue
+			}
+			value = spec.Default
+		}
+		if err := checkParamType(spec.Type, value); err != nil {
+			return nil, fmt.Errorf("%w: %s: parameter %q: %v", errInvalidJob, h.Name, spec.Name, err)
+		}
+		if len(spec.Values) > 0 && !slices.Contains(spec.Values, value) {
+			return nil, fmt.Errorf("%w: %s: parameter %q must be one of %s, got %q", errInvalidJob, h.Name, spec.Name, strings.Join(spec.Values, ", "), value)
+		}
+		out[spec.Name] = value
+	}
+
+	for name := range params {
+		if !known[name] {
+			return nil, fmt.Errorf("%w: %s: unknown parameter %q", errInvalidJob, h.Name, name)
+		}
+	}
+	return out, nil
+}
+
+// Run executes the handler with validated params
+func (h *JobHandler) Run(ctx context.Context, params Params) (string, error) {
+	return h.run(ctx, params)
+}
+
+func checkParamType(paramType, value string) error {
+	var err error
+	switch paramType {
+	case ParamInt:
+		_, err = strconv.Atoi(value)
+	case ParamBool:
+		_, err = strconv.ParseBool(value)
+	case ParamDuration:
+		_, err = parseDuration(value)
+	}
+	if err != nil {
+		return fmt.Errorf("expected %s, got %q", paramType, value)
+	}
+	return nil
+}
+
+// parseDuration accepts Go durations ("90s", "5m") and plain numbers of seconds
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
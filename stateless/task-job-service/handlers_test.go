@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupHandler(t *testing.T) {
+	for _, name := range []string{"sleep", "http", "checksum"} {
+		if h, err := lookupHandler(name); err != nil || h.Name != name {
+			t.Errorf("lookupHandler(%q) = %v, %v", name, h, err)
+		}
+	}
+	if _, err := lookupHandler("unknown"); !errors.Is(err, errInvalidJob) {
+		t.Errorf("lookupHandler() of an unknown handler error = %v, want %v", err, errInvalidJob)
+	}
+}
+
+func TestDefaultHandlerName(t *testing.T) {
+	tests := []struct {
+		jobName string
+		want    string
+	}{
+		{jobName: "", want: "sleep"},
+		{jobName: "http", want: "http"},
+		{jobName: "checksum", want: "checksum"},
+		// JOB_NAME also names the workload, which needn't be a handler
+		{jobName: "nightly-report", want: "sleep"},
+	}
+	for _, tt := range tests {
+		t.Setenv("JOB_NAME", tt.jobName)
+		if name := defaultHandlerName(); name != tt.want {
+			t.Errorf("defaultHandlerName() = %q with JOB_NAME=%q, want %q", name, tt.jobName, tt.want)
+		}
+	}
+}
+
+func TestShellHandlerOptIn(t *testing.T) {
+	enabled := shellHandlerEnabled
+	t.Cleanup(func() { shellHandlerEnabled = enabled })
+
+	shellHandlerEnabled = false
+	if _, err := lookupHandler("shell"); !errors.Is(err, errInvalidJob) {
+		t.Errorf("lookupHandler(shell) error = %v while disabled, want %v", err, errInvalidJob)
+	}
+	q := NewMemoryQueue(1)
+	if _, err := q.Submit("shell", map[string]string{"command": "true"}); !errors.Is(err, errInvalidJob) {
+		t.Errorf("Submit(shell) error = %v while disabled, want %v", err, errInvalidJob)
+	}
+
+	shellHandlerEnabled = true
+	if _, err := lookupHandler("shell"); err != nil {
+		t.Errorf("lookupHandler(shell) error = %v once enabled", err)
+	}
+}
+
+func TestBuiltinValidate(t *testing.T) {
+	tests := []struct {
+		handler string
+		params  map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{handler: "sleep", params: nil, want: map[string]string{}},
+		{handler: "sleep", params: map[string]string{"param1": "job-1", "param2": "5"}, want: map[string]string{"param1": "job-1", "param2": "5"}},
+		{handler: "sleep", params: map[string]string{"param2": "five"}, wantErr: true},
+		{handler: "sleep", params: map[string]string{"param3": "x"}, wantErr: true},
+		{
+			handler: "http",
+			params:  map[string]string{"url": "http://example.com"},
+			want:    map[string]string{"url": "http://example.com", "method": "GET", "contentType": "application/json", "timeout": "30s"},
+		},
+		{handler: "http", params: map[string]string{"method": "POST"}, wantErr: true},
+		{handler: "http", params: map[string]string{"url": "http://example.com", "method": "CONNECT"}, wantErr: true},
+		{handler: "http", params: map[string]string{"url": "http://example.com", "timeout": "soon"}, wantErr: true},
+		{
+			handler: "http",
+			params:  map[string]string{"url": "http://example.com", "timeout": "10"},
+			want:    map[string]string{"url": "http://example.com", "method": "GET", "contentType": "application/json", "timeout": "10"},
+		},
+		{handler: "checksum", params: map[string]string{"path": "reports"}, want: map[string]string{"path": "reports", "algorithm": "sha256"}},
+		{handler: "checksum", params: map[string]string{"path": "reports", "algorithm": "crc32"}, wantErr: true},
+		{handler: "checksum", params: map[string]string{}, wantErr: true},
+		{handler: "shell", params: map[string]string{"command": "date"}, want: map[string]string{"command": "date", "timeout": "5m"}},
+		{handler: "shell", params: map[string]string{"command": ""}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.handler, func(t *testing.T) {
+			got, err := handlers[tt.handler].Validate(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate(%v) error = %v, wantErr %v", tt.params, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidJob) {
+					t.Errorf("Validate(%v) error = %v, want %v", tt.params, err, errInvalidJob)
+				}
+				return
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("Validate(%v) = %v, want %v", tt.params, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDataPath(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	oldDataDir := dataDir
+	dataDir = root
+	t.Cleanup(func() { dataDir = oldDataDir })
+
+	if err := os.MkdirAll(filepath.Join(root, "reports"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{filepath.Join(root, "reports", "a.csv"), filepath.Join(outside, "secret")} {
+		if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"escape": outside, "secret": filepath.Join(outside, "secret"), "latest": "reports"} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path, wantErr := range map[string]bool{
+		"reports/a.csv":     false,
+		".":                 false,
+		"latest/a.csv":      false,
+		"../etc/passwd":     true,
+		"reports/../../etc": true,
+		"escape":            true,
+		"escape/secret":     true,
+		"secret":            true,
+		"missing":           true,
+	} {
+		if _, err := dataPath(path); (err != nil) != wantErr {
+			t.Errorf("dataPath(%q) error = %v, wantErr %v", path, err, wantErr)
+		}
+	}
+}
@@ -1,18 +1,41 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	serverPort        = "8080" // Default port
-	defaultProcessing = 5      // Default job processing delay in seconds
-	counter           = 0
+	serverPort        = "8080"  // Default port
+	defaultProcessing = 5       // Default job processing delay in seconds
+	workerCount       = 4       // Number of jobs processed in parallel
+	queueSize         = 100     // Maximum number of jobs waiting in the queue
+	dataDir           = "/data" // Root of the files the checksum handler may read
+
+	shellHandlerEnabled = false // The shell handler runs arbitrary commands, so it is opt-in
+
+	runMode            = "server"               // "server" serves the job API, "batch" runs one job and exits
+	terminationLogPath = "/dev/termination-log" // Where batch mode writes its result for Kubernetes
+
+	shutdownGracePeriod = 25 * time.Second // How long in-flight jobs may run after SIGTERM
+
+	metricsPort = "" // Serves /metrics on its own port when set, on serverPort otherwise
+	counter     = 0
+
+	queueDatabaseURL = "" // Postgres connection string, keeps jobs in Postgres instead of memory when set
+
+	jobQueue Queue
 )
 
 func init() {
@@ -25,12 +48,46 @@ func init() {
 			defaultProcessing = parsedDelay
 		}
 	}
+	if workers, exists := os.LookupEnv("WORKERS"); exists {
+		if parsedWorkers, err := strconv.Atoi(workers); err == nil && parsedWorkers > 0 {
+			workerCount = parsedWorkers
+		}
+	}
+	if size, exists := os.LookupEnv("QUEUESIZE"); exists {
+		if parsedSize, err := strconv.Atoi(size); err == nil && parsedSize > 0 {
+			queueSize = parsedSize
+		}
+	}
+	if dir, exists := os.LookupEnv("DATA_DIR"); exists {
+		dataDir = dir
+	}
+	if enabled, exists := os.LookupEnv("ENABLE_SHELL_HANDLER"); exists {
+		shellHandlerEnabled = enabled == "true"
+	}
+	if mode, exists := os.LookupEnv("RUN_MODE"); exists {
+		runMode = mode
+	}
+	if path, exists := os.LookupEnv("TERMINATION_LOG"); exists {
+		terminationLogPath = path
+	}
+	if url, exists := os.LookupEnv("QUEUE_DATABASE_URL"); exists {
+		queueDatabaseURL = url
+	}
+	if port, exists := os.LookupEnv("METRICS_PORT"); exists {
+		metricsPort = port
+	}
+	if grace, exists := os.LookupEnv("SHUTDOWN_GRACE_PERIOD"); exists {
+		if parsedGrace, err := parseDuration(grace); err == nil && parsedGrace >= 0 {
+			shutdownGracePeriod = parsedGrace
+		}
+	}
 }
 
+// jobHandler runs a job synchronously, kept for backward compatibility with /task-job
 func jobHandler(w http.ResponseWriter, r *http.Request) {
 	// Get job parameters from query string
-	jobID := r.URL.Query().Get("param1")           // Job ID
-	processingStr := r.URL.Query().Get("param2")  // Processing time for this job
+	jobID := r.URL.Query().Get("param1")         // Job ID
+	processingStr := r.URL.Query().Get("param2") // Processing time for this job
 
 	if jobID == "" {
 		http.Error(w, "Missing job parameter: param1", http.StatusBadRequest)
@@ -46,23 +103,118 @@ func jobHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("Executing job %s for %d seconds", jobID, processingTime)
-	time.Sleep(time.Duration(processingTime) * time.Second)
+	observeJobEnd := observeJobStart(legacyJobType)
+	select {
+	case <-time.After(time.Duration(processingTime) * time.Second):
+		observeJobEnd(JobSucceeded)
+	case <-r.Context().Done():
+		observeJobEnd(JobCancelled)
+		// The client went away or the server is shutting down
+		log.Printf("Job %s aborted: %v", jobID, context.Cause(r.Context()))
+		http.Error(w, "Job aborted", http.StatusServiceUnavailable)
+		return
+	}
 	fmt.Fprintf(w, "Job with ID '%s' completed at %v", jobID, time.Now())
 }
 
 func heartbeat() {
 	for {
 		counter++
+		heartbeats.Inc()
 		log.Printf("Heartbeat %d: service running...", counter)
 		time.Sleep(10 * time.Second)
 	}
 }
 
 func main() {
+	if runMode == "batch" {
+		os.Exit(runBatch())
+	}
+
 	go heartbeat() // Start periodic task in background
 
+	if queueDatabaseURL != "" {
+		queue, err := NewPostgresQueue(queueDatabaseURL, queueSize)
+		if err != nil {
+			log.Fatalf("Failed to set up the Postgres job queue: %v", err)
+		}
+		log.Printf("Using the Postgres job queue")
+		jobQueue = queue
+	} else {
+		jobQueue = NewMemoryQueue(queueSize)
+	}
+	jobQueue.Start(workerCount)
+	registerQueueMetrics(jobQueue)
+
 	http.HandleFunc("/task-job", jobHandler)
+	http.HandleFunc("POST /jobs", submitJobHandler)
+	http.HandleFunc("GET /jobs", listJobsHandler)
+	http.HandleFunc("GET /handlers", listHandlersHandler)
+	http.HandleFunc("GET /jobs/{id}", getJobHandler)
+	http.HandleFunc("DELETE /jobs/{id}", cancelJobHandler)
+	http.HandleFunc("GET /healthz", healthzHandler)
+	http.HandleFunc("GET /readyz", readyzHandler)
+	if metricsPort == "" || metricsPort == serverPort {
+		http.Handle("GET /metrics", promhttp.Handler())
+	} else {
+		go serveMetrics()
+	}
 
-	log.Printf("Starting task job server on port %s...", serverPort)
-	log.Fatal(http.ListenAndServe(":"+serverPort, nil))
+	// Requests in flight are cancelled through baseCtx once the grace period is over
+	baseCtx, abortRequests := context.WithCancelCause(context.Background())
+	server := &http.Server{
+		Addr:        ":" + serverPort,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+
+	go func() {
+		log.Printf("Starting task job server on port %s...", serverPort)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	log.Printf("Shutting down, draining jobs for up to %s", shutdownGracePeriod)
+	shutdown(server, abortRequests)
+	log.Printf("Shutdown complete")
+}
+
+// serveMetrics serves /metrics on METRICS_PORT, it runs until the process exits
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	log.Printf("Serving metrics on port %s...", metricsPort)
+	log.Fatal(http.ListenAndServe(":"+metricsPort, mux))
+}
+
+// shutdown stops accepting requests and jobs, waits up to shutdownGracePeriod for the
+// jobs in flight and then cancels the rest
+func shutdown(server *http.Server, abortRequests context.CancelCauseFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+
+	aborted := make(chan []*Job, 1)
+	go func() { aborted <- jobQueue.Shutdown(ctx) }()
+
+	if err := server.Shutdown(ctx); err != nil {
+		// Give the cancelled requests a moment to respond before closing their connections
+		abortRequests(errAborted)
+		abortCtx, cancelAbort := context.WithTimeout(context.Background(), time.Second)
+		defer cancelAbort()
+		if err := server.Shutdown(abortCtx); err != nil {
+			server.Close()
+		}
+	}
+
+	jobs := <-aborted
+	for _, job := range jobs {
+		log.Printf("Aborted %s job %s while %s", job.Handler, job.ID, job.Status)
+	}
+	if len(jobs) > 0 {
+		log.Printf("Aborted %d jobs on shutdown", len(jobs))
+	}
 }
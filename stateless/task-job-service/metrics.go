@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// legacyJobType labels jobs run through the synchronous /task-job endpoint
+const legacyJobType = "legacy"
+
+var (
+	jobsStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "taskjob_jobs_started_total",
+		Help: "Number of jobs started, by job type.",
+	}, []string{"type"})
+	jobsCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "taskjob_jobs_completed_total",
+		Help: "Number of jobs that succeeded, by job type.",
+	}, []string{"type"})
+	jobsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "taskjob_jobs_failed_total",
+		Help: "Number of jobs that failed, by job type.",
+	}, []string{"type"})
+	jobsCancelled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "taskjob_jobs_cancelled_total",
+		Help: "Number of jobs cancelled while running, by job type.",
+	}, []string{"type"})
+	jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "taskjob_job_duration_seconds",
+		Help:    "Time jobs took to run, by job type and final status.",
+		Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"type", "status"})
+	jobsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "taskjob_jobs_in_flight",
+		Help: "Number of jobs running right now.",
+	})
+	heartbeats = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "taskjob_heartbeats_total",
+		Help: "Number of heartbeats of the service.",
+	})
+)
+
+// registerQueueMetrics exports the depth of the job queue
+func registerQueueMetrics(q Queue) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "taskjob_queue_depth",
+		Help: "Number of jobs waiting for a worker.",
+	}, func() float64 {
+		depth, err := q.Depth()
+		if err != nil {
+			// NaN tells the scrape the depth is unknown, 0 would look like an empty queue
+			log.Printf("Failed to count queued jobs: %v", err)
+			return math.NaN()
+		}
+		return float64(depth)
+	})
+}
+
+// observeJobStart records a job of the given type starting and returns the function
+// recording its end with the final status
+func observeJobStart(jobType string) func(status string) {
+	start := time.Now()
+	jobsStarted.WithLabelValues(jobType).Inc()
+	jobsInFlight.Inc()
+
+	return func(status string) {
+		jobsInFlight.Dec()
+		jobDuration.WithLabelValues(jobType, status).Observe(time.Since(start).Seconds())
+		switch status {
+		case JobSucceeded:
+			jobsCompleted.WithLabelValues(jobType).Inc()
+		case JobFailed:
+			jobsFailed.WithLabelValues(jobType).Inc()
+		case JobCancelled:
+			jobsCancelled.WithLabelValues(jobType).Inc()
+		}
+	}
+}
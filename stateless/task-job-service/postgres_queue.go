@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+const (
+	// pollInterval is how often idle workers look for jobs and running jobs renew their heartbeat
+	pollInterval = time.Second
+	// staleAfter is how long a running job may go without a heartbeat before another worker takes it over
+	staleAfter = 30 * time.Second
+	// depthCacheTTL is how long Saturated reuses a count of the queued jobs, so readiness
+	// probes don't query the database every time
+	depthCacheTTL = 5 * time.Second
+)
+
+const createJobsTable = `
+CREATE TABLE IF NOT EXISTS task_jobs (
+	id               text PRIMARY KEY,
+	handler          text NOT NULL,
+	params           jsonb NOT NULL,
+	status           text NOT NULL,
+	result           text NOT NULL DEFAULT '',
+	error            text NOT NULL DEFAULT '',
+	created_at       timestamptz NOT NULL DEFAULT now(),
+	started_at       timestamptz,
+	finished_at      timestamptz,
+	worker           text,
+	heartbeat_at     timestamptz,
+	cancel_requested boolean NOT NULL DEFAULT false
+);
+CREATE INDEX IF NOT EXISTS task_jobs_pending ON task_jobs (created_at) WHERE status IN ('Queued', 'Running');
+`
+
+const jobColumns = `id, handler, params, status, result, error, created_at, started_at, finished_at`
+
+// PostgresQueue keeps jobs in a Postgres table, so replicas pointing at the same database
+// share one queue and jobs survive restarts. Workers claim jobs with FOR UPDATE SKIP LOCKED.
+type PostgresQueue struct {
+	db       *sql.DB
+	size     int
+	workerID string
+
+	// wake tells an idle local worker about a new job before the next poll
+	wake chan struct{}
+	// stop is closed by Shutdown
+	stop chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	workers sync.WaitGroup
+	// size of the worker pool and the jobs its workers are running
+	poolSize int
+	active   map[string]*Job
+	// last count of the queued jobs taken by Saturated
+	cachedDepth   int
+	cachedDepthAt time.Time
+}
+
+// NewPostgresQueue connects to the database and creates the jobs table if needed. At most
+// size jobs may wait in the queue across all replicas.
+func NewPostgresQueue(url string, size int) (*PostgresQueue, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("couldn't connect: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, createJobsTable); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("couldn't create jobs table: %v", err)
+	}
+
+	// The pod name tells replicas apart, the job ID keeps workers of restarted pods apart
+	host, _ := os.Hostname()
+	return &PostgresQueue{
+		db:       db,
+		size:     size,
+		workerID: host + "-" + newJobID(),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		active:   make(map[string]*Job),
+	}, nil
+}
+
+// Start launches the workers
+func (q *PostgresQueue) Start(workers int) {
+	q.mu.Lock()
+	q.poolSize += workers
+	q.mu.Unlock()
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go q.worker()
+	}
+}
+
+// Submit validates params against the named handler and stores a new job, failing when the
+// queue is full. The limit is checked before the insert, so concurrent submits on several
+// replicas may overshoot it slightly.
+func (q *PostgresQueue) Submit(handlerName string, params map[string]string) (*Job, error) {
+	if q.Draining() {
+		return nil, errShuttingDown
+	}
+	handler, err := lookupHandler(handlerName)
+	if err != nil {
+		return nil, err
+	}
+	validated, err := handler.Validate(params)
+	if err != nil {
+		return nil, err
+	}
+	depth, err := q.Depth()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't count queued jobs: %v", err)
+	}
+	if depth >= q.size {
+		return nil, errQueueFull
+	}
+
+	data, _ := json.Marshal(validated)
+	row := q.db.QueryRow(`INSERT INTO task_jobs (id, handler, params, status) VALUES ($1, $2, $3, $4)
+		RETURNING `+jobColumns, newJobID(), handler.Name, string(data), JobQueued)
+	job, err := scanJob(row)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't store job: %v", err)
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Get returns the job with the given ID
+func (q *PostgresQueue) Get(id string) (*Job, error) {
+	job, err := scanJob(q.db.QueryRow(`SELECT `+jobColumns+` FROM task_jobs WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errJobNotFound
+	}
+	return job, err
+}
+
+// List returns all jobs, oldest first
+func (q *PostgresQueue) List() ([]*Job, error) {
+	rows, err := q.db.Query(`SELECT ` + jobColumns + ` FROM task_jobs ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Cancel stops a queued job right away. A running job is flagged, and the replica running it
+// cancels it on its next heartbeat.
+func (q *PostgresQueue) Cancel(id string) (*Job, error) {
+	job, err := scanJob(q.db.QueryRow(`UPDATE task_jobs SET status = $2, error = $3, finished_at = now()
+		WHERE id = $1 AND status = $4 RETURNING `+jobColumns, id, JobCancelled, "cancelled before start", JobQueued))
+	if err == nil || !errors.Is(err, sql.ErrNoRows) {
+		return job, err
+	}
+
+	job, err = scanJob(q.db.QueryRow(`UPDATE task_jobs SET cancel_requested = true
+		WHERE id = $1 AND status = $2 RETURNING `+jobColumns, id, JobRunning))
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := q.Get(id); err != nil {
+			return nil, err
+		}
+		return nil, errJobFinished
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't wait for the heartbeat when the job runs here
+	q.mu.Lock()
+	if local, ok := q.active[id]; ok {
+		local.cancel(errCancelled)
+	}
+	q.mu.Unlock()
+	return job, nil
+}
+
+// Shutdown stops claiming jobs and lets running jobs finish until ctx is done. Jobs still
+// running by then are cancelled and put back in the queue for another replica.
+func (q *PostgresQueue) Shutdown(ctx context.Context) []*Job {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.stop)
+	}
+	q.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		q.db.Close()
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	var aborted []*Job
+	for _, job := range q.active {
+		aborted = append(aborted, job.snapshot())
+		job.cancel(errAborted)
+	}
+	q.mu.Unlock()
+
+	// Handlers return once their context is cancelled
+	<-drained
+	q.db.Close()
+	return aborted
+}
+
+// Draining reports whether Shutdown has been called
+func (q *PostgresQueue) Draining() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// Saturated reports whether every local worker is busy and the shared queue is full. The
+// queue is only counted while the workers are busy, and the count is reused for depthCacheTTL.
+// A replica that can't count the queue can't take work either, so it reports saturated.
+func (q *PostgresQueue) Saturated() bool {
+	q.mu.Lock()
+	busy := len(q.active) >= q.poolSize
+	fresh := time.Since(q.cachedDepthAt) < depthCacheTTL
+	depth := q.cachedDepth
+	q.mu.Unlock()
+	if !busy {
+		return false
+	}
+
+	if !fresh {
+		var err error
+		depth, err = q.Depth()
+		if err != nil {
+			log.Printf("Failed to count queued jobs: %v", err)
+			return true
+		}
+		q.mu.Lock()
+		q.cachedDepth, q.cachedDepthAt = depth, time.Now()
+		q.mu.Unlock()
+	}
+	return depth >= q.size
+}
+
+// Depth returns the number of jobs waiting for a worker across all replicas
+func (q *PostgresQueue) Depth() (int, error) {
+	var depth int
+	err := q.db.QueryRow(`SELECT count(*) FROM task_jobs WHERE status = $1`, JobQueued).Scan(&depth)
+	return depth, err
+}
+
+func (q *PostgresQueue) worker() {
+	defer q.workers.Done()
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+
+		job, err := q.claim()
+		if err != nil {
+			log.Printf("Failed to claim a job: %v", err)
+		}
+		if job == nil {
+			select {
+			case <-q.wake:
+			case <-time.After(pollInterval):
+			case <-q.stop:
+				return
+			}
+			continue
+		}
+		q.run(job)
+	}
+}
+
+// claim takes the oldest queued job, or a running job whose worker stopped sending heartbeats.
+// SKIP LOCKED lets concurrent workers claim different jobs without waiting on each other.
+func (q *PostgresQueue) claim() (*Job, error) {
+	job, err := scanJob(q.db.QueryRow(`UPDATE task_jobs
+		SET status = $1, started_at = now(), worker = $2, heartbeat_at = now()
+		WHERE id = (
+			SELECT id FROM task_jobs
+			WHERE status = $3 OR (status = $1 AND heartbeat_at < now() - $4::int * interval '1 second')
+			ORDER BY created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+jobColumns, JobRunning, q.workerID, JobQueued, int(staleAfter.Seconds())))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return job, err
+}
+
+func (q *PostgresQueue) run(job *Job) {
+	handler, err := lookupHandler(job.Handler)
+	if err == nil {
+		job.Params, err = handler.Validate(job.Params)
+	}
+	if err != nil {
+		// Stored by a replica running a different version of the service
+		q.finish(job, JobFailed, "", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	job.handler, job.ctx, job.cancel = handler, ctx, cancel
+
+	q.mu.Lock()
+	q.active[job.ID] = job
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.active, job.ID)
+		q.mu.Unlock()
+	}()
+
+	stopHeartbeat := make(chan struct{})
+	go q.heartbeat(job, stopHeartbeat)
+
+	log.Printf("Executing %s job %s", handler.Name, job.ID)
+	observeJobEnd := observeJobStart(handler.Name)
+	result, err := handler.Run(ctx, job.Params)
+	close(stopHeartbeat)
+
+	switch {
+	case errors.Is(context.Cause(ctx), errAborted):
+		// Leave the job to another replica
+		observeJobEnd(JobCancelled)
+		q.requeue(job)
+		return
+	case ctx.Err() != nil:
+		q.finish(job, JobCancelled, "", context.Cause(ctx).Error())
+	case err != nil:
+		q.finish(job, JobFailed, "", err.Error())
+	default:
+		q.finish(job, JobSucceeded, result, "")
+	}
+	observeJobEnd(job.Status)
+}
+
+// heartbeat marks the job as alive until stop is closed, and cancels it once a cancel is requested
+func (q *PostgresQueue) heartbeat(job *Job, stop chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		var cancelRequested bool
+		err := q.db.QueryRow(`UPDATE task_jobs SET heartbeat_at = now() WHERE id = $1 AND worker = $2
+			RETURNING cancel_requested`, job.ID, q.workerID).Scan(&cancelRequested)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// Taken over by another worker after missing heartbeats
+			job.cancel(errors.New("claimed by another worker"))
+		case err != nil:
+			log.Printf("Failed to record heartbeat of job %s: %v", job.ID, err)
+		case cancelRequested:
+			job.cancel(errCancelled)
+		}
+	}
+}
+
+// finish records the outcome unless another worker took the job over in the meantime
+func (q *PostgresQueue) finish(job *Job, status, result, errMsg string) {
+	job.finish(status, result, errMsg)
+	_, err := q.db.Exec(`UPDATE task_jobs SET status = $3, result = $4, error = $5, finished_at = now()
+		WHERE id = $1 AND worker = $2`, job.ID, q.workerID, status, result, errMsg)
+	if err != nil {
+		log.Printf("Failed to record the result of job %s: %v", job.ID, err)
+		return
+	}
+	log.Printf("Job %s finished: %s", job.ID, status)
+	q.pruneFinished()
+}
+
+func (q *PostgresQueue) requeue(job *Job) {
+	_, err := q.db.Exec(`UPDATE task_jobs SET status = $3, started_at = NULL, worker = NULL, heartbeat_at = NULL
+		WHERE id = $1 AND worker = $2`, job.ID, q.workerID, JobQueued)
+	if err != nil {
+		log.Printf("Failed to requeue job %s: %v", job.ID, err)
+		return
+	}
+	log.Printf("Job %s put back in the queue", job.ID)
+}
+
+// pruneFinished drops the oldest finished jobs beyond maxFinishedJobs
+func (q *PostgresQueue) pruneFinished() {
+	_, err := q.db.Exec(`DELETE FROM task_jobs WHERE id IN (
+		SELECT id FROM task_jobs WHERE finished_at IS NOT NULL ORDER BY finished_at DESC OFFSET $1
+	)`, maxFinishedJobs)
+	if err != nil {
+		log.Printf("Failed to prune finished jobs: %v", err)
+	}
+}
+
+// scanJob reads the jobColumns of a row
+func scanJob(row interface{ Scan(...any) error }) (*Job, error) {
+	var job Job
+	var params []byte
+	err := row.Scan(&job.ID, &job.Handler, &params, &job.Status, &job.Result, &job.Error,
+		&job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(params, &job.Params); err != nil {
+		return nil, fmt.Errorf("invalid params of job %s: %v", job.ID, err)
+	}
+	return &job, nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job states
+const (
+	JobQueued    = "Queued"
+	JobRunning   = "Running"
+	JobSucceeded = "Succeeded"
+	JobFailed    = "Failed"
+	JobCancelled = "Cancelled"
+)
+
+// maxFinishedJobs bounds the memory used by finished jobs, the oldest are dropped first
+const maxFinishedJobs = 1000
+
+var (
+	errQueueFull    = errors.New("job queue is full")
+	errShuttingDown = errors.New("service is shutting down")
+	errJobNotFound  = errors.New("job not found")
+	errJobFinished  = errors.New("job already finished")
+
+	// Cancellation causes recorded as the job error
+	errCancelled = errors.New("cancelled")
+	errAborted   = errors.New("aborted on shutdown")
+)
+
+// Job is a unit of work submitted through the async API
+type Job struct {
+	ID         string            `json:"id"`
+	Handler    string            `json:"handler"`
+	Params     map[string]string `json:"params,omitempty"`
+	Status     string            `json:"status"`
+	Result     string            `json:"result,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	StartedAt  *time.Time        `json:"startedAt,omitempty"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+
+	handler *JobHandler
+	// ctx is cancelled through DELETE /jobs/{id} or on shutdown
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// Queue stores submitted jobs and runs them on a pool of workers
+type Queue interface {
+	// Start launches the workers
+	Start(workers int)
+	// Submit validates params against the named handler and queues a new job
+	Submit(handlerName string, params map[string]string) (*Job, error)
+	// Get returns the job with the given ID
+	Get(id string) (*Job, error)
+	// List returns all known jobs, oldest first
+	List() ([]*Job, error)
+	// Cancel stops a queued or running job
+	Cancel(id string) (*Job, error)
+	// Shutdown stops taking jobs, drains until ctx is done and returns the jobs it aborted
+	Shutdown(ctx context.Context) []*Job
+	// Draining reports whether Shutdown has been called
+	Draining() bool
+	// Saturated reports whether every worker is busy and the queue is full
+	Saturated() bool
+	// Depth returns the number of jobs waiting for a worker
+	Depth() (int, error)
+}
+
+// MemoryQueue is a bounded in-memory queue drained by a fixed pool of workers. Jobs are
+// lost when the service restarts.
+type MemoryQueue struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	queue   chan *Job
+	closed  bool
+	workers sync.WaitGroup
+	// size of the worker pool and how many of the workers are running a job
+	poolSize int
+	running  int
+}
+
+// NewMemoryQueue creates a queue holding at most size pending jobs
+func NewMemoryQueue(size int) *MemoryQueue {
+	return &MemoryQueue{
+		jobs:  make(map[string]*Job),
+		queue: make(chan *Job, size),
+	}
+}
+
+// Start launches the workers
+func (q *MemoryQueue) Start(workers int) {
+	q.mu.Lock()
+	q.poolSize += workers
+	q.mu.Unlock()
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go q.worker()
+	}
+}
+
+// Submit validates params against the named handler and queues a new job, failing when the queue is full
+func (q *MemoryQueue) Submit(handlerName string, params map[string]string) (*Job, error) {
+	handler, err := lookupHandler(handlerName)
+	if err != nil {
+		return nil, err
+	}
+	validated, err := handler.Validate(params)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	job := &Job{
+		ID:        newJobID(),
+		Handler:   handler.Name,
+		Params:    validated,
+		handler:   handler,
+		Status:    JobQueued,
+		CreatedAt: time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		cancel(errShuttingDown)
+		return nil, errShuttingDown
+	}
+	select {
+	case q.queue <- job:
+	default:
+		cancel(errQueueFull)
+		return nil, errQueueFull
+	}
+	q.jobs[job.ID] = job
+	return job.snapshot(), nil
+}
+
+// Get returns a copy of the job with the given ID
+func (q *MemoryQueue) Get(id string) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+	return job.snapshot(), nil
+}
+
+// List returns copies of all jobs, oldest first
+func (q *MemoryQueue) List() ([]*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]*Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		jobs = append(jobs, job.snapshot())
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+// Cancel stops a queued or running job
+func (q *MemoryQueue) Cancel(id string) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+	if job.finished() {
+		return nil, errJobFinished
+	}
+	job.cancel(errCancelled)
+	// A queued job never reaches a worker's run, so finish it here
+	if job.Status == JobQueued {
+		job.finish(JobCancelled, "", "cancelled before start")
+		q.pruneFinished()
+	}
+	return job.snapshot(), nil
+}
+
+// Shutdown stops accepting jobs and lets the workers drain the queue until ctx is done.
+// Jobs still queued or running by then are cancelled and returned.
+func (q *MemoryQueue) Shutdown(ctx context.Context) []*Job {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Report the state each job was in when it got aborted
+	q.mu.Lock()
+	var aborted []*Job
+	for _, job := range q.jobs {
+		if job.finished() {
+			continue
+		}
+		aborted = append(aborted, job.snapshot())
+		job.cancel(errAborted)
+		if job.Status == JobQueued {
+			job.finish(JobCancelled, "", errAborted.Error())
+		}
+	}
+	q.mu.Unlock()
+
+	// Handlers return once their context is cancelled
+	<-drained
+	return aborted
+}
+
+// Draining reports whether Shutdown has been called
+func (q *MemoryQueue) Draining() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// Depth returns the number of jobs waiting for a worker
+func (q *MemoryQueue) Depth() (int, error) {
+	return len(q.queue), nil
+}
+
+// Saturated reports whether every worker is busy and the queue is full, so new jobs are rejected
+func (q *MemoryQueue) Saturated() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.running >= q.poolSize && len(q.queue) >= cap(q.queue)
+}
+
+func (q *MemoryQueue) worker() {
+	defer q.workers.Done()
+	for job := range q.queue {
+		q.run(job)
+	}
+}
+
+func (q *MemoryQueue) run(job *Job) {
+	q.mu.Lock()
+	if job.Status != JobQueued {
+		// Cancelled while waiting in the queue
+		q.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	job.Status = JobRunning
+	job.StartedAt = &now
+	q.running++
+	ctx, params := job.ctx, job.Params
+	q.mu.Unlock()
+
+	log.Printf("Executing %s job %s", job.handler.Name, job.ID)
+	observeJobEnd := observeJobStart(job.handler.Name)
+	result, err := job.handler.Run(ctx, params)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer job.cancel(nil)
+	q.running--
+	switch {
+	case ctx.Err() != nil:
+		job.finish(JobCancelled, "", context.Cause(ctx).Error())
+	case err != nil:
+		job.finish(JobFailed, "", err.Error())
+	default:
+		job.finish(JobSucceeded, result, "")
+	}
+	observeJobEnd(job.Status)
+	q.pruneFinished()
+	log.Printf("Job %s finished: %s", job.ID, job.Status)
+}
+
+// pruneFinished drops the oldest finished jobs beyond maxFinishedJobs, callers hold q.mu
+func (q *MemoryQueue) pruneFinished() {
+	var finished []*Job
+	for _, job := range q.jobs {
+		if job.finished() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].FinishedAt.Before(*finished[j].FinishedAt) })
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(q.jobs, job.ID)
+	}
+}
+
+func (j *Job) finish(status, result, errMsg string) {
+	now := time.Now()
+	j.Status = status
+	j.Result = result
+	j.Error = errMsg
+	j.FinishedAt = &now
+}
+
+func (j *Job) finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCancelled
+}
+
+// snapshot copies the job so it can be encoded without holding the lock
+func (j *Job) snapshot() *Job {
+	out := *j
+	out.handler, out.ctx, out.cancel = nil, nil, nil
+	return &out
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func submitMemory(t *testing.T, q *MemoryQueue, seconds string) *Job {
+	t.Helper()
+	job, err := q.Submit("sleep", map[string]string{"param1": "test", "param2": seconds})
+	if err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	return job
+}
+
+// waitForStatus polls the job until it has status
+func waitForStatus(t *testing.T, q *MemoryQueue, id, status string) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := q.Get(id)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if job.Status == status {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job is %s, want %s", job.Status, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func shutdownNow(q *MemoryQueue) []*Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return q.Shutdown(ctx)
+}
+
+func TestMemoryQueueFull(t *testing.T) {
+	q := NewMemoryQueue(2)
+	t.Cleanup(func() { shutdownNow(q) })
+	submitMemory(t, q, "0")
+	submitMemory(t, q, "0")
+	if !q.Saturated() {
+		t.Error("Saturated() = false with a full queue and no workers")
+	}
+	if _, err := q.Submit("sleep", nil); err != errQueueFull {
+		t.Errorf("Submit() error = %v, want %v", err, errQueueFull)
+	}
+	if depth, _ := q.Depth(); depth != 2 {
+		t.Errorf("Depth() = %d, want 2", depth)
+	}
+}
+
+func TestMemoryQueueSubmitInvalid(t *testing.T) {
+	q := NewMemoryQueue(2)
+	t.Cleanup(func() { shutdownNow(q) })
+	if _, err := q.Submit("unknown", nil); err == nil {
+		t.Error("Submit() of an unknown handler succeeded")
+	}
+	if _, err := q.Submit("sleep", map[string]string{"param2": "soon"}); err == nil {
+		t.Error("Submit() with an invalid param succeeded")
+	}
+	if depth, _ := q.Depth(); depth != 0 {
+		t.Errorf("Depth() = %d, want rejected jobs not queued", depth)
+	}
+}
+
+func TestMemoryQueueRunsJob(t *testing.T) {
+	q := NewMemoryQueue(2)
+	t.Cleanup(func() { shutdownNow(q) })
+	q.Start(1)
+	job := waitForStatus(t, q, submitMemory(t, q, "0").ID, JobSucceeded)
+	if job.Result == "" || job.StartedAt == nil || job.FinishedAt == nil {
+		t.Errorf("job = %+v, want a result with start and finish times", job)
+	}
+	if _, err := q.Cancel(job.ID); err != errJobFinished {
+		t.Errorf("Cancel() of a finished job error = %v, want %v", err, errJobFinished)
+	}
+	if _, err := q.Cancel("missing"); err != errJobNotFound {
+		t.Errorf("Cancel() of an unknown job error = %v, want %v", err, errJobNotFound)
+	}
+}
+
+func TestMemoryQueueCancel(t *testing.T) {
+	q := NewMemoryQueue(2)
+	t.Cleanup(func() { shutdownNow(q) })
+	running := submitMemory(t, q, "60")
+	queued := submitMemory(t, q, "60")
+	q.Start(1)
+	waitForStatus(t, q, running.ID, JobRunning)
+
+	// a queued job is finished right away and skipped by the workers
+	cancelled, err := q.Cancel(queued.ID)
+	if err != nil {
+		t.Fatalf("Cancel() of a queued job error = %v", err)
+	}
+	if cancelled.Status != JobCancelled || cancelled.StartedAt != nil {
+		t.Errorf("queued job after Cancel() = %s, started %v, want %s and never started", cancelled.Status, cancelled.StartedAt, JobCancelled)
+	}
+
+	// a running job is finished by its worker once the handler returns
+	if _, err := q.Cancel(running.ID); err != nil {
+		t.Fatalf("Cancel() of a running job error = %v", err)
+	}
+	job := waitForStatus(t, q, running.ID, JobCancelled)
+	if job.Error != errCancelled.Error() {
+		t.Errorf("error = %q, want %q", job.Error, errCancelled.Error())
+	}
+	if job, _ := q.Get(queued.ID); job.StartedAt != nil {
+		t.Error("a cancelled queued job was started")
+	}
+}
+
+func TestMemoryQueueShutdownDrains(t *testing.T) {
+	q := NewMemoryQueue(2)
+	job := submitMemory(t, q, "0")
+	q.Start(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if aborted := q.Shutdown(ctx); len(aborted) != 0 {
+		t.Errorf("Shutdown() aborted %d jobs, want the queue drained", len(aborted))
+	}
+	if got, _ := q.Get(job.ID); got.Status != JobSucceeded {
+		t.Errorf("job is %s, want %s", got.Status, JobSucceeded)
+	}
+	if !q.Draining() {
+		t.Error("Draining() = false after Shutdown()")
+	}
+	if _, err := q.Submit("sleep", nil); err != errShuttingDown {
+		t.Errorf("Submit() after Shutdown() error = %v, want %v", err, errShuttingDown)
+	}
+}
+
+func TestMemoryQueueShutdownAborts(t *testing.T) {
+	q := NewMemoryQueue(2)
+	running := submitMemory(t, q, "60")
+	queued := submitMemory(t, q, "60")
+	q.Start(1)
+	waitForStatus(t, q, running.ID, JobRunning)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	aborted := q.Shutdown(ctx)
+	states := map[string]string{}
+	for _, job := range aborted {
+		states[job.ID] = job.Status
+	}
+	if len(aborted) != 2 || states[running.ID] != JobRunning || states[queued.ID] != JobQueued {
+		t.Errorf("Shutdown() aborted %v, want the running and the queued job in the state they were in", states)
+	}
+	for _, id := range []string{running.ID, queued.ID} {
+		job, _ := q.Get(id)
+		if job.Status != JobCancelled || job.Error != errAborted.Error() {
+			t.Errorf("job %s is %s (%q), want %s (%q)", id, job.Status, job.Error, JobCancelled, errAborted.Error())
+		}
+	}
+}
+
+func TestMemoryQueuePruneFinished(t *testing.T) {
+	q := NewMemoryQueue(1)
+	start := time.Now()
+	for i := 0; i < maxFinishedJobs+5; i++ {
+		finishedAt := start.Add(time.Duration(i) * time.Second)
+		id := fmt.Sprintf("finished-%d", i)
+		q.jobs[id] = &Job{ID: id, Status: JobSucceeded, FinishedAt: &finishedAt}
+	}
+	q.jobs["queued"] = &Job{ID: "queued", Status: JobQueued}
+
+	q.pruneFinished()
+	if len(q.jobs) != maxFinishedJobs+1 {
+		t.Errorf("%d jobs kept, want %d finished and the queued one", len(q.jobs), maxFinishedJobs)
+	}
+	for i := 0; i < 5; i++ {
+		if _, ok := q.jobs[fmt.Sprintf("finished-%d", i)]; ok {
+			t.Errorf("oldest job finished-%d wasn't pruned", i)
+		}
+	}
+	if _, ok := q.jobs[fmt.Sprintf("finished-%d", maxFinishedJobs+4)]; !ok {
+		t.Error("newest finished job was pruned")
+	}
+	if _, ok := q.jobs["queued"]; !ok {
+		t.Error("a queued job was pruned")
+	}
+}